@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"strings"
+)
+
+// adminConfigPath is the proxy's own endpoint serving its effective
+// configuration, with -admin-token.
+const adminConfigPath = "/admin/config"
+
+// secretFlags are the flags whose values the admin endpoint masks.
+var secretFlags = map[string]bool{
+	"ia-access-key": true,
+	"ia-secret-key": true,
+	"admin-token":   true,
+}
+
+// redactedValue replaces secrets in the configuration served.
+const redactedValue = "[REDACTED]"
+
+type adminConfig struct {
+	Version            versionInfo       `json:"version"`
+	Date               string            `json:"date"` // resolved and normalized
+	HostDates          map[string]string `json:"hostDates"`
+	PathPrefix         string            `json:"pathPrefix"`
+	ArchiveBaseURL     string            `json:"archiveBaseURL"` // captures are fetched from it
+	CDXAPIURL          string            `json:"cdxAPIURL"`      // captures are looked up with it
+	AvailabilityAPIURL string            `json:"availabilityAPIURL"`
+	Flags              map[string]string `json:"flags"`
+}
+
+// effectiveConfig returns the configuration the proxy is running with. Flag
+// values are taken after startup has resolved and adjusted them, e.g. a
+// relative -date or the fallbacks -strict-date turns off. Secret flags are
+// masked, and so are credentials in URLs given to any flag.
+func effectiveConfig() adminConfig {
+	flags := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if secretFlags[f.Name] && value != "" {
+			value = redactedValue
+		}
+		flags[f.Name] = userinfoRe.ReplaceAllString(value, "://"+redactedValue+"@")
+	})
+	return adminConfig{
+		Version:            currentVersion(),
+		Date:               *date,
+		HostDates:          hostDates,
+		PathPrefix:         pathPrefix,
+		ArchiveBaseURL:     archiveBaseURL,
+		CDXAPIURL:          cdxAPIURL,
+		AvailabilityAPIURL: availabilityAPIURL,
+		Flags:              flags,
+	}
+}
+
+// authorizedAdmin reports whether r carries the -admin-token as a bearer
+// token.
+func authorizedAdmin(r *http.Request) bool {
+	header := r.Header.Get("Authorization")
+	if *adminToken == "" || !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) == 1
+}
+
+// handleAdminConfig serves the effective configuration as JSON to requests
+// authorized with the -admin-token.
+func handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	if !authorizedAdmin(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="time-surfer"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(effectiveConfig())
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// availabilityAPIURL is the Wayback Machine's availability API, a simpler
+// service than the CDX API that tends to keep working when the CDX API does
+// not. Like the CDX API it is reached over HTTPS.
+var availabilityAPIURL = "https://archive.org/wayback/available"
+
+type availabilityResponse struct {
+	ArchivedSnapshots struct {
+		Closest *struct {
+			Available bool   `json:"available"`
+			URL       string `json:"url"`
+			Timestamp string `json:"timestamp"`
+			Status    string `json:"status"`
+		} `json:"closest"`
+	} `json:"archived_snapshots"`
+}
+
+// availableWaybackURL resolves originalURL with the availability API, for
+// -use-availability-fallback. Unlike the CDX lookup, which takes the first
+// capture on or after date, the API returns the capture closest to date in
+// either direction.
+func availableWaybackURL(rl *requestLog, originalURL string, date string) (string, error) {
+	apiURL := availabilityAPIURL + "?url=" + cdxURLParam(originalURL) + "&timestamp=" + url.QueryEscape(date)
+	rl.debug("Calling availability API: %s", apiURL)
+
+	req, err := http.NewRequest("GET", apiURL, nil)
+	if err != nil {
+		return "", err
+	}
+	setArchiveAuthorization(req)
+	resp, err := newCDXClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("availability API returned status %d", resp.StatusCode)
+	}
+
+	var availability availabilityResponse
+	if err := json.NewDecoder(resp.Body).Decode(&availability); err != nil {
+		return "", err
+	}
+	closest := availability.ArchivedSnapshots.Closest
+	if closest == nil || !closest.Available || closest.Timestamp == "" || (closest.Status != "" && closest.Status != "200") {
+		return "", fmt.Errorf("%w for %s", ErrNoCapture, originalURL)
+	}
+	return formatWaybackURL(closest.Timestamp, originalURL), nil
+}
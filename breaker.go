@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCDXUnavailable is returned when the CDX API can't be reached or keeps
+// failing, and for lookups made while the circuit breaker is open, without
+// contacting it.
+var ErrCDXUnavailable = errors.New("CDX API unavailable")
+
+// errCircuitOpen is the cause of lookups failed by an open circuit breaker.
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// circuitBreaker stops calls to a failing service for a while. After
+// threshold consecutive failures it opens, and calls fail at once until
+// cooldown has passed. Then a single call is let through as a probe: if it
+// succeeds the breaker closes again, and if it fails it stays open for
+// another cooldown.
+type circuitBreaker struct {
+	name      string
+	threshold int // 0 disables the breaker
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	open      bool
+	probing   bool
+}
+
+// cdxBreaker guards the CDX API, configured by -cdx-breaker-threshold and
+// -cdx-breaker-cooldown.
+var cdxBreaker = &circuitBreaker{name: "CDX API"}
+
+// allow reports whether a call may go ahead, returning an ErrCDXUnavailable
+// if not.
+func (b *circuitBreaker) allow() error {
+	if b.threshold <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return nil
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return &resolveError{kind: ErrCDXUnavailable, err: errCircuitOpen}
+	}
+	b.probing = true
+	infoLog("Circuit breaker for %s half-open, probing", b.name)
+	b.transition("half_open")
+	return nil
+}
+
+// record counts the outcome of a call allow let through.
+func (b *circuitBreaker) record(err error) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		if b.open {
+			infoLog("Circuit breaker for %s closed, service recovered", b.name)
+			b.transition("closed")
+		}
+		b.failures, b.open, b.probing = 0, false, false
+		return
+	}
+
+	b.failures++
+	if b.probing || b.failures >= b.threshold {
+		if !b.open {
+			warnLog("Circuit breaker for %s open after %d consecutive failures, last: %v; failing fast for %v", b.name, b.failures, err, b.cooldown)
+			b.transition("open")
+		} else {
+			warnLog("Circuit breaker for %s probe failed: %v; failing fast for another %v", b.name, err, b.cooldown)
+		}
+		b.open, b.probing = true, false
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// transition records in metrics that the breaker entered state: open,
+// half_open or closed.
+func (b *circuitBreaker) transition(state string) {
+	metrics.IncCounter(metricBreakerTransitions, map[string]string{"breaker": b.name, "state": state})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useCDXBreaker installs a fresh CDX circuit breaker and Prometheus metrics
+// for the duration of the test.
+func useCDXBreaker(t *testing.T, threshold int, cooldown time.Duration) *prometheusMetrics {
+	oldBreaker, oldMetrics := cdxBreaker, metrics
+	cdxBreaker = &circuitBreaker{name: "CDX API", threshold: threshold, cooldown: cooldown}
+	prometheus := newPrometheusMetrics()
+	metrics = prometheus
+	t.Cleanup(func() { cdxBreaker, metrics = oldBreaker, oldMetrics })
+	return prometheus
+}
+
+func TestCDXBreakerOpensDuringOutage(t *testing.T) {
+	setFlag(t, "cdx-retries", "0")
+	prometheus := useCDXBreaker(t, 2, 50*time.Millisecond)
+	var requests int32
+	var down int32 = 1
+	newCDXServer(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&down) == 1 {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		cdxRows(w, [2]string{"20010401000000", "http://example.com/"})
+	})
+
+	// Two failures open the breaker, after which lookups fail fast
+	for i := 0; i < 4; i++ {
+		_, err := getWaybackURL(nil, "http://example.com/", "20010401")
+		if !errors.Is(err, ErrCDXUnavailable) {
+			t.Fatalf("lookup %d: %v, want ErrCDXUnavailable", i+1, err)
+		}
+		if i >= 2 && !errors.Is(err, errCircuitOpen) {
+			t.Errorf("lookup %d reached the API with the breaker open: %v", i+1, err)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("%d CDX requests during the outage, want 2", n)
+	}
+
+	// Once the cooldown has passed, a probe finds the API back and closes it
+	atomic.StoreInt32(&down, 0)
+	time.Sleep(60 * time.Millisecond)
+	if _, err := getWaybackURL(nil, "http://example.com/", "20010401"); err != nil {
+		t.Fatalf("probe lookup: %v", err)
+	}
+	if _, err := getWaybackURL(nil, "http://example.com/", "20010401"); err != nil {
+		t.Fatalf("lookup after recovery: %v", err)
+	}
+
+	var scrape bytes.Buffer
+	prometheus.write(&scrape)
+	for _, state := range []string{"open", "half_open", "closed"} {
+		series := metricBreakerTransitions + `{breaker="CDX API",state="` + state + `"} 1`
+		if !strings.Contains(scrape.String(), series) {
+			t.Errorf("metrics lack %s:\n%s", series, scrape.String())
+		}
+	}
+}
+
+func TestCDXBreakerFailedProbeReopens(t *testing.T) {
+	setFlag(t, "cdx-retries", "0")
+	useCDXBreaker(t, 1, 30*time.Millisecond)
+	var requests int32
+	newCDXServer(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "busy", http.StatusTooManyRequests)
+	})
+
+	getWaybackURL(nil, "http://example.com/", "20010401")
+	time.Sleep(40 * time.Millisecond)
+	getWaybackURL(nil, "http://example.com/", "20010401") // the probe
+	if _, err := getWaybackURL(nil, "http://example.com/", "20010401"); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("lookup after a failed probe: %v, want the breaker open again", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("%d CDX requests, want 2", n)
+	}
+}
+
+func TestCDXBreakerIgnoresClientErrors(t *testing.T) {
+	setFlag(t, "cdx-retries", "0")
+	useCDXBreaker(t, 2, time.Minute)
+	var requests int32
+	newCDXServer(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		// How the CDX API answers for a site excluded from the archive
+		http.Error(w, "Blocked Site Error", http.StatusForbidden)
+	})
+
+	for i := 0; i < 5; i++ {
+		if _, err := getWaybackURL(nil, "http://excluded.example/", "20010401"); errors.Is(err, errCircuitOpen) {
+			t.Fatalf("lookup %d failed fast: repeated 403s opened the breaker", i+1)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 5 {
+		t.Errorf("%d CDX requests, want 5", n)
+	}
+}
+
+func TestCDXOutage(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		outage bool
+	}{
+		{nil, false},
+		{&cdxStatusError{status: 400}, false},
+		{&cdxStatusError{status: 403}, false},
+		{&cdxStatusError{status: 404}, false},
+		{&cdxStatusError{status: 429}, true},
+		{&cdxStatusError{status: 500}, true},
+		{&cdxStatusError{status: 503}, true},
+		{errors.New("connection refused"), true},
+	} {
+		if got := cdxOutage(tc.err); got != tc.outage {
+			t.Errorf("cdxOutage(%v) = %v, want %v", tc.err, got, tc.outage)
+		}
+	}
+}
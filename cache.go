@@ -0,0 +1,208 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// staleMaxBodyBytes bounds the size of a single response kept for -serve-stale.
+const staleMaxBodyBytes = 2 << 20
+
+// staleCache holds the last good response for each requested URL when
+// -serve-stale is enabled, and is nil otherwise.
+var staleCache *responseCache
+
+// cachedResponse is a complete response kept for later reuse.
+type cachedResponse struct {
+	status   int
+	header   http.Header
+	body     []byte
+	storedAt time.Time
+}
+
+// responseCache is a concurrency-safe LRU of responses holding at most max
+// entries.
+type responseCache struct {
+	mu      sync.Mutex
+	max     int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type responseCacheEntry struct {
+	key      string
+	response *cachedResponse
+}
+
+func newResponseCache(max int) *responseCache {
+	return &responseCache{
+		max:     max,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *responseCache) get(key string) (*cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*responseCacheEntry).response, true
+}
+
+func (c *responseCache) put(key string, response *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*responseCacheEntry).response = response
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&responseCacheEntry{key: key, response: response})
+	for c.order.Len() > c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*responseCacheEntry).key)
+	}
+}
+
+// cacheKey identifies a requested URL at an archive date.
+func cacheKey(originalURL string, date string) string {
+	return date + " " + originalURL
+}
+
+// storeStale remembers a successful response so it can be served if a later
+// request for the same URL fails upstream. Partial responses to Range
+// requests are not kept, and neither are compressed ones, which the next
+// client may not accept.
+func storeStale(key string, r *http.Request, status int, header http.Header, body []byte) {
+	if staleCache == nil || r.Method != "GET" || r.Header.Get("Range") != "" || header.Get("Content-Encoding") != "" ||
+		status == http.StatusPartialContent || status == http.StatusNotModified || len(body) > staleMaxBodyBytes {
+		return
+	}
+
+	staleCache.put(key, &cachedResponse{
+		status:   status,
+		header:   header.Clone(),
+		body:     append([]byte(nil), body...),
+		storedAt: time.Now(),
+	})
+}
+
+// serveStale writes the last good response stored under key, marked with a
+// "110 Response is Stale" warning. It reports whether there was one to serve.
+func serveStale(w http.ResponseWriter, key string, cause error) bool {
+	if staleCache == nil {
+		return false
+	}
+	cached, ok := staleCache.get(key)
+	if !ok {
+		return false
+	}
+
+	age := time.Since(cached.storedAt)
+	warnLog("Serving stale copy of %s stored %v ago after upstream failure: %v", key, age.Round(time.Second), cause)
+
+	copyHeaders(w.Header(), cached.header)
+	w.Header().Set("Warning", `110 - "Response is Stale"`)
+	w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+	w.WriteHeader(cached.status)
+	w.Write(cached.body)
+	return true
+}
+
+// negativeCacheMax bounds the number of entries in the negative cache.
+const negativeCacheMax = 10000
+
+// negativeCache remembers recent lookups that found no capture when
+// -negative-cache-ttl is set, and is nil otherwise.
+var negativeCache *missCache
+
+// missCache is a concurrency-safe set of keys that expire after ttl, each
+// holding the error the failed lookup returned.
+type missCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]missEntry
+}
+
+type missEntry struct {
+	err     error
+	expires time.Time
+}
+
+func newMissCache(ttl time.Duration) *missCache {
+	return &missCache{ttl: ttl, entries: make(map[string]missEntry)}
+}
+
+// get returns the error recorded for key, if it has not expired.
+func (c *missCache) get(key string) (error, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.err, true
+}
+
+func (c *missCache) put(key string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if len(c.entries) >= negativeCacheMax {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		// Everything is still fresh; start over rather than grow unbounded
+		if len(c.entries) >= negativeCacheMax {
+			c.entries = make(map[string]missEntry)
+		}
+	}
+	c.entries[key] = missEntry{err: err, expires: now.Add(c.ttl)}
+}
+
+// setClientCacheHeaders lets browsers and intermediary caches keep a
+// successful archived response for -client-cache-ttl, replacing whatever
+// caching headers the archive sent.
+//
+// A capture never changes once made, so the body served for a given capture
+// only changes if the proxy's own configuration does. What a URL resolves
+// to, however, depends on -date and on what the archive holds, which is why
+// the lifetime is bounded by the TTL rather than unlimited. The ETag names
+// the capture's timestamp together with the original URL and the base the
+// links were rewritten against, so it only matches a body that is the same
+// capture modified the same way; it is weak because the body may differ in
+// bytes, but not in meaning, after a restart with other content settings.
+func setClientCacheHeaders(resp *http.Response, page *pageContext, ttl time.Duration) {
+	if ttl <= 0 || resp.StatusCode != http.StatusOK {
+		return
+	}
+
+	tag := fnv.New64a()
+	tag.Write([]byte(page.originalURL.String() + " " + page.localBase))
+	resp.Header.Set("Cache-Control", "public, max-age="+strconv.Itoa(int(ttl/time.Second)))
+	resp.Header.Set("Expires", time.Now().Add(ttl).UTC().Format(http.TimeFormat))
+	resp.Header.Set("ETag", fmt.Sprintf(`W/"%s-%x"`, page.timestamp, tag.Sum64()))
+	resp.Header.Del("Pragma")
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// useStaleCache enables -serve-stale for the duration of the test.
+func useStaleCache(t *testing.T) {
+	old := staleCache
+	staleCache = newResponseCache(10)
+	t.Cleanup(func() { staleCache = old })
+}
+
+func TestServeStaleAfterArchiveFailure(t *testing.T) {
+	useStaleCache(t)
+	setFlag(t, "max-retries", "2")
+	setFlag(t, "retry-delay", "0")
+	archiveDown := false
+	serveArchivedPage(t, "http://example.com/", "20010401000000", func(w http.ResponseWriter, r *http.Request) {
+		if archiveDown {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "image/gif")
+		w.Write([]byte("GIF89a"))
+	})
+
+	w := httptest.NewRecorder()
+	handleRequest(w, httptest.NewRequest("GET", "http://example.com/", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Warning") != "" {
+		t.Fatalf("first request: got %d, Warning %q", w.Code, w.Header().Get("Warning"))
+	}
+
+	archiveDown = true
+	w = httptest.NewRecorder()
+	handleRequest(w, httptest.NewRequest("GET", "http://example.com/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "GIF89a" {
+		t.Fatalf("with the archive down: got %d %q, want the stored copy", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Warning"); got != `110 - "Response is Stale"` {
+		t.Errorf("Warning = %q", got)
+	}
+
+	// Nothing was stored for another URL
+	w = httptest.NewRecorder()
+	handleRequest(w, httptest.NewRequest("GET", "http://example.com/other", nil))
+	if w.Code == http.StatusOK {
+		t.Errorf("uncached URL with the archive down: got %d", w.Code)
+	}
+}
+
+func TestStoreStaleSkipsPartialResponses(t *testing.T) {
+	useStaleCache(t)
+	header := http.Header{"Content-Type": {"text/plain"}}
+
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	r.Header.Set("Range", "bytes=0-1")
+	storeStale("range", r, http.StatusPartialContent, header, []byte("ab"))
+	storeStale("head", httptest.NewRequest("HEAD", "http://example.com/", nil), http.StatusOK, header, nil)
+	storeStale("gzip", httptest.NewRequest("GET", "http://example.com/", nil), http.StatusOK, http.Header{"Content-Encoding": {"gzip"}}, []byte("x"))
+	for _, key := range []string{"range", "head", "gzip"} {
+		if _, ok := staleCache.get(key); ok {
+			t.Errorf("%s response stored", key)
+		}
+	}
+}
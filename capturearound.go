@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// captureAroundPath is the proxy's own endpoint listing the captures of a
+// URL on either side of the date, e.g.
+// /capture-around?url=http://example.com/&n=5.
+const captureAroundPath = "/capture-around"
+
+const (
+	captureAroundDefault = 5  // captures on each side when n is not given
+	captureAroundMax     = 50 // the most n may ask for
+)
+
+// nearbyCapture is one capture listed by the capture-around endpoint.
+type nearbyCapture struct {
+	Timestamp string  `json:"timestamp"`
+	URL       string  `json:"url"`       // the capture, fetched through the proxy
+	DeltaDays float64 `json:"deltaDays"` // from the date, negative before it
+}
+
+type captureAroundResponse struct {
+	URL    string          `json:"url"`
+	Date   string          `json:"date"`
+	Before []nearbyCapture `json:"before"` // latest first
+	After  []nearbyCapture `json:"after"`  // earliest first
+}
+
+// handleCaptureAround serves, as JSON, the n captures of the url parameter
+// immediately before the date and the n from the date onward, for
+// interfaces offering previous and next snapshot links.
+func handleCaptureAround(w http.ResponseWriter, r *http.Request) {
+	originalURL := r.URL.Query().Get("url")
+	target, err := url.Parse(originalURL)
+	if err != nil || !target.IsAbs() {
+		http.Error(w, "url must be an absolute URL", http.StatusBadRequest)
+		return
+	}
+	n := captureAroundDefault
+	if value := r.URL.Query().Get("n"); value != "" {
+		n, err = strconv.Atoi(value)
+		if err != nil || n < 1 || n > captureAroundMax {
+			http.Error(w, fmt.Sprintf("n must be between 1 and %d", captureAroundMax), http.StatusBadRequest)
+			return
+		}
+	}
+
+	reqDate := requestDate(r)
+	before, after, err := capturesAround(originalURL, reqDate, n)
+	if err != nil {
+		errorLog("Error listing captures around %s for %s: %v", reqDate, originalURL, err)
+		http.Error(w, "Error listing captures: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	response := captureAroundResponse{URL: originalURL, Date: reqDate, Before: []nearbyCapture{}, After: []nearbyCapture{}}
+	base := localBaseFor(r)
+	for _, list := range []struct {
+		captures []cdxCapture
+		into     *[]nearbyCapture
+	}{{before, &response.Before}, {after, &response.After}} {
+		for _, capture := range list.captures {
+			entry := nearbyCapture{Timestamp: capture.Timestamp}
+			if u, err := url.Parse(formatWaybackURL(capture.Timestamp, capture.Original)); err == nil {
+				entry.URL = base + proxyLocalURL(u)
+			}
+			if delta, ok := captureDelta(reqDate, capture.Timestamp); ok {
+				entry.DeltaDays = delta.Hours() / 24
+			}
+			*list.into = append(*list.into, entry)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// capturesAround returns up to n captures of originalURL made before date,
+// latest first, and up to n made on or after it, earliest first. A capture
+// whose original field is empty is given originalURL.
+func capturesAround(originalURL string, date string, n int) ([]cdxCapture, []cdxCapture, error) {
+	day, err := time.Parse(canonicalDateLayout, date)
+	if err != nil {
+		return nil, nil, err
+	}
+	client := newCDXClient()
+
+	// A negative limit asks the CDX API for the last captures in range
+	before, err := listCaptures(client, originalURL, "&to="+day.AddDate(0, 0, -1).Format(canonicalDateLayout)+"235959", -n)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, j := 0, len(before)-1; i < j; i, j = i+1, j-1 {
+		before[i], before[j] = before[j], before[i]
+	}
+	after, err := listCaptures(client, originalURL, "&from="+date, n)
+	if err != nil {
+		return nil, nil, err
+	}
+	return before, after, nil
+}
+
+// listCaptures queries the CDX API for the successful captures of
+// originalURL within dateRange, in timestamp order, skipping repeats of the
+// same timestamp. It returns up to limit of the first captures, or with a
+// negative limit up to -limit of the last. The API collapses repeats before
+// applying its limit, and twice as many are asked for in case it doesn't.
+func listCaptures(client *http.Client, originalURL string, dateRange string, limit int) ([]cdxCapture, error) {
+	cdxURL := fmt.Sprintf("%s?url=%s%s&filter=statuscode:200&collapse=timestamp:14&limit=%d&output=json&fl=%s",
+		cdxAPIURL, cdxURLParam(originalURL), dateRange, 2*limit, cdxFields)
+	debugLog("Calling CDX API: %s", cdxURL)
+
+	resp, err := fetchCDX(client, cdxURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var captures []cdxCapture
+	err = decodeCDX(resp.Body, func(capture cdxCapture) bool {
+		if len(captures) > 0 && captures[len(captures)-1].Timestamp == capture.Timestamp {
+			return true
+		}
+		if capture.Original == "" {
+			capture.Original = originalURL
+		}
+		captures = append(captures, capture)
+		return true
+	})
+	if limit > 0 && len(captures) > limit {
+		captures = captures[:limit]
+	} else if limit < 0 && len(captures) > -limit {
+		captures = captures[len(captures)+limit:]
+	}
+	return captures, err
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCapturesAroundSkipsRepeatedTimestamps(t *testing.T) {
+	// The stand-in API doesn't collapse repeats, as the real one may not
+	newCDXServer(t, archivedCaptures("http://example.com/",
+		"20010101000000", "20010101000000", "20010201000000", "20010201000000", "20010301000000",
+		"20010501000000", "20010501000000", "20010601000000", "20010701000000"))
+
+	before, after, err := capturesAround("http://example.com/", "20010401", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name     string
+		captures []cdxCapture
+		want     []string
+	}{
+		{"before", before, []string{"20010301000000", "20010201000000"}},
+		{"after", after, []string{"20010501000000", "20010601000000"}},
+	} {
+		var got []string
+		for _, capture := range tc.captures {
+			got = append(got, capture.Timestamp)
+		}
+		if len(got) != len(tc.want) || got[0] != tc.want[0] || got[1] != tc.want[1] {
+			t.Errorf("%s = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCaptureAroundValidatesParameters(t *testing.T) {
+	for _, query := range []string{"", "?url=example.com", "?url=http://example.com/&n=0", "?url=http://example.com/&n=51"} {
+		w := httptest.NewRecorder()
+		handleCaptureAround(w, httptest.NewRequest("GET", captureAroundPath+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s%s: status %d, want 400", captureAroundPath, query, w.Code)
+		}
+	}
+}
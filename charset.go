@@ -0,0 +1,105 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// windows1252High maps the bytes 0x80 to 0x9F of windows-1252 to their
+// characters; the rest of its bytes are the same as in ISO-8859-1, which
+// maps each byte to the character of the same number. Unassigned bytes are
+// mapped to the C1 control of that number, as browsers do.
+var windows1252High = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8d, 'Ž', 0x8f,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9d, 'ž', 'Ÿ',
+}
+
+// latin1Labels are the charset labels browsers decode as windows-1252,
+// per the WHATWG Encoding Standard, which -normalize-encoding transcodes.
+// Other legacy encodings, such as Shift_JIS or KOI8-R, are left as they are.
+var latin1Labels = map[string]bool{
+	"ansi_x3.4-1968": true, "ascii": true, "cp1252": true, "cp819": true,
+	"csisolatin1": true, "ibm819": true, "iso-8859-1": true, "iso-ir-100": true,
+	"iso8859-1": true, "iso88591": true, "iso_8859-1": true, "iso_8859-1:1987": true,
+	"l1": true, "latin1": true, "us-ascii": true, "windows-1252": true, "x-cp1252": true,
+}
+
+var (
+	// metaCharsetRe matches the charset named by a meta tag, in either
+	// form: <meta charset="..."> or <meta http-equiv="Content-Type"
+	// content="text/html; charset=...">.
+	metaCharsetRe = regexp.MustCompile(`(?is)(<meta\b[^>]*?\bcharset\s*=\s*["']?)([a-z0-9_.:-]+)`)
+	// xmlEncodingRe matches the encoding in the XML declaration of an
+	// XHTML page.
+	xmlEncodingRe = regexp.MustCompile(`(?is)^(\s*<\?xml\b[^>]*?\bencoding\s*=\s*["'])([a-z0-9_.:-]+)`)
+)
+
+// charsetPrescanBytes is how far into a page browsers look for a meta
+// charset.
+const charsetPrescanBytes = 1024
+
+// declaredCharset returns the lowercased charset of an HTML response: the
+// one in its Content-Type, or else the first one its start declares, or ""
+// if there is none.
+func declaredCharset(contentType string, body []byte) string {
+	if _, params, err := mime.ParseMediaType(contentType); err == nil && params["charset"] != "" {
+		return strings.ToLower(params["charset"])
+	}
+	head := body
+	if len(head) > charsetPrescanBytes {
+		head = head[:charsetPrescanBytes]
+	}
+	if m := xmlEncodingRe.FindSubmatch(head); m != nil {
+		return strings.ToLower(string(m[2]))
+	}
+	if m := metaCharsetRe.FindSubmatch(head); m != nil {
+		return strings.ToLower(string(m[2]))
+	}
+	return ""
+}
+
+// decodeWindows1252 returns body, in windows-1252, as UTF-8.
+func decodeWindows1252(body []byte) []byte {
+	decoded := make([]byte, 0, len(body)+len(body)/8)
+	for _, b := range body {
+		switch {
+		case b < utf8.RuneSelf:
+			decoded = append(decoded, b)
+		case b < 0xa0:
+			decoded = append(decoded, string(windows1252High[b-0x80])...)
+		default:
+			decoded = append(decoded, string(rune(b))...)
+		}
+	}
+	return decoded
+}
+
+// declareUTF8 makes every charset declaration in body, meta tags of both
+// forms and an XML declaration, say UTF-8.
+func declareUTF8(body string) string {
+	body = xmlEncodingRe.ReplaceAllString(body, "${1}utf-8")
+	return metaCharsetRe.ReplaceAllString(body, "${1}utf-8")
+}
+
+// normalizeEncoding transcodes the body of an HTML response declared as
+// ISO-8859-1, windows-1252 or ASCII to UTF-8 for -normalize-encoding, and
+// updates both the Content-Type header and the declarations in the page to
+// say so, since a page still claiming its old charset would be mis-decoded.
+// Bodies in other charsets, or none, are returned as they are.
+func normalizeEncoding(resp *http.Response, contentType string, body []byte, originalURL string) []byte {
+	charset := declaredCharset(contentType, body)
+	if !latin1Labels[charset] {
+		return body
+	}
+	debugLog("Transcoding %s page %s to UTF-8", charset, originalURL)
+	if mediaType, params, err := mime.ParseMediaType(contentType); err == nil {
+		params["charset"] = "utf-8"
+		resp.Header.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+	} else {
+		resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+	}
+	return []byte(declareUTF8(string(decodeWindows1252(body))))
+}
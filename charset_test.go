@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDeclaredCharset(t *testing.T) {
+	for _, tc := range []struct{ contentType, body, want string }{
+		{"text/html; charset=ISO-8859-1", `<meta charset="utf-8">`, "iso-8859-1"},
+		{"text/html", `<html><head><meta charset="Windows-1252">`, "windows-1252"},
+		{"text/html", `<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=latin1">`, "latin1"},
+		{"text/html", `<?xml version="1.0" encoding="ISO-8859-1"?><html><meta charset="utf-8">`, "iso-8859-1"},
+		{"text/html", `<html><body>no declaration</body></html>`, ""},
+	} {
+		if got := declaredCharset(tc.contentType, []byte(tc.body)); got != tc.want {
+			t.Errorf("declaredCharset(%q, %s) = %q, want %q", tc.contentType, tc.body, got, tc.want)
+		}
+	}
+
+	// Declarations past the prescan aren't seen
+	late := make([]byte, charsetPrescanBytes)
+	for i := range late {
+		late[i] = ' '
+	}
+	if got := declaredCharset("text/html", append(late, `<meta charset="latin1">`...)); got != "" {
+		t.Errorf("declaredCharset of a late declaration = %q", got)
+	}
+}
+
+func TestDecodeWindows1252(t *testing.T) {
+	if got, want := string(decodeWindows1252([]byte("caf\xe9 \x93q\x94 \x80\x81"))), "café “q” €\u0081"; got != want {
+		t.Errorf("decodeWindows1252 = %q, want %q", got, want)
+	}
+}
+
+func TestArchivedPageTranscoded(t *testing.T) {
+	setFlag(t, "normalize-encoding", "true")
+	var contentType, body string
+	serveArchivedPage(t, "http://example.com/", "20010401000000", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Write([]byte(body))
+	})
+
+	for _, tc := range []struct{ contentType, body, wantType, want string }{
+		{
+			"text/html; charset=iso-8859-1",
+			`<html><head><meta http-equiv="Content-Type" content="text/html; charset=iso-8859-1"></head><body>caf` + "\xe9" + `</body></html>`,
+			"text/html; charset=utf-8",
+			`<html><head><meta http-equiv="Content-Type" content="text/html; charset=utf-8"></head><body>café</body></html>`,
+		},
+		{
+			"text/html",
+			`<html><head><meta charset="shift_jis"></head><body>` + "\x82\xa0" + `</body></html>`,
+			"text/html",
+			`<html><head><meta charset="shift_jis"></head><body>` + "\x82\xa0" + `</body></html>`,
+		},
+	} {
+		contentType, body = tc.contentType, tc.body
+		w := httptest.NewRecorder()
+		handleRequest(w, httptest.NewRequest("GET", "http://example.com/", nil))
+		if got := w.Header().Get("Content-Type"); got != tc.wantType {
+			t.Errorf("%s page: Content-Type %q, want %q", tc.contentType, got, tc.wantType)
+		}
+		if w.Body.String() != tc.want {
+			t.Errorf("%s page: got\n%q\nwant\n%q", tc.contentType, w.Body.String(), tc.want)
+		}
+	}
+}
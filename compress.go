@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// compressMinBytes is the smallest modified body -compress-responses
+// compresses; below it the encoding overhead outweighs the saving.
+const compressMinBytes = 1024
+
+// responseEncoding is a content coding the proxy can compress modified
+// bodies with.
+type responseEncoding struct {
+	name      string
+	newWriter func(io.Writer) io.WriteCloser
+}
+
+// responseEncodings are the codings -compress-responses offers, best first.
+// When a client accepts several equally, the earliest here wins, so Brotli,
+// which compresses text better, is chosen over gzip.
+var responseEncodings = []responseEncoding{
+	{name: "br", newWriter: func(w io.Writer) io.WriteCloser { return brotli.NewWriterLevel(w, brotli.DefaultCompression) }},
+	{name: "gzip", newWriter: func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }},
+}
+
+// negotiateEncoding picks the coding from responseEncodings that an
+// Accept-Encoding header value prefers, honoring q-values and "*". It
+// returns nil when the client accepts none of them.
+func negotiateEncoding(acceptEncoding string) *responseEncoding {
+	quality := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if value, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = value
+				}
+			}
+		}
+		quality[name] = q
+	}
+
+	var best *responseEncoding
+	bestQ := 0.0
+	for i := range responseEncodings {
+		q, ok := quality[responseEncodings[i].name]
+		if !ok {
+			q = quality["*"]
+		}
+		if q > bestQ {
+			best, bestQ = &responseEncodings[i], q
+		}
+	}
+	return best
+}
+
+// compressible reports whether a body of contentType is worth compressing:
+// text, including JavaScript. Images and other binary types are mostly
+// compressed already.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+	for _, jsType := range javaScriptTypes {
+		if mediaType == jsType {
+			return true
+		}
+	}
+	return false
+}
+
+// compressModifiedBody compresses a body the proxy has just modified, for
+// -compress-responses, with the best coding the client asked for in
+// acceptEncoding. It sets the body, Content-Encoding and Content-Length on
+// resp and reports whether it did; bodies that are not text, small or
+// already encoded by the archive are left for the caller to send as they
+// are.
+func compressModifiedBody(resp *http.Response, body string, acceptEncoding string) bool {
+	if len(body) < compressMinBytes || resp.Header.Get("Content-Encoding") != "" || !compressible(resp.Header.Get("Content-Type")) {
+		return false
+	}
+	encoding := negotiateEncoding(acceptEncoding)
+	if encoding == nil {
+		return false
+	}
+
+	var compressed bytes.Buffer
+	writer := encoding.newWriter(&compressed)
+	if _, err := io.WriteString(writer, body); err != nil {
+		return false
+	}
+	if err := writer.Close(); err != nil {
+		return false
+	}
+
+	resp.Body = io.NopCloser(&compressed)
+	resp.ContentLength = int64(compressed.Len())
+	resp.Header.Set("Content-Length", strconv.Itoa(compressed.Len()))
+	resp.Header.Set("Content-Encoding", encoding.name)
+	resp.Header.Add("Vary", "Accept-Encoding")
+	return true
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"br", "br"},
+		{"gzip, deflate, br", "br"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"br;q=0, gzip", "gzip"},
+		{"gzip;q=0.8, br;q=0.9", "br"},
+		{"*", "br"},
+		{"*, br;q=0", "gzip"},
+		{"BR, GZIP", "br"},
+	} {
+		got := ""
+		if encoding := negotiateEncoding(tc.acceptEncoding); encoding != nil {
+			got = encoding.name
+		}
+		if got != tc.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tc.acceptEncoding, got, tc.want)
+		}
+	}
+}
+
+// decodeBody reads resp's body back according to its Content-Encoding.
+func decodeBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	var reader io.Reader = resp.Body
+	switch resp.Header.Get("Content-Encoding") {
+	case "br":
+		reader = brotli.NewReader(resp.Body)
+	case "gzip":
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = gz
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestCompressModifiedBody(t *testing.T) {
+	page := "<html><body>" + strings.Repeat("<p>An archived paragraph.</p>\n", 200) + "</body></html>"
+	for _, tc := range []struct {
+		contentType    string
+		body           string
+		acceptEncoding string
+		want           string
+	}{
+		{"text/html", page, "gzip, deflate, br", "br"},
+		{"text/css", page, "gzip, deflate, br", "br"},
+		{"text/html; charset=utf-8", page, "gzip", "gzip"},
+		{"text/html", page, "", ""},
+		{"image/gif", page, "br", ""},
+		{"text/html", "<p>small</p>", "br", ""},
+	} {
+		resp := &http.Response{Header: http.Header{"Content-Type": {tc.contentType}}}
+		compressed := compressModifiedBody(resp, tc.body, tc.acceptEncoding)
+		if got := resp.Header.Get("Content-Encoding"); got != tc.want || compressed != (tc.want != "") {
+			t.Errorf("%s, %d bytes, Accept-Encoding %q: Content-Encoding %q (compressed %v), want %q",
+				tc.contentType, len(tc.body), tc.acceptEncoding, got, compressed, tc.want)
+			continue
+		}
+		if !compressed {
+			continue
+		}
+		if resp.Header.Get("Vary") != "Accept-Encoding" {
+			t.Errorf("Vary = %q", resp.Header.Get("Vary"))
+		}
+		if int(resp.ContentLength) >= len(tc.body) {
+			t.Errorf("%s body not smaller: %d bytes from %d", tc.want, resp.ContentLength, len(tc.body))
+		}
+		if got := decodeBody(t, resp); got != tc.body {
+			t.Errorf("%s body does not decode to the original", tc.want)
+		}
+	}
+}
+
+func TestCompressModifiedBodyLeavesEncodedBodies(t *testing.T) {
+	resp := &http.Response{Header: http.Header{"Content-Type": {"text/html"}, "Content-Encoding": {"gzip"}}}
+	if compressModifiedBody(resp, strings.Repeat("x", 4096), "br") {
+		t.Error("a body the archive sent encoded was compressed again")
+	}
+}
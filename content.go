@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// contentAction is a modification applied to the body of an archived
+// response.
+type contentAction string
+
+const (
+	actionPassthrough  contentAction = "passthrough"
+	actionStripToolbar contentAction = "strip-toolbar"
+	actionRewriteHTML  contentAction = "rewrite-html"
+	actionRewriteCSS   contentAction = "rewrite-css"
+	actionRewriteJS    contentAction = "rewrite-js"
+)
+
+var knownContentActions = map[contentAction]bool{
+	actionPassthrough:  true,
+	actionStripToolbar: true,
+	actionRewriteHTML:  true,
+	actionRewriteCSS:   true,
+	actionRewriteJS:    true,
+}
+
+// javaScriptTypes are the media types -rewrite-js-urls adds rewrite-js for.
+var javaScriptTypes = []string{"application/javascript", "application/x-javascript", "text/javascript"}
+
+// contentPolicy maps media types ("text/html", or "text/*" for a whole major
+// type) to the actions applied, in order, to bodies of that type. Responses
+// with no actions are passed through without being buffered.
+type contentPolicy map[string][]contentAction
+
+// contentActions is the policy in effect. By default the toolbar is stripped
+// from HTML and its links rewritten, and everything else is left alone;
+// -content-actions entries are merged over this in main.
+var contentActions = contentPolicy{
+	"text/html": {actionStripToolbar, actionRewriteHTML},
+}
+
+// parseContentPolicy parses a comma-separated list of type=action+action
+// entries and merges them over base, replacing the actions of any type that
+// appears in both.
+func parseContentPolicy(spec string, base contentPolicy) (contentPolicy, error) {
+	policy := contentPolicy{}
+	for mediaType, actions := range base {
+		policy[mediaType] = actions
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		eq := strings.Index(entry, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("invalid entry %q, expected type=action", entry)
+		}
+		mediaType := strings.ToLower(strings.TrimSpace(entry[:eq]))
+
+		var actions []contentAction
+		for _, name := range strings.Split(entry[eq+1:], "+") {
+			action := contentAction(strings.TrimSpace(name))
+			if !knownContentActions[action] {
+				return nil, fmt.Errorf("unknown action %q for %s", action, mediaType)
+			}
+			if action != actionPassthrough {
+				actions = append(actions, action)
+			}
+		}
+		policy[mediaType] = actions
+	}
+
+	return policy, nil
+}
+
+// lookup returns the actions for a Content-Type header value. A value with
+// a malformed parameter, such as the "text/html; charset" archived servers
+// sometimes sent, still has its media type looked up.
+func (p contentPolicy) lookup(contentType string) []contentAction {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil && err != mime.ErrInvalidMediaParameter {
+		return nil
+	}
+	if actions, ok := p[mediaType]; ok {
+		return actions
+	}
+	if slash := strings.Index(mediaType, "/"); slash != -1 {
+		return p[mediaType[:slash]+"/*"]
+	}
+	return nil
+}
+
+// contentTypeOverride forces the media type of archived responses whose
+// original URL matches pattern.
+type contentTypeOverride struct {
+	pattern   *regexp.Regexp
+	mediaType string
+}
+
+// contentTypeOverrides are parsed from -content-type-override.
+var contentTypeOverrides []contentTypeOverride
+
+// parseContentTypeOverrides parses a comma-separated list of pattern=type
+// entries. A pattern matches original URLs in full, with * standing for any
+// run of characters, e.g. http://www.example.com/docs/*.txt=text/html.
+func parseContentTypeOverrides(spec string) ([]contentTypeOverride, error) {
+	var overrides []contentTypeOverride
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		// URLs may contain = themselves, media types do not
+		eq := strings.LastIndex(entry, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("invalid entry %q, expected pattern=type", entry)
+		}
+		mediaType := strings.ToLower(strings.TrimSpace(entry[eq+1:]))
+		if _, _, err := mime.ParseMediaType(mediaType); err != nil {
+			return nil, fmt.Errorf("invalid media type %q for %s", mediaType, entry[:eq])
+		}
+		pattern := strings.Replace(regexp.QuoteMeta(strings.TrimSpace(entry[:eq])), `\*`, ".*", -1)
+		overrides = append(overrides, contentTypeOverride{
+			pattern:   regexp.MustCompile("^" + pattern + "$"),
+			mediaType: mediaType,
+		})
+	}
+	return overrides, nil
+}
+
+// sniffableTypes are the media types the archive serves HTML as by mistake,
+// which -sniff-html looks past.
+var sniffableTypes = map[string]bool{
+	"":                         true,
+	"application/octet-stream": true,
+	"text/plain":               true,
+}
+
+// sniffHTMLPrefixes are what an HTML page's body starts with.
+var sniffHTMLPrefixes = []string{"<!doctype html", "<html"}
+
+// correctContentType works out the type an archived response from
+// originalURL should be handled as: the first matching
+// -content-type-override, or with -sniff-html text/html for a supposed
+// binary or plain text body that starts like an HTML page. The corrected
+// type is set on the response, so the browser renders it as such too.
+func correctContentType(resp *http.Response, originalURL string) string {
+	contentType := resp.Header.Get("Content-Type")
+	for _, override := range contentTypeOverrides {
+		if override.pattern.MatchString(originalURL) {
+			return setContentType(resp, originalURL, contentType, override.mediaType)
+		}
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if !*sniffHTML || !sniffableTypes[mediaType] || resp.Body == nil {
+		return contentType
+	}
+
+	// Peek at the start of the body without consuming it
+	peeked := bufio.NewReader(resp.Body)
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{peeked, resp.Body}
+	start, _ := peeked.Peek(512)
+	head := strings.ToLower(strings.TrimLeft(strings.TrimPrefix(string(start), "\ufeff"), " \t\r\n"))
+	for _, prefix := range sniffHTMLPrefixes {
+		if strings.HasPrefix(head, prefix) {
+			return setContentType(resp, originalURL, contentType, "text/html")
+		}
+	}
+	return contentType
+}
+
+func setContentType(resp *http.Response, originalURL string, old string, mediaType string) string {
+	if old != mediaType {
+		debugLog("Treating %q response for %s as %s", old, originalURL, mediaType)
+		resp.Header.Set("Content-Type", mediaType)
+	}
+	return mediaType
+}
+
+// applyContentActions runs actions over the body of page in order, making
+// the link replacements within budget. page is nil when the page's original
+// URL is unknown.
+func applyContentActions(actions []contentAction, body string, page *pageContext, budget *rewriteBudget) string {
+	for _, action := range actions {
+		if !budget.ok() {
+			break
+		}
+		switch action {
+		case actionStripToolbar:
+			var timestamp string
+			if page != nil {
+				timestamp = page.timestamp
+			}
+			body = removeWaybackToolbar(body, timestamp)
+		case actionRewriteHTML, actionRewriteCSS:
+			if *preserveWaybackLinks {
+				body = absoluteArchiveLinks(body, budget)
+			} else if action == actionRewriteCSS {
+				body = rewriteCSS(body, page, budget)
+			} else {
+				body = rewriteLinks(body, page, budget)
+				if *rewriteAbsoluteSameHost {
+					body = rewriteSameHostLinks(body, page, budget)
+				}
+				body = rewriteFTPGopherLinks(body, *ftpGopherLinks, budget)
+				if *stripIntegrity {
+					body = stripIntegrityAttrs(body, budget)
+				}
+				if *rewriteForms {
+					body = rewriteFormActions(body, page, budget)
+				}
+				if *rewriteAnchorBase {
+					body = anchorBaseElement(body, page)
+				}
+			}
+			if action == actionRewriteHTML && *titleDatePrefix {
+				body = prefixTitleWithDate(body, page)
+			}
+			if action == actionRewriteHTML && *embedProvenance {
+				body = embedProvenanceComment(body, page)
+			}
+		case actionRewriteJS:
+			if !*preserveWaybackLinks {
+				body = rewriteScriptURLs(body, page, budget)
+			}
+		}
+	}
+	return body
+}
+
+var (
+	titleTagRe = regexp.MustCompile(`(?i)<title\b[^>]*>`)
+	headTagRe  = regexp.MustCompile(`(?i)<head\b[^>]*>`)
+)
+
+// bodyEndTagRe matches a closing body tag.
+var bodyEndTagRe = regexp.MustCompile(`(?i)</body\s*>`)
+
+// embedProvenanceComment notes, for -embed-provenance, which capture page
+// came from in an HTML comment before its last </body>, or at the end if it
+// has none, e.g. <!-- Archived copy of http://example.com/ captured
+// 2001-04-01 12:34:56 UTC: http://web.archive.org/web/20010401123456/http://example.com/ -->.
+func embedProvenanceComment(body string, page *pageContext) string {
+	if page == nil {
+		return body
+	}
+	captured := page.timestamp
+	if when, ok := captureTime(page.timestamp); ok {
+		captured = when.Format("2006-01-02 15:04:05 UTC")
+	}
+	note := fmt.Sprintf("Archived copy of %s captured %s: %s",
+		page.originalURL, captured, formatWaybackURL(page.timestamp, page.originalURL.String()))
+	// "--" would end the comment early
+	comment := "<!-- " + strings.Replace(note, "--", "%2D%2D", -1) + " -->\n"
+
+	locs := bodyEndTagRe.FindAllStringIndex(body, -1)
+	if len(locs) == 0 {
+		return body + "\n" + comment
+	}
+	last := locs[len(locs)-1][0]
+	return body[:last] + comment + body[last:]
+}
+
+// prefixTitleWithDate puts the capture date of page in front of the page's
+// title for -title-date-prefix, e.g. "[2001-09-15] Example Home Page", so
+// browser tabs show when it is from. A page without a title gets one made
+// of the date and its original URL, if it has a head to put it in.
+func prefixTitleWithDate(body string, page *pageContext) string {
+	if page == nil || len(page.timestamp) < 8 {
+		return body
+	}
+	captured, err := time.Parse(canonicalDateLayout, page.timestamp[:8])
+	if err != nil {
+		return body
+	}
+	prefix := "[" + captured.Format("2006-01-02") + "] "
+
+	if loc := titleTagRe.FindStringIndex(body); loc != nil {
+		return body[:loc[1]] + prefix + body[loc[1]:]
+	}
+	if loc := headTagRe.FindStringIndex(body); loc != nil {
+		title := "<title>" + html.EscapeString(prefix+page.originalURL.String()) + "</title>"
+		return body[:loc[1]] + title + body[loc[1]:]
+	}
+	return body
+}
+
+// rewriteBudget bounds the modification of one page, for -max-page-rewrites
+// and -page-rewrite-timeout. The rewriters make their replacements through
+// it, and once either limit is passed it refuses to make any more. A nil
+// budget is unlimited.
+type rewriteBudget struct {
+	maxReplacements int
+	timeout         time.Duration
+	deadline        time.Time
+	replacements    int
+	// err says which limit was passed, once one has been.
+	err error
+}
+
+// newRewriteBudget starts a budget of maxReplacements replacements and
+// timeout from now; zero for either is unlimited.
+func newRewriteBudget(maxReplacements int, timeout time.Duration) *rewriteBudget {
+	b := &rewriteBudget{maxReplacements: maxReplacements, timeout: timeout}
+	if timeout > 0 {
+		b.deadline = time.Now().Add(timeout)
+	}
+	return b
+}
+
+// ok reports whether the page is still within its budget, checking the
+// deadline.
+func (b *rewriteBudget) ok() bool {
+	if b == nil {
+		return true
+	}
+	if b.err == nil && !b.deadline.IsZero() && time.Now().After(b.deadline) {
+		b.err = fmt.Errorf("rewriting took longer than %v", b.timeout)
+	}
+	return b.err == nil
+}
+
+// matches returns the matches of re in body, as FindAllStringSubmatchIndex
+// does, and takes them from the budget. It returns none once the budget is
+// spent, finding no more than one match past what is left of it.
+func (b *rewriteBudget) matches(re *regexp.Regexp, body string) [][]int {
+	if !b.ok() {
+		return nil
+	}
+	n := -1
+	if b != nil && b.maxReplacements > 0 {
+		n = b.maxReplacements - b.replacements + 1
+	}
+	found := re.FindAllStringSubmatchIndex(body, n)
+	if b != nil {
+		b.replacements += len(found)
+		if b.maxReplacements > 0 && b.replacements > b.maxReplacements {
+			b.err = fmt.Errorf("more than %d replacements needed", b.maxReplacements)
+			return nil
+		}
+	}
+	return found
+}
+
+// replaceAllString is re.ReplaceAllString within the budget: body is
+// returned unchanged if its matches would take the page over it.
+func (b *rewriteBudget) replaceAllString(re *regexp.Regexp, body string, template string) string {
+	found := b.matches(re, body)
+	if len(found) == 0 {
+		return body
+	}
+	out := make([]byte, 0, len(body))
+	last := 0
+	for _, m := range found {
+		out = append(out, body[last:m[0]]...)
+		out = re.ExpandString(out, template, body, m)
+		last = m[1]
+	}
+	return string(append(out, body[last:]...))
+}
+
+// replaceAllStringFunc is re.ReplaceAllStringFunc within the budget. As
+// replace can be slow, the deadline is checked before each call, and body
+// is returned unchanged once it has passed.
+func (b *rewriteBudget) replaceAllStringFunc(re *regexp.Regexp, body string, replace func(string) string) string {
+	found := b.matches(re, body)
+	if len(found) == 0 {
+		return body
+	}
+	out := make([]byte, 0, len(body))
+	last := 0
+	for _, m := range found {
+		if !b.ok() {
+			return body
+		}
+		out = append(out, body[last:m[0]]...)
+		out = append(out, replace(body[m[0]:m[1]])...)
+		last = m[1]
+	}
+	return string(append(out, body[last:]...))
+}
+
+// applyContentActionsSafely runs applyContentActions within the
+// -max-page-rewrites and -page-rewrite-timeout limits. A page over either
+// limit is served as the archive sent it, so one pathological page cannot
+// tie up the proxy.
+func applyContentActionsSafely(actions []contentAction, body string, page *pageContext, source string) string {
+	budget := newRewriteBudget(*maxPageRewrites, *pageRewriteTimeout)
+	modified := applyContentActions(actions, body, page, budget)
+	if budget.ok() {
+		return modified
+	}
+	warnLog("Not rewriting %s: %v", source, budget.err)
+	return body
+}
+
+// bodyAllowed reports whether a response with status may have a body.
+// Informational, 204 No Content and 304 Not Modified responses never do, so
+// there is nothing to modify and no Content-Length to set.
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// contentLengthCheckMax is the largest declared Content-Length that
+// -trust-upstream-content-length=false checks; larger bodies are streamed
+// with the archive's Content-Length as before.
+const contentLengthCheckMax = 4 << 20
+
+// checkContentLength reads a small unmodified body in full and sets
+// Content-Length to the number of bytes the archive actually sent. Some
+// captures declare more bytes than they contain, which makes clients wait
+// for the rest or discard the response as truncated.
+func checkContentLength(resp *http.Response) error {
+	if resp.ContentLength < 0 || resp.ContentLength > contentLengthCheckMax || resp.StatusCode == http.StatusPartialContent {
+		return nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	// After a body that ended early, the transport still looks at resp
+	// until the body is closed, so that comes before resp is changed
+	resp.Body.Close()
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if int64(len(body)) != resp.ContentLength {
+		warnLog("Archive declared Content-Length %d for %s but sent %d bytes", resp.ContentLength, resp.Request.URL, len(body))
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRewriteBudgetReplacesAsRegexpDoes(t *testing.T) {
+	re := regexp.MustCompile(`(a+)(b?)`)
+	body := "xaabyaaxab"
+	budget := newRewriteBudget(0, 0)
+	if got, want := budget.replaceAllString(re, body, "[${2}${1}]"), re.ReplaceAllString(body, "[${2}${1}]"); got != want {
+		t.Errorf("replaceAllString = %q, want %q", got, want)
+	}
+	if got, want := budget.replaceAllStringFunc(re, body, strings.ToUpper), re.ReplaceAllStringFunc(body, strings.ToUpper); got != want {
+		t.Errorf("replaceAllStringFunc = %q, want %q", got, want)
+	}
+	if budget.replacements != 6 || !budget.ok() {
+		t.Errorf("budget after 6 replacements: %d, %v", budget.replacements, budget.err)
+	}
+
+	var unlimited *rewriteBudget
+	if got, want := unlimited.replaceAllString(re, body, "-"), re.ReplaceAllString(body, "-"); got != want {
+		t.Errorf("nil budget replaceAllString = %q, want %q", got, want)
+	}
+}
+
+// hugePage is an archived page with n archive links.
+func hugePage(n int) string {
+	return "<html><body>" + strings.Repeat(`<a href="/web/20010401000000/http://example.com/">x</a>`, n) + "</body></html>"
+}
+
+func TestPageOverRewriteLimitServedUnmodified(t *testing.T) {
+	setFlag(t, "max-page-rewrites", "1000")
+	setFlag(t, "page-rewrite-timeout", "0")
+	page := newPageContext("http://web.archive.org/web/20010401000000/http://example.com/")
+	actions := []contentAction{actionStripToolbar, actionRewriteHTML}
+
+	body := hugePage(200000)
+	if got := applyContentActionsSafely(actions, body, page, "huge page"); got != body {
+		t.Error("page with 200000 links was modified despite -max-page-rewrites=1000")
+	}
+
+	small := hugePage(10)
+	got := applyContentActionsSafely(actions, small, page, "small page")
+	if strings.Contains(got, "/web/") || strings.Count(got, `href="http://example.com/"`) != 10 {
+		t.Errorf("page within the limit not rewritten: %s", got)
+	}
+}
+
+func TestPageOverRewriteTimeoutServedUnmodified(t *testing.T) {
+	setFlag(t, "max-page-rewrites", "0")
+	setFlag(t, "page-rewrite-timeout", "1ns")
+	page := newPageContext("http://web.archive.org/web/20010401000000/http://example.com/")
+
+	body := hugePage(1000)
+	if got := applyContentActionsSafely([]contentAction{actionRewriteHTML}, body, page, "slow page"); got != body {
+		t.Error("page was modified after -page-rewrite-timeout passed")
+	}
+}
+
+func TestRewriteBudgetStopsAtDeadline(t *testing.T) {
+	re := regexp.MustCompile(`x`)
+	body := strings.Repeat("x", 100)
+	// Generous enough for the first match to be reached in time even with
+	// the race detector on
+	budget := newRewriteBudget(0, 50*time.Millisecond)
+	calls := 0
+	got := budget.replaceAllStringFunc(re, body, func(s string) string {
+		calls++
+		time.Sleep(60 * time.Millisecond)
+		return "y"
+	})
+	if got != body || calls != 1 {
+		t.Errorf("replaceAllStringFunc past its deadline: %d calls, body modified %v", calls, got != body)
+	}
+	if budget.ok() || !strings.Contains(budget.err.Error(), "longer than") {
+		t.Errorf("budget err = %v, want a timeout", budget.err)
+	}
+}
+
+func TestContentPolicyLookup(t *testing.T) {
+	policy := contentPolicy{
+		"text/html": {actionStripToolbar, actionRewriteHTML},
+		"text/*":    {actionRewriteCSS},
+	}
+	for contentType, want := range map[string][]contentAction{
+		"text/html":                 {actionStripToolbar, actionRewriteHTML},
+		"TEXT/HTML; charset=utf-8":  {actionStripToolbar, actionRewriteHTML},
+		"text/html; charset":        {actionStripToolbar, actionRewriteHTML},
+		"text/html; charset=a;=b":   {actionStripToolbar, actionRewriteHTML},
+		"text/css":                  {actionRewriteCSS},
+		"image/gif":                 nil,
+		"":                          nil,
+		"not a media type; charset": nil,
+	} {
+		if got := policy.lookup(contentType); !reflect.DeepEqual(got, want) {
+			t.Errorf("lookup(%q) = %v, want %v", contentType, got, want)
+		}
+	}
+}
+
+func TestParseContentPolicy(t *testing.T) {
+	policy, err := parseContentPolicy("text/css=rewrite-css, text/html=passthrough", contentActions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := policy["text/css"]; !reflect.DeepEqual(got, []contentAction{actionRewriteCSS}) {
+		t.Errorf("text/css actions = %v", got)
+	}
+	if got := policy["text/html"]; len(got) != 0 {
+		t.Errorf("text/html actions = %v, want none", got)
+	}
+	for _, spec := range []string{"text/html", "text/html=shred"} {
+		if _, err := parseContentPolicy(spec, contentActions); err == nil {
+			t.Errorf("parseContentPolicy(%q) succeeded", spec)
+		}
+	}
+}
+
+// shortBodyArchive serves body under a Content-Length larger than it.
+func shortBodyArchive(t *testing.T, body string) {
+	serveArchivedPage(t, "http://example.com/", "20010401000000", func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Type: image/gif\r\nContent-Length: 100\r\nConnection: close\r\n\r\n" + body)
+		buf.Flush()
+	})
+}
+
+func TestUntrustedContentLengthRecomputed(t *testing.T) {
+	setFlag(t, "trust-upstream-content-length", "false")
+	setFlag(t, "max-retries", "1")
+	shortBodyArchive(t, "GIF89a")
+
+	w := httptest.NewRecorder()
+	handleRequest(w, httptest.NewRequest("GET", "http://example.com/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "GIF89a" {
+		t.Fatalf("got %d %q, want the body that arrived", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Length"); got != "6" {
+		t.Errorf("Content-Length = %q, want 6", got)
+	}
+}
+
+func TestCheckContentLengthSkipsLargeAndPartialBodies(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		length int64
+	}{
+		{http.StatusOK, contentLengthCheckMax + 1},
+		{http.StatusOK, -1},
+		{http.StatusPartialContent, 100},
+	} {
+		body := io.NopCloser(strings.NewReader("short"))
+		resp := &http.Response{StatusCode: tc.status, ContentLength: tc.length, Header: http.Header{}, Body: body}
+		if err := checkContentLength(resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.ContentLength != tc.length || resp.Body != body {
+			t.Errorf("%d response with Content-Length %d was read", tc.status, tc.length)
+		}
+	}
+}
+
+func TestParseContentTypeOverrides(t *testing.T) {
+	overrides, err := parseContentTypeOverrides("http://example.com/docs/*.txt=Text/HTML, http://example.com/?a=b=text/css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(overrides) != 2 || overrides[0].mediaType != "text/html" || overrides[1].mediaType != "text/css" {
+		t.Fatalf("parsed %+v", overrides)
+	}
+	for url, want := range map[string]bool{
+		"http://example.com/docs/a/b.txt": true,
+		"http://example.com/docs/a.txt?x": false,
+		"http://example.com/docsXa.txt":   false,
+	} {
+		if got := overrides[0].pattern.MatchString(url); got != want {
+			t.Errorf("pattern matches %s: %v, want %v", url, got, want)
+		}
+	}
+	if !overrides[1].pattern.MatchString("http://example.com/?a=b") {
+		t.Error("pattern containing = not kept whole")
+	}
+
+	for _, spec := range []string{"text/html", "=text/html", "http://example.com/=not a type"} {
+		if _, err := parseContentTypeOverrides(spec); err == nil {
+			t.Errorf("parseContentTypeOverrides(%q) accepted", spec)
+		}
+	}
+}
+
+func TestCorrectContentType(t *testing.T) {
+	overrides, _ := parseContentTypeOverrides("http://example.com/*.txt=text/html")
+	old := contentTypeOverrides
+	contentTypeOverrides = overrides
+	defer func() { contentTypeOverrides = old }()
+	setFlag(t, "sniff-html", "true")
+
+	for _, tc := range []struct{ url, contentType, body, want string }{
+		{"http://example.com/a.txt", "text/plain", "plain", "text/html"},
+		{"http://example.com/a", "application/octet-stream", "\ufeff\r\n <!DOCTYPE HTML><p>x", "text/html"},
+		{"http://example.com/a", "", "<html><p>x", "text/html"},
+		{"http://example.com/a", "text/plain", "just text", "text/plain"},
+		{"http://example.com/a.gif", "image/gif", "<html>", "image/gif"},
+	} {
+		resp := &http.Response{Header: http.Header{"Content-Type": {tc.contentType}}, Body: io.NopCloser(strings.NewReader(tc.body))}
+		if got := correctContentType(resp, tc.url); got != tc.want || resp.Header.Get("Content-Type") != tc.want {
+			t.Errorf("%s as %q: %q, header %q; want %q", tc.url, tc.contentType, got, resp.Header.Get("Content-Type"), tc.want)
+		}
+		// Sniffing must not consume the body
+		if body, _ := io.ReadAll(resp.Body); string(body) != tc.body {
+			t.Errorf("%s: body %q after sniffing, want %q", tc.url, body, tc.body)
+		}
+	}
+}
+
+func TestBodilessResponsesPassedThrough(t *testing.T) {
+	for _, status := range []int{http.StatusNoContent, http.StatusNotModified} {
+		serveArchivedPage(t, "http://example.com/", "20010401000000", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("ETag", `"abc"`)
+			w.WriteHeader(status)
+		})
+
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		r.Header.Set("If-None-Match", `"abc"`)
+		w := httptest.NewRecorder()
+		handleRequest(w, r)
+		if w.Code != status || w.Body.Len() != 0 {
+			t.Errorf("%d: got %d with %d bytes", status, w.Code, w.Body.Len())
+		}
+		if got := w.Header().Get("Content-Length"); got != "" {
+			t.Errorf("%d: Content-Length %q", status, got)
+		}
+		if got := w.Header().Get("ETag"); got != `"abc"` {
+			t.Errorf("%d: ETag %q", status, got)
+		}
+	}
+}
+
+func TestBodyAllowed(t *testing.T) {
+	for status, want := range map[int]bool{100: false, 200: true, 204: false, 206: true, 301: true, 304: false, 404: true} {
+		if got := bodyAllowed(status); got != want {
+			t.Errorf("bodyAllowed(%d) = %v, want %v", status, got, want)
+		}
+	}
+}
+
+func TestPrefixTitleWithDate(t *testing.T) {
+	page := newPageContext("http://web.archive.org/web/20010915123456/http://example.com/?a=1&b=2")
+	for _, tc := range []struct{ body, want string }{
+		{`<html><head><TITLE lang="en">Home</TITLE></head>`, `<html><head><TITLE lang="en">[2001-09-15] Home</TITLE></head>`},
+		{`<html><head><meta charset="utf-8"></head>`, `<html><head><title>[2001-09-15] http://example.com/?a=1&amp;b=2</title><meta charset="utf-8"></head>`},
+		{`<p>fragment</p>`, `<p>fragment</p>`},
+	} {
+		if got := prefixTitleWithDate(tc.body, page); got != tc.want {
+			t.Errorf("prefixTitleWithDate(%s):\n got %s\nwant %s", tc.body, got, tc.want)
+		}
+	}
+
+	// Timestamps too short to name a day leave the title alone
+	page = newPageContext("http://web.archive.org/web/2001/http://example.com/")
+	if got := prefixTitleWithDate(`<title>Home</title>`, page); got != `<title>Home</title>` {
+		t.Errorf("year-only timestamp: %s", got)
+	}
+}
+
+func TestEmbedProvenanceComment(t *testing.T) {
+	page := newPageContext("http://web.archive.org/web/20010401123456/http://example.com/a--b")
+	note := "<!-- Archived copy of http://example.com/a%2D%2Db captured 2001-04-01 12:34:56 UTC: http://web.archive.org/web/20010401123456/http://example.com/a%2D%2Db -->\n"
+	for _, tc := range []struct{ body, want string }{
+		{`<html><body><p>page</p></BODY ></html>`, `<html><body><p>page</p>` + note + `</BODY ></html>`},
+		// Before the last closing tag, as one in a script is no real end
+		{`<body><script>s = "</body>"</script></body>`, `<body><script>s = "</body>"</script>` + note + `</body>`},
+		{`<p>fragment</p>`, "<p>fragment</p>\n" + note},
+	} {
+		if got := embedProvenanceComment(tc.body, page); got != tc.want {
+			t.Errorf("embedProvenanceComment(%s):\n got %q\nwant %q", tc.body, got, tc.want)
+		}
+	}
+	if got := embedProvenanceComment(`<p>page</p>`, nil); got != `<p>page</p>` {
+		t.Errorf("unknown page: got %s", got)
+	}
+}
+
+func TestArchivedPageProvenance(t *testing.T) {
+	setFlag(t, "embed-provenance", "true")
+	var contentType, body string
+	serveArchivedPage(t, "http://example.com/", "20010401123456", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Write([]byte(body))
+	})
+
+	for _, tc := range []struct{ contentType, body, want string }{
+		{"text/html", `<html><body>page</body></html>`, "<html><body>page<!-- Archived copy of http://example.com/ captured 2001-04-01 12:34:56 UTC: http://web.archive.org/web/20010401123456/http://example.com/ -->\n</body></html>"},
+		{"text/css", `body { color: red }`, `body { color: red }`},
+	} {
+		contentType, body = tc.contentType, tc.body
+		w := httptest.NewRecorder()
+		handleRequest(w, httptest.NewRequest("GET", "http://example.com/", nil))
+		if w.Body.String() != tc.want {
+			t.Errorf("%s response:\n got %q\nwant %q", tc.contentType, w.Body.String(), tc.want)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// canonicalDateLayout is the form dates are kept in internally and sent to
+// the CDX API in.
+const canonicalDateLayout = "20060102"
+
+// dateFormats maps the format names accepted by -accept-date-formats to
+// their layouts. Month and day may be written with one or two digits in all
+// but the canonical form.
+var dateFormats = map[string]string{
+	"YYYYMMDD":   canonicalDateLayout,
+	"YYYY-MM-DD": "2006-1-2",
+	"YYYY/MM/DD": "2006/1/2",
+	"MM/DD/YYYY": "1/2/2006",
+}
+
+// parseDateFormats parses a comma-separated list of format names.
+func parseDateFormats(spec string) ([]string, error) {
+	var formats []string
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if _, ok := dateFormats[name]; !ok {
+			return nil, fmt.Errorf("unknown date format %q", name)
+		}
+		formats = append(formats, name)
+	}
+	if len(formats) == 0 {
+		return nil, fmt.Errorf("no date formats given")
+	}
+	return formats, nil
+}
+
+// normalizeDate converts value, written in any of the accepted formats, to
+// the canonical YYYYMMDD form.
+func normalizeDate(value string, accepted []string) (string, error) {
+	value = strings.TrimSpace(value)
+	for _, name := range accepted {
+		if t, err := time.Parse(dateFormats[name], value); err == nil {
+			return t.Format(canonicalDateLayout), nil
+		}
+	}
+	return "", fmt.Errorf("invalid date %q, accepted formats are %s", value, strings.Join(accepted, ", "))
+}
+
+// relativeDateRe matches a date given relative to an anchor, such as -5y,
+// -18m, -6w or -90d.
+var relativeDateRe = regexp.MustCompile(`^-(\d+)([ymwd])$`)
+
+// resolveRelativeDate converts a relative date like -5y to the canonical
+// form of the day that long before anchor. It reports false if value is not
+// a relative date. Counting back whole months or years from a day the
+// target month lacks, such as the 31st, gives that month's last day.
+func resolveRelativeDate(value string, anchor time.Time) (string, bool) {
+	m := relativeDateRe.FindStringSubmatch(strings.ToLower(strings.TrimSpace(value)))
+	if m == nil {
+		return "", false
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return "", false
+	}
+
+	var resolved time.Time
+	switch m[2] {
+	case "y":
+		resolved = anchor.AddDate(-n, 0, 0)
+	case "m":
+		resolved = anchor.AddDate(0, -n, 0)
+	case "w":
+		resolved = anchor.AddDate(0, 0, -7*n)
+	case "d":
+		resolved = anchor.AddDate(0, 0, -n)
+	}
+	// AddDate carries an overflowing day into the next month
+	if (m[2] == "y" || m[2] == "m") && resolved.Day() != anchor.Day() {
+		resolved = resolved.AddDate(0, 0, -resolved.Day())
+	}
+	return resolved.Format(canonicalDateLayout), true
+}
+
+// dateWindow is a span of time in CDX timestamps, both ends included.
+type dateWindow struct {
+	from, to string
+}
+
+// fallbackWindows returns the spans to search, nearest first, when date has
+// no capture: the stepDays days before date, the stepDays before those, and
+// so on, up to maxDays before it. The lookup for date has no upper bound, so
+// a miss means there is nothing from date onward, and the nearest capture
+// is the latest in the first of these with any. None are returned if
+// stepDays is not positive.
+func fallbackWindows(date string, stepDays int, maxDays int) []dateWindow {
+	start, err := time.Parse(canonicalDateLayout, date)
+	if err != nil || stepDays <= 0 {
+		return nil
+	}
+
+	var windows []dateWindow
+	for nearer := 0; nearer < maxDays; nearer += stepDays {
+		farther := nearer + stepDays
+		if farther > maxDays {
+			farther = maxDays
+		}
+		windows = append(windows, dateWindow{
+			from: start.AddDate(0, 0, -farther).Format(canonicalDateLayout),
+			to:   start.AddDate(0, 0, -nearer-1).Format(canonicalDateLayout) + "235959",
+		})
+	}
+	return windows
+}
+
+// captureDelta returns how far the capture with the given Wayback timestamp
+// lies from date, positive when it was captured after it. Timestamps shorter
+// than 14 digits are taken as the start of the period they name.
+func captureDelta(date string, timestamp string) (time.Duration, bool) {
+	requested, err := time.Parse(canonicalDateLayout, date)
+	if err != nil || len(timestamp) < 8 {
+		return 0, false
+	}
+	if len(timestamp) < 14 {
+		timestamp += "000000"[:14-len(timestamp)]
+	}
+	captured, err := time.Parse("20060102150405", timestamp[:14])
+	if err != nil {
+		return 0, false
+	}
+	return captured.Sub(requested), true
+}
+
+// captureTime returns the time the capture with the given Wayback timestamp
+// was made, in UTC, as the archive records it. Timestamps shorter than 14
+// digits are taken as the start of the period they name.
+func captureTime(timestamp string) (time.Time, bool) {
+	if len(timestamp) < 4 || len(timestamp) > 14 {
+		return time.Time{}, false
+	}
+	padded := timestamp + "0101000000"[len(timestamp)-4:]
+	captured, err := time.Parse("20060102150405", padded)
+	return captured, err == nil
+}
+
+// setCaptureDateHeaders gives an archived response the Date of its capture,
+// for -use-capture-date-header, and a Last-Modified of the original
+// server's, as the archive recorded it, or else the capture time too.
+func setCaptureDateHeaders(resp *http.Response, timestamp string) {
+	captured, ok := captureTime(timestamp)
+	if !ok {
+		return
+	}
+	resp.Header.Set("Date", captured.Format(http.TimeFormat))
+
+	lastModified := captured
+	if original, err := http.ParseTime(resp.Header.Get("X-Archive-Orig-Last-Modified")); err == nil && !original.After(captured) {
+		lastModified = original
+	}
+	resp.Header.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+}
+
+// captureYear returns the year of the capture with the given Wayback
+// timestamp.
+func captureYear(timestamp string) (int, bool) {
+	if len(timestamp) < 4 {
+		return 0, false
+	}
+	year, err := time.Parse("2006", timestamp[:4])
+	if err != nil {
+		return 0, false
+	}
+	return year.Year(), true
+}
+
+// hostDates maps host names, from -host-date-map, to the date requests
+// addressed to them are served for, overriding -date.
+var hostDates = map[string]string{}
+
+// parseHostDateMap parses a comma-separated list of host=date entries, with
+// dates in any of the accepted formats or relative to anchor, as for -date.
+func parseHostDateMap(spec string, formats []string, anchor time.Time) (map[string]string, error) {
+	dates := map[string]string{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		eq := strings.Index(entry, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("invalid entry %q, expected host=date", entry)
+		}
+		host := strings.ToLower(strings.TrimSpace(entry[:eq]))
+		value := strings.TrimSpace(entry[eq+1:])
+		if resolved, ok := resolveRelativeDate(value, anchor); ok {
+			value = resolved
+		}
+		date, err := normalizeDate(value, formats)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", host, err)
+		}
+		dates[host] = date
+	}
+	return dates, nil
+}
+
+// requestDate returns the date r is served for: the -host-date-map date of
+// the host the client addressed, or -date. Only clients addressing the
+// proxy directly name it in the Host header; requests from browsers using it
+// as a proxy name the archived site there, and always get -date.
+func requestDate(r *http.Request) string {
+	if len(hostDates) == 0 || r.URL.IsAbs() {
+		return *date
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if hostDate, ok := hostDates[strings.ToLower(host)]; ok {
+		return hostDate
+	}
+	return *date
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFallbackWindows(t *testing.T) {
+	got := fallbackWindows("20010401", 30, 75)
+	want := []dateWindow{
+		{"20010302", "20010331235959"},
+		{"20010131", "20010301235959"},
+		{"20010116", "20010130235959"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("fallbackWindows = %v, want %v", got, want)
+	}
+	if got := fallbackWindows("20010401", 0, 365); got != nil {
+		t.Errorf("fallbackWindows with no step = %v", got)
+	}
+}
+
+func TestResolveRelativeDate(t *testing.T) {
+	anchor := time.Date(2024, time.March, 31, 15, 0, 0, 0, time.UTC)
+	for value, want := range map[string]string{
+		"-5y":  "20190331",
+		" -1M": "20240229",
+		"-13m": "20230228",
+		"-2w":  "20240317",
+		"-90d": "20240101",
+		"-0d":  "20240331",
+	} {
+		if got, ok := resolveRelativeDate(value, anchor); !ok || got != want {
+			t.Errorf("resolveRelativeDate(%q) = %q, %v; want %q", value, got, ok, want)
+		}
+	}
+	for _, value := range []string{"20010401", "5y", "-5", "-1.5y", "+5y", "-5years"} {
+		if got, ok := resolveRelativeDate(value, anchor); ok {
+			t.Errorf("resolveRelativeDate(%q) = %q, want no match", value, got)
+		}
+	}
+}
+
+func TestParseHostDateMap(t *testing.T) {
+	formats, err := parseDateFormats("YYYYMMDD,YYYY-MM-DD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	anchor := time.Date(2024, time.March, 31, 15, 0, 0, 0, time.UTC)
+	got, err := parseHostDateMap("2001.proxy.lan=20010101, Recent.Proxy.Lan = -5y,last-month.proxy.lan=-1m,2010.proxy.lan=2010-06-15", formats, anchor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"2001.proxy.lan":       "20010101",
+		"recent.proxy.lan":     "20190331",
+		"last-month.proxy.lan": "20240229",
+		"2010.proxy.lan":       "20100615",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseHostDateMap = %v, want %v", got, want)
+	}
+
+	for _, spec := range []string{"old.proxy.lan=-5", "old.proxy.lan=5y", "=-5y", "old.proxy.lan"} {
+		if _, err := parseHostDateMap(spec, formats, anchor); err == nil {
+			t.Errorf("parseHostDateMap(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestSetCaptureDateHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		origLastModified string
+		wantLastModified string
+	}{
+		{"original date", "Sun, 01 Apr 2001 00:00:00 GMT", "Sun, 01 Apr 2001 00:00:00 GMT"},
+		{"later than the capture", "Tue, 01 May 2001 00:00:00 GMT", "Sun, 15 Apr 2001 12:30:00 GMT"},
+		{"none", "", "Sun, 15 Apr 2001 12:30:00 GMT"},
+	} {
+		resp := &http.Response{Header: http.Header{}}
+		if tc.origLastModified != "" {
+			resp.Header.Set("X-Archive-Orig-Last-Modified", tc.origLastModified)
+		}
+		setCaptureDateHeaders(resp, "20010415123000")
+		if got := resp.Header.Get("Date"); got != "Sun, 15 Apr 2001 12:30:00 GMT" {
+			t.Errorf("%s: Date = %q", tc.name, got)
+		}
+		if got := resp.Header.Get("Last-Modified"); got != tc.wantLastModified {
+			t.Errorf("%s: Last-Modified = %q, want %q", tc.name, got, tc.wantLastModified)
+		}
+	}
+
+	resp := &http.Response{Header: http.Header{}}
+	setCaptureDateHeaders(resp, "2001x")
+	if len(resp.Header) != 0 {
+		t.Errorf("invalid timestamp: headers %v", resp.Header)
+	}
+}
+
+func TestArchivedPageDatedAtCapture(t *testing.T) {
+	setFlag(t, "use-capture-date-header", "true")
+	serveArchivedPage(t, "http://example.com/", "20010415123000", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("X-Archive-Orig-Last-Modified", "Sun, 01 Apr 2001 00:00:00 GMT")
+		w.Write([]byte("<html><body>page</body></html>"))
+	})
+
+	w := httptest.NewRecorder()
+	handleRequest(w, httptest.NewRequest("GET", "http://example.com/", nil))
+	if got := w.Header().Get("Date"); got != "Sun, 15 Apr 2001 12:30:00 GMT" {
+		t.Errorf("Date = %q", got)
+	}
+	if got := w.Header().Get("Last-Modified"); got != "Sun, 01 Apr 2001 00:00:00 GMT" {
+		t.Errorf("Last-Modified = %q", got)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// directHostTargets maps the hosts that are proxied directly to a live
+// mirror instead of being looked up in the Wayback Machine to the base URL
+// of that mirror. The URLs are parsed once, when the proxy starts.
+var directHostTargets = map[string]*url.URL{
+	"geocities.restorativland.org": mustParseURL("https://geocities.restorativland.org"),
+}
+
+func mustParseURL(rawURL string) *url.URL {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
+
+// directTarget returns the base URL requests for host are proxied to, if
+// host, with or without a port, is one of directHostTargets or a subdomain
+// of one. The URL keeps the host the client addressed, without the port,
+// which only applied to the client's plain HTTP request: mirrors like
+// geocities.restorativland.org serve several virtual hosts from one
+// server, and tell them apart by the Host header.
+func directTarget(host string) (*url.URL, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for domain, base := range directHostTargets {
+		if matchesDomain(host, []string{domain}) {
+			target := *base
+			target.Host = host
+			if base.Port() != "" {
+				target.Host = net.JoinHostPort(host, base.Port())
+			}
+			return &target, true
+		}
+	}
+	return nil, false
+}
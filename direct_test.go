@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestDirectTarget(t *testing.T) {
+	for _, tc := range []struct {
+		host, want string
+		ok         bool
+	}{
+		{"geocities.restorativland.org", "https://geocities.restorativland.org", true},
+		{"GeoCities.RestorativLand.org.:80", "https://geocities.restorativland.org", true},
+		{"www.geocities.restorativland.org", "https://www.geocities.restorativland.org", true},
+		{"restorativland.org", "", false},
+		{"geocities.restorativland.org.evil.example", "", false},
+	} {
+		target, ok := directTarget(tc.host)
+		if ok != tc.ok || (ok && target.String() != tc.want) {
+			t.Errorf("directTarget(%s) = %v, %v; want %s, %v", tc.host, target, ok, tc.want, tc.ok)
+		}
+	}
+
+	// Each request gets its own copy of the parsed base URL
+	target, _ := directTarget("geocities.restorativland.org")
+	target.Path = "/changed"
+	if base := directHostTargets["geocities.restorativland.org"]; base.Path != "" {
+		t.Errorf("shared base URL modified: %s", base)
+	}
+}
+
+func TestDirectRequestKeepsHost(t *testing.T) {
+	var host, uri string
+	mirror := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, uri = r.Host, r.RequestURI
+		w.Write([]byte("mirrored"))
+	}))
+	defer mirror.Close()
+	_, port, _ := net.SplitHostPort(mirror.Listener.Addr().String())
+
+	oldTargets := directHostTargets
+	directHostTargets = map[string]*url.URL{"mirror.example": mustParseURL("https://mirror.example:" + port)}
+	defer func() { directHostTargets = oldTargets }()
+	routeToServer(t, "www.mirror.example:"+port, mirror)
+
+	r := httptest.NewRequest("GET", "/~user/index.html?x=1", nil)
+	r.Host = "WWW.Mirror.Example:80"
+	w := httptest.NewRecorder()
+	handleRequest(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "mirrored" {
+		t.Fatalf("got %d %q", w.Code, w.Body.String())
+	}
+	if want := "www.mirror.example:" + port; host != want {
+		t.Errorf("mirror was asked for Host %s, want %s", host, want)
+	}
+	if uri != "/~user/index.html?x=1" {
+		t.Errorf("mirror was asked for %s", uri)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+)
+
+// errorPageData is what error page templates can refer to: {{.URL}} is the
+// URL the client asked for, {{.Date}} the configured archive date and
+// {{.Error}} a description of what went wrong.
+type errorPageData struct {
+	Status     int
+	StatusText string
+	URL        string
+	Date       string
+	Error      string
+}
+
+// builtinErrorPage is used for any status without a custom page. It sticks to
+// HTML 3.2 so it renders in the browsers people use the proxy with.
+var builtinErrorPage = template.Must(template.New("error").Parse(`<!DOCTYPE HTML PUBLIC "-//W3C//DTD HTML 3.2 Final//EN">
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body bgcolor="#ffffff">
+<h1>{{.StatusText}}</h1>
+<p>{{.Error}}</p>
+{{if .URL}}<p>Requested URL: <a href="{{.URL}}">{{.URL}}</a></p>
+{{end}}<hr>
+<p><i>Time Surfer Proxy, browsing {{.Date}}</i></p>
+</body>
+</html>
+`))
+
+// errorPages holds the custom templates loaded at startup, keyed by status.
+var errorPages = map[int]*template.Template{}
+
+// loadErrorPage parses the template at path and makes it the page served for
+// status. The template is rendered once with sample data so that a bad
+// placeholder is reported at startup rather than on the first error.
+func loadErrorPage(status int, path string) error {
+	if path == "" {
+		return nil
+	}
+
+	tmpl, err := template.ParseFiles(path)
+	if err != nil {
+		return err
+	}
+
+	sample := errorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		URL:        "http://www.example.com/",
+		Date:       "20020401",
+		Error:      "sample error",
+	}
+	if err := tmpl.Execute(io.Discard, sample); err != nil {
+		return err
+	}
+
+	errorPages[status] = tmpl
+	return nil
+}
+
+// serveErrorPage responds with an HTML error page for status, using the
+// custom template for that status if one was configured.
+func serveErrorPage(w http.ResponseWriter, status int, requestedURL string, detail string) {
+	tmpl, ok := errorPages[status]
+	if !ok {
+		tmpl = builtinErrorPage
+	}
+
+	data := errorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		URL:        requestedURL,
+		Date:       *date,
+		Error:      detail,
+	}
+
+	var page bytes.Buffer
+	if err := tmpl.Execute(&page, data); err != nil {
+		errorLog("Error rendering %d error page: %v", status, err)
+		http.Error(w, detail, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(page.Len()))
+	w.WriteHeader(status)
+	w.Write(page.Bytes())
+}
+
+// replaceWithErrorPage replaces an upstream response with an error page, for
+// responses that are rejected once they have arrived.
+func replaceWithErrorPage(resp *http.Response, status int, requestedURL string, detail string) {
+	recorder := httptest.NewRecorder()
+	serveErrorPage(recorder, status, requestedURL, detail)
+	resp.StatusCode = status
+	resp.Status = recorder.Result().Status
+	resp.Header = recorder.Header()
+	resp.Body = io.NopCloser(recorder.Body)
+	resp.ContentLength = int64(recorder.Body.Len())
+}
+
+// statusForResolveError maps an error from resolving a Wayback URL to the
+// status reported to the client.
+func statusForResolveError(err error) int {
+	if errors.Is(err, ErrNoCapture) {
+		return http.StatusNotFound
+	}
+	if errors.Is(err, ErrCDXUnavailable) {
+		return http.StatusServiceUnavailable
+	}
+	if errors.Is(err, ErrBadCDXResponse) {
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
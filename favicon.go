@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+)
+
+// faviconPath is where browsers look for a site's icon.
+const faviconPath = "/favicon.ico"
+
+// favicon is the icon served with -favicon, nil when it is not set.
+var favicon []byte
+
+// loadFavicon returns the icon for -favicon: the built-in one for
+// "builtin", or else the contents of the file named by spec.
+func loadFavicon(spec string) ([]byte, error) {
+	if spec == "builtin" {
+		return builtinFavicon(), nil
+	}
+	return os.ReadFile(spec)
+}
+
+// isFaviconRequest reports whether r, for originalURL, asks for a site's
+// /favicon.ico while -favicon is set.
+func isFaviconRequest(r *http.Request, originalURL string) bool {
+	if favicon == nil || r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	target, err := url.Parse(originalURL)
+	return err == nil && target.RawQuery == "" && path.Clean(target.Path) == faviconPath
+}
+
+// serveFavicon answers with the -favicon icon.
+func serveFavicon(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "image/x-icon")
+	w.Header().Set("Content-Length", strconv.Itoa(len(favicon)))
+	w.Header().Set("Cache-Control", "max-age=86400")
+	w.WriteHeader(http.StatusOK)
+	if r.Method != "HEAD" {
+		w.Write(favicon)
+	}
+}
+
+// builtinFavicon draws the proxy's own 16x16 icon, a clock face, as an ICO
+// file holding a single 32-bit bitmap, which every browser that asks for
+// /favicon.ico understands.
+func builtinFavicon() []byte {
+	const size = 16
+	var (
+		clear = [4]byte{0, 0, 0, 0}
+		face  = [4]byte{0xf0, 0xf0, 0xf0, 0xff} // BGRA
+		rim   = [4]byte{0x80, 0x30, 0x00, 0xff}
+		hand  = [4]byte{0x20, 0x20, 0x20, 0xff}
+	)
+
+	pixel := func(x, y int) [4]byte {
+		// Distance from the centre, doubled so it stays an integer
+		dx, dy := 2*x-(size-1), 2*y-(size-1)
+		d := dx*dx + dy*dy
+		switch {
+		case d > 15*15:
+			return clear
+		case d > 12*12:
+			return rim
+		case x == 7 && y >= 3 && y <= 8, y == 8 && x >= 7 && x <= 11:
+			// Hands pointing at twelve and three
+			return hand
+		default:
+			return face
+		}
+	}
+
+	var image bytes.Buffer
+	// BITMAPINFOHEADER; an icon's height counts the AND mask as well
+	binary.Write(&image, binary.LittleEndian, struct {
+		Size                  uint32
+		Width, Height         int32
+		Planes, BitCount      uint16
+		Compression, SizeData uint32
+		XPerMeter, YPerMeter  int32
+		ColorsUsed, Important uint32
+	}{Size: 40, Width: size, Height: 2 * size, Planes: 1, BitCount: 32})
+	// Rows are stored bottom up
+	for y := size - 1; y >= 0; y-- {
+		for x := 0; x < size; x++ {
+			p := pixel(x, y)
+			image.Write(p[:])
+		}
+	}
+	// The AND mask is unused with an alpha channel, but must be present:
+	// one bit per pixel, rows padded to 4 bytes
+	image.Write(make([]byte, size*4))
+
+	var ico bytes.Buffer
+	binary.Write(&ico, binary.LittleEndian, struct {
+		Reserved, Type, Count uint16
+	}{Type: 1, Count: 1})
+	binary.Write(&ico, binary.LittleEndian, struct {
+		Width, Height, Colors, Reserved uint8
+		Planes, BitCount                uint16
+		Size, Offset                    uint32
+	}{Width: size, Height: size, Planes: 1, BitCount: 32, Size: uint32(image.Len()), Offset: 6 + 16})
+	ico.Write(image.Bytes())
+	return ico.Bytes()
+}
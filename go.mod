@@ -1,3 +1,5 @@
 module timesurfer
 
-go 1.16
\ No newline at end of file
+go 1.16
+
+require github.com/andybalholm/brotli v1.0.6
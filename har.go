@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HAR 1.2 structures, see http://www.softwareishard.com/blog/har-12-spec/.
+// Only the fields the proxy can fill in are included.
+type harLog struct {
+	Log harLogBody `json:"log"`
+}
+
+type harLogBody struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string  `json:"method"`
+	URL         string  `json:"url"`
+	HTTPVersion string  `json:"httpVersion"`
+	Cookies     []harNV `json:"cookies"`
+	Headers     []harNV `json:"headers"`
+	QueryString []harNV `json:"queryString"`
+	HeadersSize int     `json:"headersSize"`
+	BodySize    int64   `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int        `json:"status"`
+	StatusText  string     `json:"statusText"`
+	HTTPVersion string     `json:"httpVersion"`
+	Cookies     []harNV    `json:"cookies"`
+	Headers     []harNV    `json:"headers"`
+	Content     harContent `json:"content"`
+	RedirectURL string     `json:"redirectURL"`
+	HeadersSize int        `json:"headersSize"`
+	BodySize    int64      `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harNV struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+const (
+	// harMaxEntries bounds the entries kept in memory for the HAR file; the
+	// oldest are dropped to make room for new ones.
+	harMaxEntries = 10000
+	// harMaxBodyBytes bounds the response bodies kept with -har-bodies, in
+	// all and for a single response.
+	harMaxBodyBytes = 64 << 20
+)
+
+// harBodyOmitted is the comment on a response whose body was not recorded
+// because of harMaxBodyBytes.
+const harBodyOmitted = "body not recorded, over the -har-bodies size limit"
+
+// harRecorder collects an entry for every request it sees, up to
+// maxEntries of the latest, and writes them all to a HAR file when flushed.
+type harRecorder struct {
+	path         string
+	withBodies   bool
+	maxEntries   int
+	maxBodyBytes int
+
+	mu        sync.Mutex
+	entries   []harEntry
+	bodyBytes int
+	dropped   int
+}
+
+func newHARRecorder(path string, withBodies bool) *harRecorder {
+	return &harRecorder{path: path, withBodies: withBodies, maxEntries: harMaxEntries, maxBodyBytes: harMaxBodyBytes}
+}
+
+// harResponseWriter captures what is written to the client, and the body
+// up to bodyLimit bytes, if body is set.
+type harResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	header      http.Header
+	size        int64
+	body        *bytes.Buffer
+	bodyLimit   int
+	bodyOmitted bool
+	firstByteAt time.Time
+}
+
+func (w *harResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+		w.header = w.ResponseWriter.Header().Clone()
+		w.firstByteAt = time.Now()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *harResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.size += int64(n)
+	if w.body != nil {
+		if w.body.Len()+n > w.bodyLimit {
+			w.body, w.bodyOmitted = nil, true
+		} else {
+			w.body.Write(p[:n])
+		}
+	}
+	return n, err
+}
+
+func (w *harResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// middleware records every request served by next.
+func (h *harRecorder) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		requestHeader := r.Header.Clone()
+
+		hw := &harResponseWriter{ResponseWriter: w, bodyLimit: h.maxBodyBytes}
+		if h.withBodies {
+			hw.body = &bytes.Buffer{}
+		}
+		next.ServeHTTP(hw, r)
+
+		finished := time.Now()
+		if hw.status == 0 {
+			hw.status = http.StatusOK
+			hw.header = w.Header().Clone()
+			hw.firstByteAt = finished
+		}
+
+		requestURL := r.URL.String()
+		if !r.URL.IsAbs() {
+			requestURL = "http://" + r.Host + r.URL.RequestURI()
+		}
+
+		var query []harNV
+		for name, values := range r.URL.Query() {
+			for _, value := range values {
+				query = append(query, harNV{Name: name, Value: value})
+			}
+		}
+
+		entry := harEntry{
+			StartedDateTime: started.Format("2006-01-02T15:04:05.000Z07:00"),
+			Time:            milliseconds(finished.Sub(started)),
+			Request: harRequest{
+				Method:      r.Method,
+				URL:         requestURL,
+				HTTPVersion: r.Proto,
+				Cookies:     []harNV{},
+				Headers:     harHeaders(requestHeader),
+				QueryString: append([]harNV{}, query...),
+				HeadersSize: -1,
+				BodySize:    r.ContentLength,
+			},
+			Response: harResponse{
+				Status:      hw.status,
+				StatusText:  http.StatusText(hw.status),
+				HTTPVersion: r.Proto,
+				Cookies:     []harNV{},
+				Headers:     harHeaders(hw.header),
+				Content:     harBody(hw.header.Get("Content-Type"), hw.size, hw.body),
+				RedirectURL: hw.header.Get("Location"),
+				HeadersSize: -1,
+				BodySize:    hw.size,
+			},
+			Timings: harTimings{
+				Wait:    milliseconds(hw.firstByteAt.Sub(started)),
+				Receive: milliseconds(finished.Sub(hw.firstByteAt)),
+			},
+		}
+
+		if hw.bodyOmitted {
+			entry.Response.Content.Comment = harBodyOmitted
+		}
+		h.add(entry)
+	})
+}
+
+// add records entry, without its body if that would take the bodies kept
+// over maxBodyBytes, and drops the oldest entry if there are more than
+// maxEntries.
+func (h *harRecorder) add(entry harEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	size := len(entry.Response.Content.Text)
+	if size > 0 && h.bodyBytes+size > h.maxBodyBytes {
+		entry.Response.Content.Text, entry.Response.Content.Encoding = "", ""
+		entry.Response.Content.Comment = harBodyOmitted
+		size = 0
+	}
+	h.entries = append(h.entries, entry)
+	h.bodyBytes += size
+	if len(h.entries) > h.maxEntries {
+		h.bodyBytes -= len(h.entries[0].Response.Content.Text)
+		h.entries = h.entries[1:]
+		h.dropped++
+	}
+}
+
+// flush writes all entries recorded so far to the HAR file.
+func (h *harRecorder) flush() error {
+	h.mu.Lock()
+	entries := append([]harEntry{}, h.entries...)
+	dropped := h.dropped
+	h.mu.Unlock()
+	if dropped > 0 {
+		warnLog("HAR file %s only holds the last %d requests, %d earlier ones were dropped", h.path, len(entries), dropped)
+	}
+
+	har := harLog{Log: harLogBody{
+		Version: "1.2",
+		Creator: harCreator{Name: "Time Surfer Proxy", Version: version},
+		Entries: entries,
+	}}
+
+	data, err := json.MarshalIndent(har, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(h.path, data, 0644)
+}
+
+func harHeaders(header http.Header) []harNV {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	headers := []harNV{}
+	for _, name := range names {
+		for _, value := range header[name] {
+			headers = append(headers, harNV{Name: name, Value: value})
+		}
+	}
+	return headers
+}
+
+// harBody describes a response body, including its text when bodies are
+// being captured. Non-text bodies are stored base64 encoded.
+func harBody(contentType string, size int64, body *bytes.Buffer) harContent {
+	content := harContent{Size: size, MimeType: contentType}
+	if body == nil {
+		return content
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "javascript") ||
+		strings.HasSuffix(mediaType, "json") || strings.HasSuffix(mediaType, "xml") {
+		content.Text = body.String()
+	} else {
+		content.Text = base64.StdEncoding.EncodeToString(body.Bytes())
+		content.Encoding = "base64"
+	}
+	return content
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
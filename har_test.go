@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHARRecorderBoundsEntriesAndBodies(t *testing.T) {
+	har := newHARRecorder(filepath.Join(t.TempDir(), "session.har"), true)
+	har.maxEntries, har.maxBodyBytes = 3, 10
+	handler := har.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if r.URL.Path == "/big" {
+			w.Write([]byte("0123456789abc"))
+			return
+		}
+		w.Write([]byte("0123456"))
+	}))
+
+	for _, path := range []string{"/1", "/2", "/3", "/4", "/5", "/big"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com"+path, nil))
+	}
+	if err := har.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(har.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var log harLog
+	if err := json.Unmarshal(data, &log); err != nil {
+		t.Fatalf("HAR file is not JSON: %v", err)
+	}
+	var got []string
+	for _, entry := range log.Log.Entries {
+		got = append(got, entry.Request.URL+" "+entry.Response.Content.Text+entry.Response.Content.Comment)
+	}
+	want := []string{
+		"http://example.com/4 " + harBodyOmitted,
+		"http://example.com/5 0123456",
+		"http://example.com/big " + harBodyOmitted,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("entries = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("entry %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+	if size := log.Log.Entries[2].Response.Content.Size; size != 13 {
+		t.Errorf("size of the omitted body = %d, want 13", size)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// siteIndexParam is the query parameter, set to 1, that asks for a list of
+// the archived pages under a URL instead of the page itself.
+const siteIndexParam = "__index"
+
+// siteIndexLimit caps the number of pages a site index lists.
+const siteIndexLimit = 1000
+
+// siteIndexEntry is one archived page listed in a site index.
+type siteIndexEntry struct {
+	URL  string // where the page is fetched through the proxy
+	Name string // the page's original URL
+	Date string // when it was captured, YYYY-MM-DD
+}
+
+// siteIndexData is what the site index template refers to.
+type siteIndexData struct {
+	Prefix    string
+	Date      string
+	Entries   []siteIndexEntry
+	Truncated bool
+}
+
+// siteIndexPage sticks to HTML 3.2, like the error pages, so it renders in
+// old browsers.
+var siteIndexPage = template.Must(template.New("index").Parse(`<!DOCTYPE HTML PUBLIC "-//W3C//DTD HTML 3.2 Final//EN">
+<html>
+<head><title>Archived pages under {{.Prefix}}</title></head>
+<body bgcolor="#ffffff">
+<h1>Archived pages under {{.Prefix}}</h1>
+<p>{{len .Entries}} page(s) captured on or after {{.Date}}{{if .Truncated}}, only the first {{len .Entries}} are listed{{end}}.</p>
+<ul>
+{{range .Entries}}<li><a href="{{.URL}}">{{.Name}}</a> ({{.Date}})
+{{end}}</ul>
+<hr>
+<p><i>Time Surfer Proxy, browsing {{.Date}}</i></p>
+</body>
+</html>
+`))
+
+// siteIndexPrefix reports whether originalURL asks for a site index, and if
+// so returns the URL with the parameter removed.
+func siteIndexPrefix(originalURL string) (string, bool) {
+	u, err := url.Parse(originalURL)
+	if err != nil || u.RawQuery == "" {
+		return "", false
+	}
+	query := u.Query()
+	if query.Get(siteIndexParam) != "1" {
+		return "", false
+	}
+	query.Del(siteIndexParam)
+	u.RawQuery = query.Encode()
+	return u.String(), true
+}
+
+// serveSiteIndex lists the HTML pages the archive holds under prefix,
+// captured on or after date, each linked through the proxy.
+func serveSiteIndex(w http.ResponseWriter, r *http.Request, prefix string, date string) {
+	entries, truncated, err := listArchivedPages(prefix, date)
+	if err != nil {
+		errorLog("Error listing archived pages under %s: %v", prefix, err)
+		serveErrorPage(w, http.StatusBadGateway, prefix, "Error listing archived pages: "+err.Error())
+		return
+	}
+
+	base := localBaseFor(r)
+	for i := range entries {
+		if u, err := url.Parse(entries[i].Name); err == nil {
+			entries[i].URL = base + proxyLocalURL(u)
+		}
+	}
+
+	var page bytes.Buffer
+	data := siteIndexData{Prefix: prefix, Date: date, Entries: entries, Truncated: truncated}
+	if err := siteIndexPage.Execute(&page, data); err != nil {
+		errorLog("Error rendering site index for %s: %v", prefix, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(page.Len()))
+	w.Write(page.Bytes())
+}
+
+// listArchivedPages queries the CDX API for the distinct HTML pages
+// captured under prefix on or after date.
+func listArchivedPages(prefix string, date string) ([]siteIndexEntry, bool, error) {
+	cdxURL := fmt.Sprintf("%s?url=%s&matchType=prefix&collapse=urlkey&from=%s&filter=statuscode:200&filter=mimetype:text/html&limit=%d&output=json&fl=%s",
+		cdxAPIURL, cdxURLParam(prefix), date, siteIndexLimit+1, cdxFields)
+	debugLog("Calling CDX API: %s", cdxURL)
+
+	resp, err := fetchCDX(newCDXClient(), cdxURL)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	var captures []cdxCapture
+	err = decodeCDX(resp.Body, func(capture cdxCapture) bool {
+		captures = append(captures, capture)
+		return true
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	truncated := len(captures) > siteIndexLimit
+	if truncated {
+		captures = captures[:siteIndexLimit]
+	}
+	entries := make([]siteIndexEntry, 0, len(captures))
+	for _, capture := range captures {
+		if capture.Original == "" {
+			continue
+		}
+		entry := siteIndexEntry{Name: capture.Original, Date: capture.Timestamp}
+		if len(capture.Timestamp) < 8 {
+			continue
+		}
+		if captured, err := time.Parse("20060102", capture.Timestamp[:8]); err == nil {
+			entry.Date = captured.Format("2006-01-02")
+		}
+		entries = append(entries, entry)
+	}
+	return entries, truncated, nil
+}
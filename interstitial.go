@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// interstitialData is what the redirect interstitial refers to.
+type interstitialData struct {
+	From     string // the page that redirects
+	To       string // where it redirects to
+	Continue string // the target, fetched through the proxy
+	Date     string // the date being browsed, YYYY-MM-DD
+	Captured string // the date of the target's nearest capture, YYYY-MM-DD
+	Days     int    // between the two
+	Before   bool   // whether the capture is from before the date
+}
+
+// interstitialPage sticks to HTML 3.2, like the error pages.
+var interstitialPage = template.Must(template.New("interstitial").Parse(`<!DOCTYPE HTML PUBLIC "-//W3C//DTD HTML 3.2 Final//EN">
+<html>
+<head><title>Redirect to {{.To}}</title></head>
+<body bgcolor="#ffffff">
+<h1>Redirect to another period</h1>
+<p>{{.From}} redirects to {{.To}}, whose nearest capture is from {{.Captured}}, {{.Days}} days {{if .Before}}before{{else}}after{{end}} {{.Date}}.</p>
+<p><a href="{{.Continue}}">Continue to {{.To}}</a></p>
+<hr>
+<p><i>Time Surfer Proxy, browsing {{.Date}}</i></p>
+</body>
+</html>
+`))
+
+// offPeriodCapture reports whether the capture with the given timestamp is
+// more than maxDays away from date, in either direction, and how many days
+// away it is.
+func offPeriodCapture(date string, timestamp string, maxDays int) (int, bool) {
+	delta, ok := captureDelta(date, timestamp)
+	if !ok {
+		return 0, false
+	}
+	days := int(math.Round(delta.Hours() / 24))
+	return days, days > maxDays || days < -maxDays
+}
+
+// interceptOffPeriodRedirect replaces resp, a redirect from the page at from
+// to target, with the -redirect-interstitial page if target's capture for
+// date is more than -redirect-interstitial-days away. It reports whether it
+// did. A target that can't be resolved is left to the redirect, which
+// reports the error once followed.
+func interceptOffPeriodRedirect(resp *http.Response, r *http.Request, from string, target *url.URL, date string) bool {
+	rl := requestLogFrom(r)
+	waybackURL, err := resolveWaybackURL(rl, target.String(), date)
+	if err != nil {
+		return false
+	}
+	ref, ok := parseWaybackURL(waybackURL)
+	if !ok {
+		return false
+	}
+	days, off := offPeriodCapture(date, ref.Timestamp, *redirectInterstitialDays)
+	if !off {
+		return false
+	}
+	rl.debug("Redirect from %s to %s lands %+d days away, serving interstitial", from, target, days)
+
+	data := interstitialData{
+		From:     from,
+		To:       target.String(),
+		Continue: redirectLocation(r, target),
+		Date:     isoDate(date),
+		Captured: isoDate(ref.Timestamp),
+		Days:     days,
+		Before:   days < 0,
+	}
+	if days < 0 {
+		data.Days = -days
+	}
+	var page bytes.Buffer
+	if err := interstitialPage.Execute(&page, data); err != nil {
+		errorLog("Error rendering redirect interstitial for %s: %v", target, err)
+		return false
+	}
+
+	resp.Body.Close()
+	resp.StatusCode = http.StatusOK
+	resp.Status = "200 OK"
+	resp.Header = http.Header{}
+	resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+	resp.Header.Set("Content-Length", strconv.Itoa(page.Len()))
+	resp.Header.Set("Cache-Control", "no-store")
+	resp.Body = io.NopCloser(&page)
+	resp.ContentLength = int64(page.Len())
+	return true
+}
+
+// isoDate formats the day of a Wayback timestamp or YYYYMMDD date as
+// YYYY-MM-DD, returning anything else as it is.
+func isoDate(timestamp string) string {
+	if len(timestamp) < 8 {
+		return timestamp
+	}
+	day, err := time.Parse(canonicalDateLayout, timestamp[:8])
+	if err != nil {
+		return timestamp
+	}
+	return day.Format("2006-01-02")
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOffPeriodCapture(t *testing.T) {
+	for _, tc := range []struct {
+		timestamp string
+		days      int
+		off       bool
+	}{
+		{"20010411000000", 10, false},
+		{"20020402000000", 366, true},
+		{"20000331000000", -366, true},
+		{"2001x", 0, false},
+	} {
+		days, off := offPeriodCapture("20010401", tc.timestamp, 365)
+		if days != tc.days || off != tc.off {
+			t.Errorf("offPeriodCapture(%s) = %d, %v, want %d, %v", tc.timestamp, days, off, tc.days, tc.off)
+		}
+	}
+}
+
+func TestRedirectInterstitial(t *testing.T) {
+	setFlag(t, "redirect-interstitial", "true")
+	setFlag(t, "redirect-interstitial-days", "365")
+	setFlag(t, "date", "20010401")
+	captures := map[string]string{
+		"http://example.com/":     "20010401000000",
+		"http://example.com/near": "20010405000000",
+		"http://example.com/far":  "20050101000000",
+	}
+	newCDXServer(t, func(w http.ResponseWriter, r *http.Request) {
+		for u, timestamp := range captures {
+			if r.URL.Query().Get("url") == normalizeLookupURL(u) && timestamp >= r.URL.Query().Get("from") {
+				cdxRows(w, [2]string{timestamp, u})
+				return
+			}
+		}
+		cdxRows(w)
+	})
+	var target string
+	var crawlTime bool
+	newArchiveServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if crawlTime {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(crawlRedirectPage(target)))
+			return
+		}
+		w.Header().Set("Location", "http://web.archive.org/web/20010401000000/"+target)
+		w.WriteHeader(http.StatusFound)
+	})
+
+	target = "http://example.com/far"
+	w := httptest.NewRecorder()
+	handleRequest(w, httptest.NewRequest("GET", "http://example.com/", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "from 2005-01-01, 1371 days after 2001-04-01") ||
+		!strings.Contains(w.Body.String(), `<a href="http://example.com/far">`) {
+		t.Errorf("redirect far away: got %d\n%s", w.Code, w.Body.String())
+	}
+
+	target = "http://example.com/near"
+	w = httptest.NewRecorder()
+	handleRequest(w, httptest.NewRequest("GET", "http://example.com/", nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "http://web.archive.org/web/20010401000000/http://example.com/near" {
+		t.Errorf("redirect nearby: got %d to %q", w.Code, w.Header().Get("Location"))
+	}
+
+	// A redirect the archive recorded at crawl time
+	target, crawlTime = "http://example.com/far", true
+	w = httptest.NewRecorder()
+	handleRequest(w, httptest.NewRequest("GET", "http://example.com/", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Redirect to another period") {
+		t.Errorf("crawl-time redirect far away: got %d\n%s", w.Code, w.Body.String())
+	}
+}
+
+func TestIsoDate(t *testing.T) {
+	for timestamp, want := range map[string]string{
+		"20010401000000": "2001-04-01",
+		"20010401":       "2001-04-01",
+		"2001":           "2001",
+		"2001x401":       "2001x401",
+	} {
+		if got := isoDate(timestamp); got != want {
+			t.Errorf("isoDate(%s) = %q, want %q", timestamp, got, want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// prioritySemaphore limits how many requests are handled at once. When all
+// slots are taken, waiting page requests are let in before waiting requests
+// for the images, scripts and stylesheets those pages embed, so a page
+// starts to render while its assets are still queued.
+type prioritySemaphore struct {
+	mu   sync.Mutex
+	free int
+	// waiting holds the channels of queued requests, pages first
+	waiting [2]*list.List
+}
+
+const (
+	priorityPage = iota
+	priorityAsset
+)
+
+func newPrioritySemaphore(slots int) *prioritySemaphore {
+	return &prioritySemaphore{free: slots, waiting: [2]*list.List{list.New(), list.New()}}
+}
+
+// acquire waits for a slot, returning false if done is closed first.
+func (s *prioritySemaphore) acquire(priority int, done <-chan struct{}) bool {
+	s.mu.Lock()
+	if s.free > 0 {
+		s.free--
+		s.mu.Unlock()
+		return true
+	}
+	granted := make(chan struct{})
+	elem := s.waiting[priority].PushBack(granted)
+	s.mu.Unlock()
+
+	select {
+	case <-granted:
+		return true
+	case <-done:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		select {
+		case <-granted:
+			// Handed a slot just as the request went away; pass it on
+			s.releaseLocked()
+		default:
+			s.waiting[priority].Remove(elem)
+		}
+		return false
+	}
+}
+
+func (s *prioritySemaphore) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releaseLocked()
+}
+
+// releaseLocked hands the slot to the first waiting request of the highest
+// priority, or frees it if nobody is waiting.
+func (s *prioritySemaphore) releaseLocked() {
+	for _, queue := range s.waiting {
+		if front := queue.Front(); front != nil {
+			queue.Remove(front)
+			close(front.Value.(chan struct{}))
+			return
+		}
+	}
+	s.free++
+}
+
+// requestPriority classifies r as a page navigation or an asset, using the
+// Sec-Fetch-Dest header modern browsers send and otherwise whether HTML is
+// asked for explicitly. Browsers that send Accept: */* for everything get
+// all their requests treated alike.
+func requestPriority(r *http.Request) int {
+	if dest := r.Header.Get("Sec-Fetch-Dest"); dest != "" {
+		switch dest {
+		case "document", "iframe", "frame":
+			return priorityPage
+		}
+		return priorityAsset
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		return priorityPage
+	}
+	return priorityAsset
+}
+
+// limitConcurrency lets at most as many requests through to next at a time
+// as sem has slots.
+func limitConcurrency(sem *prioritySemaphore, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !sem.acquire(requestPriority(r), r.Context().Done()) {
+			return
+		}
+		defer sem.release()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitForQueued waits until n requests are queued on s.
+func waitForQueued(t *testing.T, s *prioritySemaphore, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		s.mu.Lock()
+		queued := s.waiting[priorityPage].Len() + s.waiting[priorityAsset].Len()
+		s.mu.Unlock()
+		if queued == n {
+			return
+		}
+	}
+	t.Fatalf("%d requests never queued", n)
+}
+
+func TestPrioritySemaphoreAdmitsPagesFirst(t *testing.T) {
+	s := newPrioritySemaphore(1)
+	s.acquire(priorityPage, nil)
+
+	admitted := make(chan string, 3)
+	for i, priority := range []int{priorityAsset, priorityAsset, priorityPage} {
+		name := map[int]string{priorityPage: "page", priorityAsset: "asset"}[priority]
+		go func(priority int, name string) {
+			s.acquire(priority, nil)
+			admitted <- name
+		}(priority, name)
+		waitForQueued(t, s, i+1)
+	}
+
+	var order []string
+	for i := 0; i < 3; i++ {
+		s.release()
+		order = append(order, <-admitted)
+	}
+	if order[0] != "page" || order[1] != "asset" || order[2] != "asset" {
+		t.Errorf("admitted %v, want the page first", order)
+	}
+}
+
+func TestPrioritySemaphoreGivesUpWhenDone(t *testing.T) {
+	s := newPrioritySemaphore(1)
+	s.acquire(priorityPage, nil)
+
+	done := make(chan struct{})
+	result := make(chan bool)
+	go func() { result <- s.acquire(priorityAsset, done) }()
+	waitForQueued(t, s, 1)
+	close(done)
+	if <-result {
+		t.Fatal("acquired after the request went away")
+	}
+	waitForQueued(t, s, 0)
+
+	// The slot goes back to the pool, not to the request that left
+	s.release()
+	if !s.acquire(priorityAsset, nil) {
+		t.Error("released slot not free")
+	}
+}
+
+func TestRequestPriority(t *testing.T) {
+	for _, tc := range []struct {
+		dest, accept string
+		want         int
+	}{
+		{"document", "", priorityPage},
+		{"iframe", "*/*", priorityPage},
+		{"image", "text/html", priorityAsset},
+		{"", "text/html,application/xhtml+xml", priorityPage},
+		{"", "*/*", priorityAsset},
+	} {
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		r.Header.Set("Sec-Fetch-Dest", tc.dest)
+		r.Header.Set("Accept", tc.accept)
+		if got := requestPriority(r); got != tc.want {
+			t.Errorf("Sec-Fetch-Dest %q, Accept %q: priority %d, want %d", tc.dest, tc.accept, got, tc.want)
+		}
+	}
+}
+
+func TestLimitConcurrency(t *testing.T) {
+	var running, most int32
+	handler := limitConcurrency(newPrioritySemaphore(2), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/", nil))
+		}()
+	}
+	wg.Wait()
+	if most > 2 {
+		t.Errorf("%d requests ran at once, want at most 2", most)
+	}
+}
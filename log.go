@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// logLevel is the verbosity selected with -log-level. Each level includes the
+// messages of the levels before it.
+type logLevel int
+
+const (
+	levelError logLevel = iota
+	levelWarn
+	levelInfo
+	levelDebug
+)
+
+var logLevelNames = map[string]logLevel{
+	"error": levelError,
+	"warn":  levelWarn,
+	"info":  levelInfo,
+	"debug": levelDebug,
+}
+
+// currentLogLevel is set from -log-level, or -debug, at startup.
+var currentLogLevel = levelWarn
+
+// parseLogLevel parses a -log-level value.
+func parseLogLevel(name string) (logLevel, error) {
+	level, ok := logLevelNames[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level %q, must be error, warn, info or debug", name)
+	}
+	return level, nil
+}
+
+func logAt(level logLevel, prefix string, format string, v ...interface{}) {
+	if level <= currentLogLevel {
+		logOutput(prefix, format, v...)
+	}
+}
+
+// logOutput writes a message, redacted as configured, to the log.
+func logOutput(prefix string, format string, v ...interface{}) {
+	log.Print(redactLogMessage(prefix + fmt.Sprintf(format, v...)))
+}
+
+// redactedHeaderRes match "Name: value" for the headers, from
+// -redact-log-headers, whose values are redacted from log messages.
+var redactedHeaderRes []*regexp.Regexp
+
+// setRedactedHeaders parses a comma-separated list of header names for
+// -redact-log-headers.
+func setRedactedHeaders(spec string) {
+	for _, name := range strings.Split(spec, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			redactedHeaderRes = append(redactedHeaderRes, regexp.MustCompile(`(?im)(\b`+regexp.QuoteMeta(name)+`:\s*)[^\r\n]+`))
+		}
+	}
+}
+
+// logQueryRe matches the query string of an absolute or root-relative URL.
+var logQueryRe = regexp.MustCompile(`((?:://|\s/|^/)[^\s?#"']*)\?[^\s#"']+`)
+
+// redactLogMessage removes what -redact-query-logging and
+// -redact-log-headers ask to keep out of the log: the query strings of URLs,
+// which can hold tokens or what was typed into an archived form, and the
+// values of the listed headers, which are logged as "Name: value" and are
+// redacted to the end of the line. Passwords in URLs are always redacted.
+func redactLogMessage(message string) string {
+	message = userinfoRe.ReplaceAllString(message, "://[REDACTED]@")
+	if *redactQueryLogging {
+		message = logQueryRe.ReplaceAllString(message, "${1}?[REDACTED]")
+	}
+	for _, headerRe := range redactedHeaderRes {
+		message = headerRe.ReplaceAllString(message, "${1}[REDACTED]")
+	}
+	return message
+}
+
+func debugLog(format string, v ...interface{}) {
+	logAt(levelDebug, "[DEBUG] ", format, v...)
+}
+
+func infoLog(format string, v ...interface{}) {
+	logAt(levelInfo, "[INFO] ", format, v...)
+}
+
+func warnLog(format string, v ...interface{}) {
+	logAt(levelWarn, "[WARN] ", format, v...)
+}
+
+func errorLog(format string, v ...interface{}) {
+	logAt(levelError, "[ERROR] ", format, v...)
+}
+
+// requestLog logs on behalf of a single request. With -debug-sample-rate,
+// a sampled request's debug messages are logged even when -log-level is
+// lower, each tagged with the request's number so that its trace can be
+// picked out of the log. With -request-id-header, every debug message of a
+// request is tagged with its request ID instead. A nil *requestLog logs like
+// debugLog. It also carries the request's trace for -otel-endpoint.
+type requestLog struct {
+	id        uint64
+	requestID string // from -request-id-header, empty without it
+	sampled   bool
+	span      *span // the innermost phase being traced, nil without tracing
+}
+
+// requestCount numbers requests for their requestLog.
+var requestCount uint64
+
+type requestLogKey struct{}
+
+// newRequestLog starts the log of a new request, deciding whether it is
+// sampled.
+func newRequestLog() *requestLog {
+	rl := &requestLog{id: atomic.AddUint64(&requestCount, 1)}
+	rl.sampled = currentLogLevel < levelDebug && *debugSampleRate > 0 && rand.Float64() < *debugSampleRate
+	return rl
+}
+
+// withRequestLog returns r with rl attached, for requestLogFrom.
+func withRequestLog(r *http.Request, rl *requestLog) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestLogKey{}, rl))
+}
+
+// requestLogFrom returns the requestLog attached to r, or nil.
+func requestLogFrom(r *http.Request) *requestLog {
+	rl, _ := r.Context().Value(requestLogKey{}).(*requestLog)
+	return rl
+}
+
+// requestIDRe limits the request IDs accepted from clients to what is safe
+// to log and echo back.
+var requestIDRe = regexp.MustCompile(`^[A-Za-z0-9._:/+=-]{1,128}$`)
+
+// assignRequestID gives rl the request ID r carries in -request-id-header,
+// or a new random one if it carries none or an unusable one, sets it on r so
+// that it is passed upstream, and returns it.
+func assignRequestID(rl *requestLog, r *http.Request) string {
+	id := r.Header.Get(*requestIDHeader)
+	if !requestIDRe.MatchString(id) {
+		if id != "" {
+			debugLog("Replacing unusable %s %q", *requestIDHeader, id)
+		}
+		var random [8]byte
+		crand.Read(random[:])
+		id = hex.EncodeToString(random[:])
+		r.Header.Set(*requestIDHeader, id)
+	}
+	rl.requestID = id
+	return id
+}
+
+// tag returns what the request's messages are tagged with, if anything.
+func (rl *requestLog) tag() string {
+	if rl.requestID != "" {
+		return "[request " + rl.requestID + "] "
+	}
+	if rl.sampled {
+		return fmt.Sprintf("[request %d] ", rl.id)
+	}
+	return ""
+}
+
+func (rl *requestLog) debug(format string, v ...interface{}) {
+	switch {
+	case rl == nil:
+		debugLog(format, v...)
+	case rl.sampled:
+		logOutput("[DEBUG] "+rl.tag(), format, v...)
+	default:
+		logAt(levelDebug, "[DEBUG] "+rl.tag(), format, v...)
+	}
+}
+
+// logUpstreamHeaders logs the status and full header set of an upstream
+// response for -log-upstream-headers, one "Name: value" line per header,
+// whatever the -log-level. Values are redacted like any log message.
+func logUpstreamHeaders(rl *requestLog, resp *http.Response) {
+	if !*logUpstreamHeadersEnabled {
+		return
+	}
+	var lines strings.Builder
+	resp.Header.Write(&lines)
+	prefix := "[DEBUG] "
+	if rl != nil && rl.requestID != "" {
+		prefix += rl.tag()
+	} else if rl != nil {
+		prefix += fmt.Sprintf("[request %d] ", rl.id)
+	}
+	logOutput(prefix, "Upstream response %s for %s\n%s", resp.Status, resp.Request.URL, strings.TrimRight(strings.Replace(lines.String(), "\r\n", "\n", -1), "\n"))
+}
@@ -2,15 +2,21 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"html"
 	"io"
 	"log"
+	"math"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
+	"path"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
@@ -19,29 +25,194 @@ import (
 
 var (
 	port     = flag.String("port", "8080", "Port to listen on")
-	date     = flag.String("date", "", "Date in YYYYMMDD format")
-	debug    = flag.Bool("debug", false, "Enable debug logging")
+	date     = flag.String("date", "", "Date to browse, e.g. 20020401 or 2002-04-01, or relative to -date-anchor, e.g. -5y, -18m, -6w or -90d")
+	debug    = flag.Bool("debug", false, "Enable debug logging (same as -log-level=debug)")
 	maxRetries = flag.Int("max-retries", 3, "Maximum number of retries for failed requests")
 	retryDelay = flag.Duration("retry-delay", 1*time.Second, "Initial delay between retries")
+	saveOnMiss = flag.Bool("save-on-miss", false, "Ask Save Page Now to capture pages that have no archived version")
+	iaAccessKey = flag.String("ia-access-key", "", "archive.org S3-style access key")
+	iaSecretKey = flag.String("ia-secret-key", "", "archive.org S3-style secret key")
+	spnTimeout = flag.Duration("spn-timeout", 2*time.Minute, "Maximum time to wait for a Save Page Now capture")
+	spnMinInterval = flag.Duration("spn-min-interval", 20*time.Second, "Minimum time between Save Page Now requests")
+	relaxCSP = flag.Bool("relax-csp", false, "Strip Content-Security-Policy and X-Frame-Options headers from proxied responses")
+	errorPage404 = flag.String("error-page-404", "", "HTML template file served when no archived version is found")
+	errorPage502 = flag.String("error-page-502", "", "HTML template file served when the archive cannot be reached")
+	tryTrailingSlash = flag.Bool("try-trailing-slash", false, "Retry lookups with the trailing slash toggled when a URL has no archived version")
+	cdxRetries = flag.Int("cdx-retries", 2, "Number of times to retry a CDX lookup that failed with a transient error")
+	cdxRetryDelay = flag.Duration("cdx-retry-delay", 500*time.Millisecond, "Initial delay between CDX lookup retries")
+	serveStaleOnError = flag.Bool("serve-stale", false, "Serve the last good copy of a page when the archive fails")
+	staleCacheSize = flag.Int("stale-cache-size", 1000, "Number of responses kept in memory for -serve-stale")
+	contentActionsSpec = flag.String("content-actions", "", "Per-type body modifications merged over the defaults, e.g. text/css=rewrite-css")
+	listenUnix = flag.String("listen-unix", "", "Listen on this Unix domain socket instead of a TCP port")
+	listenUnixMode = flag.String("listen-unix-mode", "0660", "Permissions of the -listen-unix socket file")
+	acceptDateFormats = flag.String("accept-date-formats", "YYYYMMDD,YYYY-MM-DD,YYYY/MM/DD,MM/DD/YYYY", "Comma-separated list of formats accepted for -date")
+	harFile = flag.String("har-file", "", "Record proxied requests and responses to this HAR file, written on shutdown")
+	harBodies = flag.Bool("har-bodies", false, "Include response bodies in the -har-file recording")
+	minCaptureBytes = flag.Int64("min-capture-bytes", 0, "Treat captures smaller than this many bytes as missing and use the next one")
+	rewriteForms = flag.Bool("rewrite-forms", false, "Rewrite form actions in archived pages so submissions go back through the proxy")
+	showVersion = flag.Bool("version", false, "Print version information and exit")
+	pageCacheTTL = flag.Duration("page-cache-ttl", 0, "How long fetched archived pages are reused for identical requests (0 disables)")
+	pageCacheSize = flag.Int("page-cache-size", 500, "Number of pages kept in memory for -page-cache-ttl")
+	ftpGopherLinks = flag.String("ftp-gopher-links", "keep", "How to handle ftp:// and gopher:// links in archived pages: keep, strip or annotate")
+	negativeCacheTTL = flag.Duration("negative-cache-ttl", 0, "How long to remember that a URL has no capture (0 disables)")
+	logLevelName = flag.String("log-level", "warn", "Log verbosity: error, warn, info or debug")
+	trustContentLength = flag.Bool("trust-upstream-content-length", true, "Pass the archive's Content-Length through for unmodified responses instead of recomputing it for small bodies")
+	blockMixedContent = flag.Bool("block-mixed-content", false, "Serve clients addressing the proxy directly over HTTPS, sending the plain http:// links in archived pages through it too")
+	maxConcurrent = flag.Int("max-concurrent", 0, "Maximum number of proxied requests handled at once, pages before assets (0 is unlimited)")
+	fallbackDateStep = flag.Int("fallback-date-step", 0, "When a URL has no capture, search this many days further back at a time (0 disables)")
+	fallbackDateMax = flag.Int("fallback-date-max", 365, "How many days before -date to search with -fallback-date-step")
+	externalURL = flag.String("external-url", "", "Public base URL of the proxy, e.g. https://surf.example.com, used in the redirects it generates for clients addressing it directly")
+	pprofAddr = flag.String("pprof", "", "Serve pprof profiling endpoints on this separate address, e.g. localhost:6060")
+	warcFiles = flag.String("warc", "", "Comma-separated WARC files to serve pages from instead of the Wayback Machine")
+	normalizeWWWRedirects = flag.Bool("normalize-www-redirects", false, "Follow archive redirects between example.com and www.example.com in the proxy, with loop detection")
+	rewriteJSURLs = flag.Bool("rewrite-js-urls", false, "Rewrite same-host absolute URLs in archived JavaScript so they go back through the proxy")
+	dedupeQueryParams = flag.String("dedupe-query-params", "", "Comma-separated cache-busting query parameters to drop from asset URLs that have no exact capture")
+	dnsServer = flag.String("dns-server", "", "DNS server (host or host:port) used to resolve upstream hosts instead of the system resolver")
+	hostOverride = flag.String("host-override", "", "Comma-separated host=ip entries pinning upstream hosts to fixed addresses; private addresses need -allow-private-ips")
+	originalURLHeader = flag.Bool("output-original-url-header", false, "Add an X-Original-URL header with the original URL of the capture to archived responses")
+	captureDeltaHeader = flag.Bool("capture-delta-header", false, "Add an X-Time-Surfer-Delta header with the days between -date and the served capture")
+	passthroughDomainsSpec = flag.String("passthrough-domains", "", "Comma-separated domains fetched live instead of from the archive")
+	allowFutureDate = flag.Bool("allow-future-date", false, "Allow a -date in the future, for testing")
+	maxPageRewrites = flag.Int("max-page-rewrites", 100000, "Serve pages needing more link replacements than this unmodified (0 is unlimited)")
+	pageRewriteTimeout = flag.Duration("page-rewrite-timeout", 5*time.Second, "Serve pages whose modification takes longer than this unmodified (0 is unlimited)")
+	pathPrefixSpec = flag.String("path-prefix", "", "Sub-path the proxy is mounted under behind a front end, e.g. /time-surfer")
+	cdxMatchType = flag.String("cdx-match-type", "exact", "CDX match to fall back to when a URL has no capture of its own: exact (no fallback), prefix, host or domain")
+	preserveWaybackLinks = flag.Bool("preserve-wayback-links", false, "Keep the links in archived pages pointing at web.archive.org instead of rewriting them through the proxy; the toolbar is still removed")
+	dialTimeout = flag.Duration("dial-timeout", 30*time.Second, "Timeout for connecting to the archive and other upstream servers, 0 for none")
+	tlsHandshakeTimeout = flag.Duration("tls-handshake-timeout", 10*time.Second, "Timeout for the TLS handshake with upstream servers, 0 for none")
+	responseHeaderTimeout = flag.Duration("response-header-timeout", 0, "Timeout for an upstream server to start its response once the request is sent, 0 for none")
+	idleConnTimeout = flag.Duration("idle-conn-timeout", 90*time.Second, "How long idle upstream connections are kept open for reuse, 0 for no limit")
+	useAvailabilityFallback = flag.Bool("use-availability-fallback", false, "Resolve URLs with the Wayback availability API when the CDX API fails")
+	rewriteAbsoluteSameHost = flag.Bool("rewrite-absolute-same-host", false, "Also rewrite plain absolute links to an archived page's own host to come back through the proxy")
+	contentTypeOverrideSpec = flag.String("content-type-override", "", "Comma-separated url-pattern=type entries forcing the type of matching archived responses, * matching anything, e.g. http://www.example.com/*.txt=text/html")
+	sniffHTML = flag.Bool("sniff-html", false, "Treat archived responses labeled as binary or plain text whose body starts like an HTML page as HTML")
+	bandwidthSpec = flag.String("bandwidth", "", "Throttle each connection's responses to this many bits per second, e.g. 56k or 1.5M, to emulate period network speeds (default unlimited)")
+	debugSampleRate = flag.Float64("debug-sample-rate", 0, "Fraction of requests, from 0 to 1, whose debug messages are logged whatever the -log-level")
+	strictDate = flag.Bool("strict-date", false, "Only serve captures made on the configured day, disabling every fallback")
+	clientCacheTTL = flag.Duration("client-cache-ttl", 0, "Let browsers and intermediary caches keep successful archived responses this long, with Cache-Control, Expires and an ETag naming the capture (0 keeps the archive's headers)")
+	redactQueryLogging = flag.Bool("redact-query-logging", false, "Replace the query strings of URLs in log messages with [REDACTED]")
+	redactLogHeaders = flag.String("redact-log-headers", "", "Comma-separated header names whose values are replaced with [REDACTED] in log messages, e.g. Cookie,Authorization")
+	hostDateMap = flag.String("host-date-map", "", "Comma-separated host=date entries serving clients that address the proxy by that host name a different date than -date, e.g. 2001.proxy.lan=20010101; relative dates like -5y count back from -date-anchor, as for -date")
+	logUpstreamHeadersEnabled = flag.Bool("log-upstream-headers", false, "Log the full header set of every upstream response, whatever the -log-level")
+	prefetchAssets = flag.Bool("prefetch-assets", false, "Look up the images, scripts and stylesheets of each archived page in the background as it is served")
+	reverseRewriteEnabled = flag.Bool("reverse-rewrite", false, "Map proxy-local forms of URLs that scripts and forms send back, such as a doubled proxy prefix or an encoded URL, to the URLs they stand for")
+	maxHeaderBytes = flag.Int("max-header-bytes", http.DefaultMaxHeaderBytes, "Maximum size in bytes of the request line and headers the proxy accepts from clients (at least 4096)")
+	compressResponses = flag.Bool("compress-responses", false, "Compress the text responses the proxy modifies with Brotli or gzip, whichever the client prefers")
+	stripIntegrity = flag.Bool("strip-integrity", true, "Remove integrity and crossorigin attributes from script and link tags in rewritten pages, whose hashes the rewritten assets no longer match")
+	cdxBreakerThreshold = flag.Int("cdx-breaker-threshold", 0, "Number of consecutive failed CDX lookups after which lookups fail fast for -cdx-breaker-cooldown (0 disables)")
+	cdxBreakerCooldown = flag.Duration("cdx-breaker-cooldown", 30*time.Second, "How long CDX lookups fail fast once -cdx-breaker-threshold is reached")
+	titleDatePrefix = flag.Bool("title-date-prefix", false, "Prefix the titles of archived pages with their capture date, e.g. [2001-09-15] Original Title")
+	resolveBatch = flag.String("resolve-batch", "", "Resolve the URLs listed in this file (- for stdin), one per line, at -date, write the mapping to stdout or -out and exit")
+	resolveBatchOut = flag.String("out", "", "File -resolve-batch writes its results to, as CSV if it ends in .csv and JSON otherwise (default stdout)")
+	dropCookies = flag.Bool("drop-cookies", false, "Remove Set-Cookie headers from archived responses")
+	dropRequestCookies = flag.Bool("drop-request-cookies", false, "Remove the Cookie header from requests before they are sent to the archive")
+	dateAnchor = flag.String("date-anchor", "", "Date a relative -date such as -5y counts back from (default today)")
+	maxUpstreamRedirects = flag.Int("max-upstream-redirects", 5, "Maximum number of archive redirects followed in the proxy for one request, e.g. with -normalize-www-redirects, before giving up with 508 Loop Detected")
+	faviconSpec = flag.String("favicon", "", "Answer sites' /favicon.ico requests with this icon file, or the proxy's own icon for \"builtin\", instead of looking them up")
+	useCaptureDateHeader = flag.Bool("use-capture-date-header", false, "Send archived responses with Date and Last-Modified headers giving the capture time instead of the current time")
+	insecureSkipVerify = flag.Bool("insecure-skip-verify", false, "Do not verify the TLS certificates of the archive and other upstream servers (for mirrors with self-signed certificates; insecure)")
+	postForms = flag.String("post-forms", "keep", "What -rewrite-forms does with POST forms, which the archive cannot answer: keep, get (resubmit as GET where no password or file fields rule it out, disabling the rest) or disable")
+	captureQualityFilter = flag.Bool("capture-quality-filter", false, "Rank the first few captures on or after the date by status, size and distance from the date and use the best instead of the first")
+	redirectInterstitial = flag.Bool("redirect-interstitial", false, "Show a page with a continue link instead of following redirects to pages whose nearest capture is far from the date")
+	redirectInterstitialDays = flag.Int("redirect-interstitial-days", 365, "How many days away from the date a redirect target's capture must be for -redirect-interstitial")
+	allowRetriesHeader = flag.Bool("allow-retries-header", false, "Let clients override -max-retries for a request with an X-Time-Surfer-Max-Retries header")
+	metricsEnabled = flag.Bool("metrics", false, "Serve request and CDX lookup metrics in the Prometheus format at /metrics")
+	otelEndpoint = flag.String("otel-endpoint", "", "OpenTelemetry collector, e.g. http://localhost:4318, to send a trace of each request to over OTLP/HTTP")
+	normalizeEncodingEnabled = flag.Bool("normalize-encoding", false, "Transcode archived HTML pages declared as ISO-8859-1 or windows-1252 to UTF-8, declaring UTF-8 in their meta tags as well")
+	requestIDHeader = flag.String("request-id-header", "", "Request header, e.g. X-Request-ID, whose correlation ID tags the request's log messages and is echoed back and passed upstream; one is generated when a request has none")
+	sameSnapshotAssets = flag.Bool("same-snapshot-assets", false, "Fetch the images, scripts and stylesheets of archived pages from the page's own snapshot instead of looking each one up at the date")
+	allowPrivateIPs = flag.Bool("allow-private-ips", false, "Allow upstream connections to loopback, private and link-local addresses, such as internal hosts or cloud metadata services, which are refused by default. Needed for private -host-override addresses and HTTP_PROXY outbound proxies, which are otherwise rejected at startup")
+	embedProvenance = flag.Bool("embed-provenance", false, "Note in an HTML comment at the end of each archived page which capture it was served from")
+	readHeaderTimeout = flag.Duration("read-header-timeout", 20*time.Second, "How long a client may take to send the request line and headers, 0 for no limit")
+	readTimeout = flag.Duration("read-timeout", time.Minute, "How long a client may take to send a whole request, body included, 0 for no limit")
+	writeTimeout = flag.Duration("write-timeout", 15*time.Minute, "How long serving a response, from the end of the request headers to the last byte sent, may take, 0 for no limit, which is the default with -bandwidth")
+	idleTimeout = flag.Duration("idle-timeout", 2*time.Minute, "How long an idle keep-alive connection from a client is kept open, 0 for the -read-timeout")
+	fallbackToLive = flag.Bool("fallback-to-live", false, "Fetch URLs that have no capture from the live web instead of answering 404, logging each one")
+	fallbackToLiveDomainsSpec = flag.String("fallback-to-live-domains", "", "Comma-separated list of domains, with their subdomains, -fallback-to-live is limited to (default: all)")
+	adminToken = flag.String("admin-token", "", "Serve the effective configuration, secrets masked, at /admin/config to requests with an Authorization: Bearer header carrying this token (default: not served)")
+	rewriteAnchorBase = flag.Bool("rewrite-anchor-base", false, "Point the <base> element of archived pages that names the page's own directory at the page itself, so fragment-only links such as href=\"#top\" scroll instead of loading the base URL")
+	recordSession = flag.String("record-session", "", "Save every response to proxied GET requests in this directory, for -replay-session")
+	replaySession = flag.String("replay-session", "", "Serve proxied requests only from the responses recorded in this directory with -record-session, without contacting the archive or any other server")
 )
 
-func debugLog(format string, v ...interface{}) {
-	if *debug {
-		log.Printf("[DEBUG] "+format, v...)
-	}
-}
+// envPrefix is prepended to a flag's upper-cased name (dashes become
+// underscores) to form the environment variable consulted when that flag is
+// not given on the command line, e.g. TIME_SURFER_DATE for -date.
+const envPrefix = "TIME_SURFER_"
+
+// applyEnvDefaults fills in every flag that was not set on the command line
+// from its TIME_SURFER_* environment variable, if present. Flags given on the
+// command line always take precedence.
+func applyEnvDefaults() error {
+	setOnCommandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
 
-func errorLog(format string, v ...interface{}) {
-	log.Printf("[ERROR] "+format, v...)
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || setOnCommandLine[f.Name] {
+			return
+		}
+		name := envPrefix + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		if setErr := flag.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %v", value, name, setErr)
+		}
+	})
+	return err
 }
 
-func removeWaybackToolbar(html string) string {
+const (
+	toolbarBeginMarker = "<!-- BEGIN WAYBACK TOOLBAR INSERT -->"
+	toolbarEndMarker   = "<!-- END WAYBACK TOOLBAR INSERT -->"
+)
+
+var (
+	// toolbarElementRe matches the opening tag of the toolbar's container,
+	// which some capture years carry without the comment markers around it.
+	toolbarElementRe = regexp.MustCompile(`(?i)<div\b[^>]*\bid\s*=\s*["']?wm-ipp(?:-base)?["'\s/>]`)
+	// toolbarStyleRe matches style blocks and stylesheets that only exist to
+	// lay out the toolbar.
+	toolbarStyleRe = regexp.MustCompile(`(?is)<style\b[^>]*>[^<]*?[#.]wm-ipp[^<]*</style>|<link\b[^>]*/_static/css/(?:banner-styles|iconochive)\.css[^>]*>`)
+	divTagRe       = regexp.MustCompile(`(?i)<(/?)div\b[^>]*>`)
+)
+
+// toolbarSafeBeforeYear is the year the Wayback Machine opened to the
+// public. A page captured before then cannot contain toolbar markup of its
+// own, so every removal pattern is safe on it. Later captures may, such as
+// a page that quotes an archived page, so on those the unmarked toolbar
+// element and styles are only removed where the archive inserts them.
+const toolbarSafeBeforeYear = 2001
+
+// bodyTagRe matches a page's opening body tag, after which the archive
+// inserts the toolbar.
+var bodyTagRe = regexp.MustCompile(`(?i)<body\b[^>]*>`)
+
+// removeWaybackToolbar removes the toolbar from a page captured at
+// timestamp, choosing how aggressively by the capture's year. An unknown
+// timestamp is treated as an early capture.
+func removeWaybackToolbar(html string, timestamp string) string {
 	// Remove the Wayback toolbar
-	start := strings.Index(html, "<!-- BEGIN WAYBACK TOOLBAR INSERT -->")
-	end := strings.Index(html, "<!-- END WAYBACK TOOLBAR INSERT -->")
+	start := strings.Index(html, toolbarBeginMarker)
+	end := strings.Index(html, toolbarEndMarker)
+	
+	if start != -1 && end > start {
+		html = html[:start] + html[end+len(toolbarEndMarker):]
+	}
 	
-	if start != -1 && end != -1 {
-		html = html[:start] + html[end+36:] // 36 is length of end comment
+	// Remove the toolbar element and its styles even without the markers
+	if year, ok := captureYear(timestamp); !ok || year < toolbarSafeBeforeYear {
+		if loc := toolbarElementRe.FindStringIndex(html); loc != nil {
+			html = removeDivAt(html, loc[0])
+		}
+		html = toolbarStyleRe.ReplaceAllString(html, "")
+	} else {
+		html = removeInsertedToolbarElement(html)
+		html = removeHeadToolbarStyles(html)
 	}
 	
 	// Remove the tracking javascript
@@ -51,60 +222,663 @@ func removeWaybackToolbar(html string) string {
 	return html
 }
 
-func getWaybackURL(originalURL string, date string) (string, error) {
+// removeInsertedToolbarElement removes the toolbar's container div only
+// if it is the first thing in the body, where the archive puts it.
+func removeInsertedToolbarElement(html string) string {
+	body := bodyTagRe.FindStringIndex(html)
+	if body == nil {
+		return html
+	}
+	start := body[1] + len(html[body[1]:]) - len(strings.TrimLeft(html[body[1]:], " \t\r\n"))
+	if loc := toolbarElementRe.FindStringIndex(html[start:]); loc != nil && loc[0] == 0 {
+		return removeDivAt(html, start)
+	}
+	return html
+}
+
+// removeHeadToolbarStyles removes toolbar styles from the page's head, where
+// the archive puts them, leaving the body alone.
+func removeHeadToolbarStyles(html string) string {
+	end := strings.Index(strings.ToLower(html), "</head>")
+	if end == -1 {
+		return html
+	}
+	return toolbarStyleRe.ReplaceAllString(html[:end], "") + html[end:]
+}
+
+// removeDivAt removes the div starting at start, including any divs nested
+// inside it.
+func removeDivAt(html string, start int) string {
+	depth := 0
+	for _, tag := range divTagRe.FindAllStringSubmatchIndex(html[start:], -1) {
+		if tag[3] > tag[2] {
+			depth--
+		} else {
+			depth++
+		}
+		if depth == 0 {
+			return html[:start] + html[start+tag[1]:]
+		}
+	}
+	
+	// Unterminated element, leave the page alone rather than truncate it
+	return html
+}
+
+// ErrNoCapture is returned when the archive has no capture of a URL.
+var ErrNoCapture = errors.New("no archived version found")
+
+// ErrBadCDXResponse is returned when the CDX API answers with something the
+// proxy can't read as a CDX response.
+var ErrBadCDXResponse = errors.New("invalid CDX response")
+
+// resolveError is a failure to resolve a URL of one of the kinds callers
+// tell apart, ErrCDXUnavailable or ErrBadCDXResponse, with the error that
+// caused it. errors.Is matches it against its kind as well as its cause.
+type resolveError struct {
+	kind error
+	err  error
+}
+
+func (e *resolveError) Error() string {
+	return e.kind.Error() + ": " + e.err.Error()
+}
+
+func (e *resolveError) Unwrap() error {
+	return e.err
+}
+
+func (e *resolveError) Is(target error) bool {
+	return target == e.kind
+}
+
+// cdxCandidateLimit is how many captures are requested from the CDX API when
+// some of them may be rejected.
+const cdxCandidateLimit = 10
+
+// cdxCapture is one row of a CDX API response.
+type cdxCapture struct {
+	Timestamp string
+	Original  string
+	Length    int64 // archived record size in bytes, -1 if unknown
+	Status    string // HTTP status of the capture, empty if unknown
+}
+
+// cdxFields are the CDX fields the proxy asks for, by name, so that it does
+// not rely on the API's default set.
+const cdxFields = "timestamp,original,length,statuscode"
+
+// cdxAPIURL is the Wayback Machine's CDX API. It is reached over HTTPS, since
+// lookups carry the -ia-secret-key when one is given.
+var cdxAPIURL = "https://web.archive.org/cdx/search/cdx"
+
+// cdxColumns maps the CDX fields the proxy uses to their position in a row.
+type cdxColumns map[string]int
+
+// parseCDXHeader reads the column names from the first row of a JSON CDX
+// API response.
+func parseCDXHeader(header []interface{}) (cdxColumns, error) {
+	columns := cdxColumns{"timestamp": -1, "original": -1, "length": -1, "statuscode": -1}
+	for i, name := range header {
+		if name, ok := name.(string); ok {
+			if _, wanted := columns[name]; wanted {
+				columns[name] = i
+			}
+		}
+	}
+	if columns["timestamp"] == -1 {
+		return nil, fmt.Errorf("no timestamp column in %v", header)
+	}
+	return columns, nil
+}
+
+func (columns cdxColumns) field(row []interface{}, column string) string {
+	i := columns[column]
+	if i == -1 || i >= len(row) {
+		return ""
+	}
+	value, _ := row[i].(string)
+	return value
+}
+
+// capture converts one row of a CDX API response.
+func (columns cdxColumns) capture(row []interface{}) (cdxCapture, error) {
+	capture := cdxCapture{
+		Timestamp: columns.field(row, "timestamp"),
+		Original:  columns.field(row, "original"),
+		Length:    -1,
+		Status:    columns.field(row, "statuscode"),
+	}
+	if capture.Timestamp == "" {
+		return cdxCapture{}, fmt.Errorf("row without a timestamp")
+	}
+	if length, err := strconv.ParseInt(columns.field(row, "length"), 10, 64); err == nil {
+		capture.Length = length
+	}
+	return capture, nil
+}
+
+// decodeCDX reads a JSON CDX API response, whose first row names the
+// columns, and passes each capture to visit as soon as its row is decoded.
+// It stops reading when visit returns false, so the rest of a long response
+// to a lookup that has found what it needs isn't decoded, or even
+// downloaded. A response it can't read fails with ErrBadCDXResponse.
+func decodeCDX(body io.Reader, visit func(cdxCapture) bool) error {
+	if err := decodeCDXRows(body, visit); err != nil {
+		return &resolveError{kind: ErrBadCDXResponse, err: err}
+	}
+	return nil
+}
+
+func decodeCDXRows(body io.Reader, visit func(cdxCapture) bool) error {
+	decoder := json.NewDecoder(body)
+	if token, err := decoder.Token(); err != nil {
+		return err
+	} else if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("expected a JSON array")
+	}
+	if !decoder.More() {
+		return nil
+	}
+	
+	var header []interface{}
+	if err := decoder.Decode(&header); err != nil {
+		return fmt.Errorf("unreadable header row: %v", err)
+	}
+	columns, err := parseCDXHeader(header)
+	if err != nil {
+		return err
+	}
+	
+	for decoder.More() {
+		var row []interface{}
+		if err := decoder.Decode(&row); err != nil {
+			return fmt.Errorf("unreadable row: %v", err)
+		}
+		capture, err := columns.capture(row)
+		if err != nil {
+			return err
+		}
+		if !visit(capture) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// CDX match types accepted by -cdx-match-type. With anything but exact,
+// a URL without captures of its own is resolved to a capture under the
+// broader match: another page with the URL as prefix, on the same host, or
+// anywhere in the domain.
+const (
+	cdxMatchExact  = "exact"
+	cdxMatchPrefix = "prefix"
+	cdxMatchHost   = "host"
+	cdxMatchDomain = "domain"
+)
+
+// getWaybackURL resolves originalURL to the Wayback URL of its capture for
+// date, recording the lookup in metrics.
+func getWaybackURL(rl *requestLog, originalURL string, date string) (string, error) {
+	start := time.Now()
+	lookup := rl.startSpan("cdx.lookup", spanKindClient)
+	waybackURL, err := findWaybackURL(rl, originalURL, date)
+	
+	result := "found"
+	if errors.Is(err, ErrNoCapture) {
+		result = "not_found"
+	} else if err != nil {
+		result = "error"
+		lookup.fail(err)
+	}
+	metrics.IncCounter(metricLookups, map[string]string{"result": result})
+	metrics.ObserveHistogram(metricLookupDuration, time.Since(start).Seconds(), nil)
+	
+	lookup.setAttr("url.full", originalURL)
+	lookup.setAttr("timesurfer.date", date)
+	lookup.setAttr("timesurfer.result", result)
+	if ref, ok := parseWaybackURL(waybackURL); ok {
+		lookup.setAttr("timesurfer.timestamp", ref.Timestamp)
+	}
+	lookup.end()
+	return waybackURL, err
+}
+
+func findWaybackURL(rl *requestLog, originalURL string, date string) (string, error) {
+	// Compare and build Wayback URLs from the form the archive is asked for
+	originalURL = normalizeLookupURL(originalURL)
+	
 	// Call the CDX API to get the archived URL
-	cdxURL := fmt.Sprintf("http://web.archive.org/cdx/search/cdx?url=%s&from=%s&filter=statuscode:200&filter=mimetype:text/html&limit=1&output=json", 
-		url.QueryEscape(originalURL), date)
+	// Look at a few candidates when small captures may have to be skipped,
+	// or all of them are ranked
+	limit := 1
+	if *minCaptureBytes > 0 || *captureQualityFilter {
+		limit = cdxCandidateLimit
+	}
+	statuses := cdxStatusOK
+	if *captureQualityFilter {
+		statuses = cdxStatusOKRedirect
+	}
+	var capture *cdxCapture
+	var candidates []cdxCapture
+	err := queryCDX(rl, originalURL, date, cdxMatchExact, statuses, limit, func(candidate cdxCapture) bool {
+		if !usableCapture(rl, candidate, originalURL) {
+			return true
+		}
+		if *captureQualityFilter {
+			candidates = append(candidates, candidate)
+			return true
+		}
+		capture = &candidate
+		return false
+	})
+	if err != nil {
+		if !*useAvailabilityFallback {
+			return "", err
+		}
+		warnLog("CDX lookup of %s failed: %v, trying the availability API", originalURL, err)
+		return availableWaybackURL(rl, originalURL, date)
+	}
+	if *captureQualityFilter {
+		capture = bestCapture(rl, candidates, date)
+	}
+	archived := originalURL
+	
+	// Fall back to the broader match, if one was asked for. The API lists
+	// its captures by URL rather than by length, so all of them have to be
+	// compared.
+	if capture == nil && *cdxMatchType != cdxMatchExact {
+		err := queryCDX(rl, originalURL, date, *cdxMatchType, cdxStatusOK, cdxCandidateLimit, func(candidate cdxCapture) bool {
+			if betterBroadCapture(rl, candidate, capture, originalURL) {
+				capture = &candidate
+			}
+			return true
+		})
+		if err != nil {
+			return "", err
+		}
+		if capture != nil {
+			archived = capture.Original
+			rl.debug("No capture of %s, using %s from %s match", originalURL, capture.Original, *cdxMatchType)
+		}
+	}
+	
+	// Check if we have results
+	if capture == nil {
+		return "", fmt.Errorf("%w for %s", ErrNoCapture, originalURL)
+	}
 	
-	debugLog("Calling CDX API: %s", cdxURL)
+	// Construct the Wayback URL from the URL the archive actually captured,
+	// which can differ from the requested one in scheme, port or trailing
+	// slash, so that it names an existing capture
+	if capture.Original != "" && capture.Original != archived {
+		rl.debug("CDX matched %s as %s", archived, capture.Original)
+		archived = capture.Original
+	}
+	waybackURL := formatWaybackURL(capture.Timestamp, archived)
+	rl.debug("Wayback URL: %s", waybackURL)
 	
-	// Use a dedicated client for CDX API calls with default transport
-	client := &http.Client{
+	return waybackURL, nil
+}
+
+// latestWaybackURL returns the Wayback URL of the latest capture of
+// originalURL within window, as findWaybackURL does for the earliest from a
+// date, skipping captures -min-capture-bytes rules out.
+func latestWaybackURL(rl *requestLog, originalURL string, window dateWindow) (string, error) {
+	originalURL = normalizeLookupURL(originalURL)
+	limit := 1
+	if *minCaptureBytes > 0 {
+		limit = cdxCandidateLimit
+	}
+	
+	// A negative limit asks for the last captures in the window
+	var capture *cdxCapture
+	err := queryCDXWindow(rl, originalURL, window, cdxMatchExact, cdxStatusOK, -limit, func(candidate cdxCapture) bool {
+		if usableCapture(rl, candidate, originalURL) && (capture == nil || candidate.Timestamp > capture.Timestamp) {
+			capture = &candidate
+		}
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+	if capture == nil {
+		return "", fmt.Errorf("%w for %s", ErrNoCapture, originalURL)
+	}
+	archived := originalURL
+	if capture.Original != "" {
+		archived = capture.Original
+	}
+	return formatWaybackURL(capture.Timestamp, archived), nil
+}
+
+// queryCDX asks the CDX API for up to limit captures matching originalURL
+// under matchType, from date onwards, whose status matches statuses,
+// passing them to visit as decodeCDX does. Only HTML captures count unless
+// originalURL is an asset, which is archived under its own MIME type.
+func queryCDX(rl *requestLog, originalURL string, date string, matchType string, statuses string, limit int, visit func(cdxCapture) bool) error {
+	window := dateWindow{from: date}
+	if *strictDate {
+		window.to = date + "235959"
+	}
+	return queryCDXWindow(rl, originalURL, window, matchType, statuses, limit, visit)
+}
+
+// queryCDXWindow is queryCDX for the captures within window, which is open
+// ended if window.to is empty. A negative limit asks for the last captures
+// in it rather than the first.
+func queryCDXWindow(rl *requestLog, originalURL string, window dateWindow, matchType string, statuses string, limit int, visit func(cdxCapture) bool) error {
+	cdxURL := fmt.Sprintf("%s?url=%s&from=%s&filter=statuscode:%s&limit=%d&output=json&fl=%s", 
+		cdxAPIURL, cdxURLParam(originalURL), window.from, statuses, limit, cdxFields)
+	if !isAssetURL(originalURL) {
+		cdxURL += "&filter=mimetype:text/html"
+	}
+	if matchType != cdxMatchExact {
+		cdxURL += "&matchType=" + matchType
+	}
+	if window.to != "" {
+		cdxURL += "&to=" + window.to
+	}
+	
+	rl.debug("Calling CDX API: %s", cdxURL)
+	
+	resp, err := fetchCDX(newCDXClient(), cdxURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	
+	return decodeCDX(resp.Body, visit)
+}
+
+// usableCapture reports whether capture isn't a suspiciously small stub.
+func usableCapture(rl *requestLog, capture cdxCapture, originalURL string) bool {
+	if capture.Length >= 0 && capture.Length < *minCaptureBytes {
+		rl.debug("Skipping %d byte capture %s of %s", capture.Length, capture.Timestamp, originalURL)
+		return false
+	}
+	return true
+}
+
+// betterBroadCapture reports whether candidate, from a broader match, is
+// nearer what was asked for than best: it has a shorter URL, which is the
+// closest to the top of the prefix, host or domain, or the same length and
+// an earlier capture.
+func betterBroadCapture(rl *requestLog, candidate cdxCapture, best *cdxCapture, originalURL string) bool {
+	if candidate.Original == "" || !usableCapture(rl, candidate, originalURL) {
+		return false
+	}
+	return best == nil || len(candidate.Original) < len(best.Original) ||
+		(len(candidate.Original) == len(best.Original) && candidate.Timestamp < best.Timestamp)
+}
+
+// newCDXClient returns a dedicated client for CDX API calls with default
+// transport settings, apart from the timeouts configured for upstream
+// connections.
+func newCDXClient() *http.Client {
+	return &http.Client{
 		Timeout: 90 * time.Second,
 		Transport: &http.Transport{
-			DialContext: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).DialContext,
+			DialContext:           dialUpstream,
+			TLSHandshakeTimeout:   upstreamTransport.TLSHandshakeTimeout,
+			ResponseHeaderTimeout: upstreamTransport.ResponseHeaderTimeout,
+			IdleConnTimeout:       upstreamTransport.IdleConnTimeout,
+			TLSClientConfig:       upstreamTransport.TLSClientConfig,
 		},
 	}
-	resp, err := client.Get(cdxURL)
+}
+
+// fetchCDX performs a CDX API request, retrying transient failures (timeouts,
+// 429 and 5xx responses) up to -cdx-retries times with exponential backoff
+// and jitter. Only a 200 response is returned; every failure is an
+// ErrCDXUnavailable. While the circuit breaker is open it fails at once.
+func fetchCDX(client *http.Client, cdxURL string) (*http.Response, error) {
+	if err := cdxBreaker.allow(); err != nil {
+		return nil, err
+	}
+	resp, err := fetchCDXWithRetries(client, cdxURL)
+	// A 4xx answer is about the request, such as a robots-excluded URL, and
+	// shows the API is up
+	if cdxOutage(err) {
+		cdxBreaker.record(err)
+	} else {
+		cdxBreaker.record(nil)
+	}
 	if err != nil {
-		return "", err
+		return nil, &resolveError{kind: ErrCDXUnavailable, err: err}
 	}
-	defer resp.Body.Close()
+	return resp, nil
+}
+
+func fetchCDXWithRetries(client *http.Client, cdxURL string) (*http.Response, error) {
+	delay := *cdxRetryDelay
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest("GET", cdxURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		setArchiveAuthorization(req)
+		
+		resp, err := client.Do(req)
+		if err == nil && resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+		
+		var retryable bool
+		if err != nil {
+			var netErr net.Error
+			retryable = errors.As(err, &netErr) && netErr.Timeout()
+		} else {
+			resp.Body.Close()
+			retryable = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+			err = &cdxStatusError{status: resp.StatusCode}
+		}
+		
+		if !retryable || attempt >= *cdxRetries {
+			return nil, err
+		}
+		
+		wait := delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+		warnLog("CDX request attempt %d failed: %v, retrying in %v", attempt+1, err, wait)
+		time.Sleep(wait)
+		delay *= 2
+	}
+}
+
+// cdxStatusError is a CDX API answer other than 200 OK.
+type cdxStatusError struct {
+	status int
+}
+
+func (e *cdxStatusError) Error() string {
+	return fmt.Sprintf("CDX API returned status %d", e.status)
+}
+
+// cdxOutage reports whether a failed CDX request, err, is a sign of the API
+// failing, which the circuit breaker counts: it could not be reached, timed
+// out, or answered 429 or 5xx. Other 4xx answers, such as the 403 for a
+// site excluded from the archive, only concern the URL asked for.
+func cdxOutage(err error) bool {
+	var statusErr *cdxStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.status == http.StatusTooManyRequests || statusErr.status >= 500
+	}
+	return err != nil
+}
+
+// setArchiveAuthorization authenticates req with the archive.org S3-style
+// keys given with -ia-access-key and -ia-secret-key, if there are any.
+// Authenticated clients get higher rate limits from the archive's APIs. The
+// keys are only ever sent over HTTPS, where nobody on the way can read them.
+func setArchiveAuthorization(req *http.Request) {
+	if *iaAccessKey != "" && *iaSecretKey != "" && req.URL.Scheme == "https" {
+		req.Header.Set("Authorization", fmt.Sprintf("LOW %s:%s", *iaAccessKey, *iaSecretKey))
+	}
+}
+
+// resolveWaybackURL resolves originalURL with getWaybackURL and, when the
+// archive has no capture of it as requested, tries it with double escaping
+// undone and the alternative forms enabled by flags before giving up.
+func resolveWaybackURL(rl *requestLog, originalURL string, date string) (string, error) {
+	return lookupWaybackURL(rl, originalURL, date, *saveOnMiss)
+}
+
+// lookupWaybackURL is resolveWaybackURL, falling back to Save Page Now only
+// if allowSave is set.
+func lookupWaybackURL(rl *requestLog, originalURL string, date string, allowSave bool) (string, error) {
+	resolve := rl.startSpan("resolve", spanKindInternal)
+	defer resolve.end()
+	resolve.setAttr("url.full", originalURL)
+	
+	// URLs that recently had no capture fail fast without another lookup
+	missKey := cacheKey(originalURL, date)
+	if negativeCache != nil {
+		if err, ok := negativeCache.get(missKey); ok {
+			rl.debug("Negative cache hit for %s", originalURL)
+			resolve.setAttr("timesurfer.cache", "negative_hit")
+			return "", err
+		}
+	}
+	if prefetched != nil {
+		if waybackURL, ok := prefetched.get(missKey); ok {
+			rl.debug("Using prefetched lookup of %s", originalURL)
+			resolve.setAttr("timesurfer.cache", "prefetched_hit")
+			return waybackURL, nil
+		}
+	}
+	resolve.setAttr("timesurfer.cache", "miss")
 	
-	// Check status code
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("CDX API returned status %d", resp.StatusCode)
+	candidates := []string{originalURL}
+	if undone, ok := undoDoubleEscaping(originalURL); ok {
+		candidates = append(candidates, undone)
+	}
+	if *tryTrailingSlash {
+		if toggled, ok := toggleTrailingSlash(originalURL); ok {
+			candidates = append(candidates, toggled)
+		}
 	}
 	
-	var cdxResp []interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&cdxResp); err != nil {
-		return "", err
+	if *dedupeQueryParams != "" && isAssetURL(originalURL) {
+		if stripped, ok := stripQueryParams(originalURL, strings.Split(*dedupeQueryParams, ",")); ok {
+			candidates = append(candidates, stripped)
+		}
 	}
 	
-	// Check if we have results
-	if len(cdxResp) < 2 {
-		return "", fmt.Errorf("no archived version found for %s", originalURL)
+	for _, candidate := range candidates {
+		waybackURL, err := getWaybackURL(rl, candidate, date)
+		if err == nil {
+			return waybackURL, nil
+		}
+		if !errors.Is(err, ErrNoCapture) {
+			return "", err
+		}
+		rl.debug("No capture found for %s", candidate)
+	}
+	
+	// Look further back in time, one step at a time, for the latest capture
+	// before the configured date
+	for _, window := range fallbackWindows(date, *fallbackDateStep, *fallbackDateMax) {
+		waybackURL, err := latestWaybackURL(rl, originalURL, window)
+		if err == nil {
+			rl.debug("Found capture of %s from %s to %s", originalURL, window.from, window.to)
+			return waybackURL, nil
+		}
+		if !errors.Is(err, ErrNoCapture) {
+			return "", err
+		}
 	}
 	
-	// Extract timestamp from the second row (first row is headers)
-	row, ok := cdxResp[1].([]interface{})
-	if !ok || len(row) < 2 {
-		return "", fmt.Errorf("invalid CDX response format")
+	if allowSave {
+		waybackURL, err := savePageNow(originalURL)
+		if err == nil {
+			return waybackURL, nil
+		}
+		warnLog("Save Page Now failed for %s: %v", originalURL, err)
 	}
 	
-	timestamp, ok := row[1].(string)
-	if !ok {
-		return "", fmt.Errorf("invalid timestamp in CDX response")
+	err := fmt.Errorf("%w for %s", ErrNoCapture, originalURL)
+	if len(candidates) > 1 {
+		err = fmt.Errorf("%w for %s (tried %s)", ErrNoCapture, originalURL, strings.Join(candidates, ", "))
+	}
+	if negativeCache != nil {
+		negativeCache.put(missKey, err)
+	}
+	return "", err
+}
+
+// assetExtensions are the file extensions of the images, scripts,
+// stylesheets and plugin content pages embed.
+var assetExtensions = map[string]bool{
+	".js": true, ".css": true, ".gif": true, ".jpg": true, ".jpeg": true, ".png": true,
+	".bmp": true, ".ico": true, ".swf": true, ".class": true, ".jar": true, ".wav": true,
+	".mid": true, ".midi": true, ".mp3": true, ".svg": true, ".woff": true, ".ttf": true,
+}
+
+// isAssetURL reports whether rawURL looks like an embedded resource rather
+// than a page, judging by its file extension.
+func isAssetURL(rawURL string) bool {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	return assetExtensions[strings.ToLower(path.Ext(parsedURL.Path))]
+}
+
+// stripQueryParams returns rawURL without the named query parameters, which
+// are matched case-insensitively. It reports false if there were none.
+func stripQueryParams(rawURL string, names []string) (string, bool) {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil || parsedURL.RawQuery == "" {
+		return "", false
 	}
 	
-	// Construct the Wayback URL
-	waybackURL := fmt.Sprintf("http://web.archive.org/web/%s/%s", timestamp, originalURL)
-	debugLog("Wayback URL: %s", waybackURL)
+	strip := make(map[string]bool)
+	for _, name := range names {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			strip[name] = true
+		}
+	}
 	
-	return waybackURL, nil
+	// Keep the remaining parameters in their original order and encoding
+	var kept []string
+	for _, pair := range strings.Split(parsedURL.RawQuery, "&") {
+		name := pair
+		if eq := strings.Index(pair, "="); eq >= 0 {
+			name = pair[:eq]
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if !strip[strings.ToLower(name)] {
+			kept = append(kept, pair)
+		}
+	}
+	
+	query := strings.Join(kept, "&")
+	if query == parsedURL.RawQuery {
+		return "", false
+	}
+	parsedURL.RawQuery = query
+	parsedURL.ForceQuery = false
+	return parsedURL.String(), true
+}
+
+// toggleTrailingSlash returns rawURL with a trailing slash added to or removed
+// from its path. The site root has no alternative form.
+func toggleTrailingSlash(rawURL string) (string, bool) {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil || parsedURL.Path == "" || parsedURL.Path == "/" {
+		return "", false
+	}
+	
+	if strings.HasSuffix(parsedURL.Path, "/") {
+		parsedURL.Path = strings.TrimSuffix(parsedURL.Path, "/")
+	} else {
+		parsedURL.Path += "/"
+	}
+	parsedURL.RawPath = ""
+	
+	return parsedURL.String(), true
 }
 
 func extractRedirectURL(redirectURL string) string {
@@ -129,10 +903,11 @@ func extractRedirectURL(redirectURL string) string {
 			if strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://") {
 				return value
 			}
-			// If it's a relative path, construct full URL
-			if strings.HasPrefix(value, "/") {
-				baseURL := fmt.Sprintf("%s://%s", parsedURL.Scheme, parsedURL.Host)
-				return baseURL + value
+			// If it's a relative path, resolve it against the URL it came from
+			if strings.HasPrefix(value, "/") && !strings.HasPrefix(value, "//") {
+				if ref, err := url.Parse(value); err == nil && parsedURL.Host != "" {
+					return parsedURL.ResolveReference(ref).String()
+				}
 			}
 		}
 	}
@@ -141,25 +916,73 @@ func extractRedirectURL(redirectURL string) string {
 	return redirectURL
 }
 
+// securityHeadersRelaxedByFlag are the captured headers -relax-csp removes.
+// They were written for the original site and, once the proxy has rewritten
+// the page, commonly block its inline content or framing.
+var securityHeadersRelaxedByFlag = []string{
+	"Content-Security-Policy",
+	"Content-Security-Policy-Report-Only",
+	"X-Content-Security-Policy",
+	"X-WebKit-CSP",
+	"X-Frame-Options",
+}
+
+// copyHeaders copies response headers destined for the client, leaving out
+// the ones -relax-csp and -drop-cookies remove.
+func copyHeaders(dst http.Header, src http.Header) {
+	for k, v := range src {
+		dst[k] = v
+	}
+	if *relaxCSP {
+		for _, header := range securityHeadersRelaxedByFlag {
+			dst.Del(header)
+		}
+	}
+	// Captured cookies are stale, and on a shared proxy a cached response
+	// would hand one visitor's cookies to the next
+	if *dropCookies {
+		dst.Del("Set-Cookie")
+	}
+}
+
+// copyResponse writes a recorded proxy response to the client.
+func copyResponse(w http.ResponseWriter, recorder *httptest.ResponseRecorder) {
+	copyHeaders(w.Header(), recorder.Header())
+	w.WriteHeader(recorder.Code)
+	io.Copy(w, recorder.Body)
+}
+
 func handleRequest(w http.ResponseWriter, r *http.Request) {
-	// Check if this is a geocities.restorativland.org request
-	isGeocitiesRequest := strings.Contains(r.Host, "geocities.restorativland.org") || r.Host == "geocities.restorativland.org"
+	rl := newRequestLog()
+	r = withRequestLog(r, rl)
+	reqDate := requestDate(r)
 	
-	if isGeocitiesRequest {
-		// Handle geocities.restorativland.org requests directly
-		// Construct the target URL for geocities.restorativland.org (use HTTPS)
-		targetURL, err := url.Parse("https://geocities.restorativland.org")
-		if err != nil {
-			http.Error(w, "Error parsing geocities.restorativland.org URL", 500)
-			errorLog("Error parsing geocities.restorativland.org URL: %v", err)
-			return
-		}
-		
-		debugLog("Handling geocities request - Host: %s, Path: %s, Query: %s", r.Host, r.URL.Path, r.URL.RawQuery)
-		debugLog("Target base URL: %s", targetURL.String())
+	// Record the request once it has been served, by where it went
+	upstream := "archive"
+	trace := startRequestSpan(rl, r)
+	if *requestIDHeader != "" {
+		id := assignRequestID(rl, r)
+		w.Header().Set(*requestIDHeader, id)
+		trace.setAttr("timesurfer.request_id", id)
+	}
+	defer func(start time.Time) {
+		labels := map[string]string{"upstream": upstream}
+		metrics.IncCounter(metricRequests, labels)
+		metrics.ObserveHistogram(metricRequestDuration, time.Since(start).Seconds(), labels)
+		trace.setAttr("timesurfer.upstream", upstream)
+		trace.end()
+	}(time.Now())
+	
+	// Check if this is a geocities.restorativland.org request
+	if targetURL, isGeocitiesRequest := directTarget(r.Host); isGeocitiesRequest {
+		upstream = "direct"
+		// Handle geocities.restorativland.org requests directly, over HTTPS
+		rl.debug("Handling geocities request - Host: %s, URI: %s", r.Host, r.URL.RequestURI())
+		rl.debug("Target base URL: %s", targetURL.String())
 		
 		// Create a reverse proxy
 	proxy := httputil.NewSingleHostReverseProxy(targetURL)
+	proxy.Transport = upstreamTransport
 	
 	// Modify the request to match the target
 	proxy.Director = func(req *http.Request) {
@@ -174,48 +997,53 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 		}
 		req.URL.RawQuery = r.URL.RawQuery
 		
-		// Set the Host header
+		// Send the Host the client addressed, which directTarget kept in
+		// targetURL, so the mirror serves the right virtual host
 		req.Host = targetURL.Host
 		
 		// Remove headers that might interfere
 		req.Header.Del("Proxy-Connection")
 		req.Header.Del("Proxy-Authorization")
-		
-		debugLog("Proxying to: %s://%s%s", req.URL.Scheme, req.URL.Host, req.URL.Path)
-		if req.URL.RawQuery != "" {
-			debugLog("With query: %s", req.URL.RawQuery)
+		req.Header.Del(maxRetriesHeader)
+		if *dropRequestCookies {
+			req.Header.Del("Cookie")
 		}
+		
+		rl.debug("Proxying to: %s", req.URL)
 	}
 	
 	// Handle response modification to rewrite redirect URLs and modify HTML content
 	proxy.ModifyResponse = func(resp *http.Response) error {
+		logUpstreamHeaders(rl, resp)
+		rl.span.setAttr("http.response.status_code", resp.StatusCode)
+		
 		// Check if it's a redirect response
 		if resp.StatusCode >= 300 && resp.StatusCode < 400 {
 			// Check if there's a Location header
 			if location := resp.Header.Get("Location"); location != "" {
-				debugLog("Original redirect location: %s", location)
+				rl.debug("Original redirect location: %s", location)
 				
 				// Parse the location URL
 			locationURL, err := url.Parse(location)
 			if err != nil {
-					debugLog("Error parsing redirect location: %v", err)
+					rl.debug("Error parsing redirect location: %v", err)
 					return nil // Continue with original response
 				}
 				
 				// If it's redirecting to the same domain, ensure it goes through our proxy
-				if locationURL.Host == "geocities.restorativland.org" {
+				if _, sameMirror := directTarget(locationURL.Host); sameMirror {
 					// Keep the same scheme (HTTPS) but ensure it goes through our proxy
 					// We don't need to rewrite it since we're already using HTTPS
-					debugLog("Redirect staying within geocities.restorativland.org domain")
+					rl.debug("Redirect staying within %s", locationURL.Host)
 				}
 			} else {
-				debugLog("301 response but no Location header found")
+				rl.debug("301 response but no Location header found")
 			}
 		}
 		
 		// Check if it's HTML content and modify it to remove screenshots for better performance
 		contentType := resp.Header.Get("Content-Type")
-		if strings.Contains(contentType, "text/html") {
+		if strings.Contains(contentType, "text/html") && bodyAllowed(resp.StatusCode) {
 			// Read the body
 			body, err := io.ReadAll(resp.Body)
 			if err != nil {
@@ -243,80 +1071,96 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 		var lastErr error
 		var recorder *httptest.ResponseRecorder
 		shouldRetry := false
+		attempts := requestMaxRetries(r)
+		fetch := rl.startSpan("upstream.fetch", spanKindClient)
+		defer fetch.end()
+		fetch.setAttr("url.full", targetURL.String()+r.URL.RequestURI())
 		
-		for attempt := 0; attempt < *maxRetries; attempt++ {
+		delay := *retryDelay
+		for attempt := 0; attempt < attempts; attempt++ {
 			if attempt > 0 {
-				debugLog("Retrying proxy request (attempt %d/%d), waiting %v...", attempt+1, *maxRetries, *retryDelay)
-				time.Sleep(*retryDelay)
-				*retryDelay *= 2 // Exponential backoff
+				rl.debug("Retrying proxy request (attempt %d/%d), waiting %v...", attempt+1, attempts, delay)
+				time.Sleep(delay)
+				delay *= 2 // Exponential backoff
 			}
 			
 			recorder = httptest.NewRecorder()
+			attemptProxy, requestErrors := trackBodyErrors(proxy)
 			
 			// Call the proxy with retry logic
+			var panicked bool
 			func() {
 				defer func() {
 					if r := recover(); r != nil {
+						panicked = true
 						lastErr = fmt.Errorf("proxy panic: %v", r)
 					}
 				}()
-				proxy.ServeHTTP(recorder, r)
+				attemptProxy.ServeHTTP(recorder, r)
 			}()
 			
+			// A panic leaves the recorder with its default empty 200, which
+			// must not reach the client as if it were the page
+			if panicked {
+				errorLog("Proxy request attempt %d failed: %v", attempt+1, lastErr)
+				recorder = nil
+				break
+			}
+			
 			resp := recorder.Result()
 			
-			debugLog("Geocities proxy response status: %d", resp.StatusCode)
+			rl.debug("Geocities proxy response status: %d", resp.StatusCode)
 			
 			// HTTP 200-399 are all valid responses (including redirects)
 			if resp.StatusCode >= 200 && resp.StatusCode < 400 {
-				debugLog("Successfully proxying response with status %d", resp.StatusCode)
+				rl.debug("Successfully proxying response with status %d", resp.StatusCode)
 				// Log the Location header specifically if it exists
 				if location := resp.Header.Get("Location"); location != "" {
-					debugLog("Redirect location: %s", location)
+					rl.debug("Redirect location: %s", location)
 				}
 				// Success - copy response
-				for k, v := range recorder.Header() {
-					w.Header()[k] = v
-				}
-				w.WriteHeader(recorder.Code)
-				io.Copy(w, recorder.Body)
+				copyResponse(w, recorder)
 				return
 			}
 			
 			lastErr = fmt.Errorf("proxy returned status %d", resp.StatusCode)
 			
 			// Only retry on connection-related errors
-			if resp.StatusCode == 502 || strings.Contains(resp.Status, "connection refused") {
+			if cause := requestErrors.failure(); cause != nil {
+				lastErr = fmt.Errorf("%s: %v", describeFailure(cause), cause)
 				shouldRetry = true
-				errorLog("Proxy request attempt %d failed with status %d (connection-related), will retry", attempt+1, resp.StatusCode)
+				warnLog("Proxy request attempt %d for %s failed (%v), will retry", attempt+1, r.URL.RequestURI(), lastErr)
+				continue
+			}
+			if resp.StatusCode == 502 {
+				shouldRetry = true
+				warnLog("Proxy request attempt %d failed with status %d from the upstream server, will retry", attempt+1, resp.StatusCode)
 				continue
 			}
 			
 			// Other errors are not retryable
 			errorLog("Proxy request attempt %d failed with status %d (not retryable)", attempt+1, resp.StatusCode)
-			debugLog("Response headers: %v", resp.Header)
+			rl.debug("Response headers: %v", resp.Header)
 			// Log the Location header specifically if it exists
 			if location := resp.Header.Get("Location"); location != "" {
-				debugLog("Redirect location: %s", location)
+				rl.debug("Redirect location: %s", location)
 			}
 			break
 		}
 		
+		fetch.fail(lastErr)
+		
 		// Handle final result
 		if shouldRetry && lastErr != nil {
-			errorLog("Proxy request failed after %d attempts: %v", *maxRetries, lastErr)
-			http.Error(w, "Failed to connect to geocities.restorativland.org after "+strconv.Itoa(*maxRetries)+" attempts", 502)
+			errorLog("Proxy request failed after %d attempts: %v", attempts, lastErr)
+			serveErrorPage(w, 502, r.URL.String(), "Failed to connect to geocities.restorativland.org after "+strconv.Itoa(attempts)+" attempts")
 		} else if recorder != nil {
 			// Return last response
-			debugLog("Returning final response")
-			for k, v := range recorder.Header() {
-				w.Header()[k] = v
-			}
-			w.WriteHeader(recorder.Code)
-			io.Copy(w, recorder.Body)
+			rl.debug("Returning final response")
+			copyResponse(w, recorder)
 		} else {
 			errorLog("No response recorded: %v", lastErr)
-			http.Error(w, "Error proxying request to geocities.restorativland.org: "+lastErr.Error(), 500)
+			serveErrorPage(w, 502, r.URL.String(), "Error proxying request to geocities.restorativland.org: "+lastErr.Error())
 		}
 		
 		return
@@ -324,74 +1168,151 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 	
 	// For regular requests, proxy to Wayback Machine
 	originalURL := r.URL.String()
+	if target, ok := pathEncodedTarget(r); ok {
+		originalURL = target
+	} else if *reverseRewriteEnabled {
+		originalURL = reverseRewrite(r, originalURL)
+	}
+	
+	// Credentials in the URL are for the original site, not the archive
+	originalURL = stripUserinfo(originalURL)
+	
+	// Assets of a page that come with its timestamp are fetched from the
+	// same snapshot without a lookup
+	if *sameSnapshotAssets {
+		if pinned, ok := pinnedSnapshotURL(originalURL); ok {
+			rl.debug("Fetching %s from its page's snapshot: %s", originalURL, pinned)
+			originalURL = pinned
+		}
+	}
 	
 	// Check if this is already a Wayback Machine URL
-	isWaybackURL := strings.HasPrefix(originalURL, "http://web.archive.org/web/")
+	ref, isWaybackURL := parseWaybackURL(originalURL)
+	isWaybackURL = isWaybackURL && ref.Host != ""
 	
 	if !strings.HasPrefix(originalURL, "http") {
 		originalURL = "http://" + r.Host + originalURL
 	}
 	
-	debugLog("Original request: %s", originalURL)
+	rl.debug("Original request: %s", originalURL)
+	
+	// Domains on -passthrough-domains are fetched live, bypassing the archive
+	if len(passthroughDomains) > 0 {
+		if target, err := url.Parse(originalURL); err == nil && matchesDomain(target.Hostname(), passthroughDomains) {
+			upstream = "live"
+			serveLive(w, r, target)
+			return
+		}
+	}
+	
+	// With -warc, pages come from the local WARC files and never the archive
+	if warcArchive != nil {
+		upstream = "warc"
+		serveFromWARC(w, originalURL, reqDate)
+		return
+	}
+	
+	// ?__index=1 lists what the archive holds under the URL instead
+	if !isWaybackURL {
+		if prefix, ok := siteIndexPrefix(originalURL); ok {
+			serveSiteIndex(w, r, prefix, reqDate)
+			return
+		}
+		// Most sites never had a /favicon.ico, so answering it here saves
+		// a lookup that usually misses; icons archived pages link to arrive
+		// as Wayback URLs and are still fetched from the archive
+		if isFaviconRequest(r, originalURL) {
+			rl.debug("Serving -favicon for %s", originalURL)
+			serveFavicon(w, r)
+			return
+		}
+	}
+	
+	// Last good copies are kept per requested URL for -serve-stale
+	staleKey := cacheKey(originalURL, reqDate)
 	
 	var waybackURL string
 	var err error
 	
 	// If this is already a Wayback URL, we still need to check for redirects
 	if isWaybackURL {
-		// Extract the original URL from the Wayback URL
-		parts := strings.Split(originalURL, "/")
-		if len(parts) >= 7 {
-			// Reconstruct the original URL
-			originalPart := strings.Join(parts[6:], "/")
+		// Extract the original URL from the Wayback URL, so that relative
+		// redirect targets resolve against the archived site rather than
+		// web.archive.org
+		if page := newPageContext(originalURL); page != nil {
+			archivedURL := page.originalURL.String()
 			// Check if this contains redirect parameters
-			destinationURL := extractRedirectURL("http://" + originalPart)
+			destinationURL := extractRedirectURL(archivedURL)
 			
 			// If the destination is different, get the Wayback URL for it
-			if destinationURL != "http://"+originalPart {
-				waybackURL, err = getWaybackURL(destinationURL, *date)
+			if destinationURL != archivedURL {
+				waybackURL, err = resolveWaybackURL(rl, destinationURL, reqDate)
 				if err != nil {
-					http.Error(w, "Error finding archived version: "+err.Error(), 500)
+					if !errors.Is(err, ErrNoCapture) && serveStale(w, staleKey, err) {
+						return
+					}
+					if errors.Is(err, ErrNoCapture) && liveFallbackAllowed(destinationURL) {
+						upstream = "live"
+						serveLiveFallback(w, r, destinationURL)
+						return
+					}
+					serveErrorPage(w, statusForResolveError(err), originalURL, "Error finding archived version: "+err.Error())
 					errorLog("Error getting Wayback URL for %s: %v", destinationURL, err)
 					return
 				}
-				debugLog("Redirecting to: %s", waybackURL)
+				rl.debug("Redirecting to: %s", waybackURL)
 			} else {
 				// Use the existing Wayback URL
 				waybackURL = originalURL
-				debugLog("Using existing Wayback URL: %s", waybackURL)
+				rl.debug("Using existing Wayback URL: %s", waybackURL)
 			}
 		} else {
 			// Use the existing Wayback URL
 			waybackURL = originalURL
-			debugLog("Using existing Wayback URL: %s", waybackURL)
+			rl.debug("Using existing Wayback URL: %s", waybackURL)
 		}
 	} else {
 		// Check if this is a redirect URL and extract the destination
 		destinationURL := extractRedirectURL(originalURL)
 		
 		// Get the Wayback URL for the destination
-		waybackURL, err = getWaybackURL(destinationURL, *date)
+		waybackURL, err = resolveWaybackURL(rl, destinationURL, reqDate)
 		if err != nil {
-			http.Error(w, "Error finding archived version: "+err.Error(), 500)
+			if !errors.Is(err, ErrNoCapture) && serveStale(w, staleKey, err) {
+				return
+			}
+			if errors.Is(err, ErrNoCapture) && liveFallbackAllowed(destinationURL) {
+				upstream = "live"
+				serveLiveFallback(w, r, destinationURL)
+				return
+			}
+			serveErrorPage(w, statusForResolveError(err), originalURL, "Error finding archived version: "+err.Error())
 			errorLog("Error getting Wayback URL for %s: %v", destinationURL, err)
 			return
 		}
 	}
 	
+	if ref, ok := parseWaybackURL(waybackURL); ok {
+		trace.setAttr("timesurfer.timestamp", ref.Timestamp)
+	}
+	
 	// Parse the Wayback URL
 	targetURL, err := url.Parse(waybackURL)
 	if err != nil {
-		http.Error(w, "Error parsing Wayback URL", 500)
+		serveErrorPage(w, 500, originalURL, "Error parsing Wayback URL")
 		errorLog("Error parsing Wayback URL %s: %v", waybackURL, err)
 		return
 	}
 	
 	// Create a reverse proxy
 	proxy := httputil.NewSingleHostReverseProxy(targetURL)
+	proxy.Transport = upstreamTransport
 	
 	// Modify the request to match the target
 	proxy.Director = func(req *http.Request) {
+		// The archive is asked for web.archive.org; the archived site's
+		// host travels in the Wayback URL's path, which is how the archive
+		// tells virtual hosts apart
 		req.URL = targetURL
 		req.Host = targetURL.Host
 		req.URL.Scheme = targetURL.Scheme
@@ -400,74 +1321,289 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 		// Remove headers that might interfere
 		req.Header.Del("Proxy-Connection")
 		req.Header.Del("Proxy-Authorization")
+		req.Header.Del(maxRetriesHeader)
+		if *dropRequestCookies {
+			req.Header.Del("Cookie")
+		}
+		if rl.span != nil {
+			req.Header.Set("traceparent", rl.span.traceparent())
+		}
+	}
+	
+	// Bouncing the browser between example.com and www.example.com can loop,
+	// so those redirects are followed here, with loop detection
+	if *normalizeWWWRedirects {
+		proxy.Transport = &redirectFollower{next: upstreamTransport, maxHops: *maxUpstreamRedirects, follow: isWWWRedirect}
+	}
+	proxy.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
+		if errors.Is(err, ErrRedirectLoop) {
+			errorLog("Giving up on %s: %v", originalURL, err)
+			serveErrorPage(rw, http.StatusLoopDetected, originalURL, err.Error())
+			return
+		}
+		errorLog("Error proxying %s: %v", originalURL, err)
+		rw.WriteHeader(http.StatusBadGateway)
 	}
 	
-	// Handle response modification for HTML content
+	// Handle response modification according to the content policy
 	proxy.ModifyResponse = func(resp *http.Response) error {
-		// Check if it's HTML content
-		contentType := resp.Header.Get("Content-Type")
-		if strings.Contains(contentType, "text/html") {
+		logUpstreamHeaders(rl, resp)
+		rl.span.setAttr("http.response.status_code", resp.StatusCode)
+		
+		// The page may have been reached by following archive redirects
+		page := newPageContext(waybackURL)
+		if resp.Request != nil {
+			if final := newPageContext(resp.Request.URL.String()); final != nil {
+				page = final
+			}
+		}
+		// With -strict-date the archive must not substitute a capture from
+		// another day, as it does when asked for a timestamp it lacks
+		if *strictDate && page != nil && !strings.HasPrefix(page.timestamp, reqDate) {
+			rl.debug("Rejecting capture %s of %s, not from %s", page.timestamp, page.originalURL, reqDate)
+			resp.Body.Close()
+			replaceWithErrorPage(resp, http.StatusNotFound, page.originalURL.String(), fmt.Sprintf("%v for %s on %s", ErrNoCapture, page.originalURL, reqDate))
+			return nil
+		}
+		if page != nil {
+			page.localBase = localBaseFor(r)
+			
+			// Tell the client the actual date of the capture it got
+			resp.Header.Set("X-Time-Surfer-Timestamp", page.timestamp)
+			if *originalURLHeader {
+				resp.Header.Set("X-Original-URL", page.originalURL.String())
+			}
+			if delta, ok := captureDelta(reqDate, page.timestamp); ok && resp.StatusCode < 300 {
+				days := int(math.Round(delta.Hours() / 24))
+				infoLog("Served %s captured %s for %s (%+d days)", page.originalURL, page.timestamp, reqDate, days)
+				if *captureDeltaHeader {
+					resp.Header.Set("X-Time-Surfer-Delta", strconv.Itoa(days))
+				}
+			}
+			setClientCacheHeaders(resp, page, *clientCacheTTL)
+			if *useCaptureDateHeader {
+				setCaptureDateHeaders(resp, page.timestamp)
+			}
+		}
+		originalOrWayback := waybackURL
+		if page != nil {
+			originalOrWayback = page.originalURL.String()
+		}
+		// The browser following redirects can go round in circles as well
+		if redirectChains != nil && page != nil && resp.StatusCode >= 300 && resp.StatusCode < 400 {
+			if location, err := resp.Location(); err == nil {
+				if err := redirectChains.redirected(clientAddress(r), redirectPageKey(originalURL), redirectPageKey(location.String())); err != nil {
+					errorLog("Giving up on %s: %v", originalURL, err)
+					resp.Body.Close()
+					replaceWithErrorPage(resp, http.StatusLoopDetected, originalURL, err.Error())
+					return nil
+				}
+			}
+		}
+		// Archive redirects to another page can be held up as well
+		if *redirectInterstitial && page != nil && resp.StatusCode >= 300 && resp.StatusCode < 400 {
+			if location, err := resp.Location(); err == nil {
+				if target := newPageContext(location.String()); target != nil && redirectPageKey(location.String()) != page.originalURL.String() &&
+					interceptOffPeriodRedirect(resp, r, page.originalURL.String(), target.originalURL, reqDate) {
+					return nil
+				}
+			}
+		}
+		contentType := correctContentType(resp, originalOrWayback)
+		actions := contentActions.lookup(contentType)
+		// Responses that cannot have a body are passed through as they are
+		if !bodyAllowed(resp.StatusCode) {
+			return nil
+		}
+		
+		// A partial body can't be modified, so ranges of pages are passed
+		// through as they are
+		transcode := *normalizeEncodingEnabled && strings.HasPrefix(contentType, "text/html")
+		if (len(actions) > 0 || wantsTransform(contentType) || transcode) && resp.StatusCode != http.StatusPartialContent {
 			// Read the body
 			body, err := io.ReadAll(resp.Body)
 			if err != nil {
 				return err
 			}
+			if transcode {
+				body = normalizeEncoding(resp, contentType, body, originalOrWayback)
+			}
 			
-			// Convert to string and remove Wayback elements
-			html := string(body)
-			html = removeWaybackToolbar(html)
+			// Turn the archive's "Got an HTTP 302 response at crawl time" page
+			// into a real redirect that comes back through the proxy
+			if target, ok := crawlRedirectTarget(string(body), page); ok {
+				if *redirectInterstitial && interceptOffPeriodRedirect(resp, r, page.originalURL.String(), target, reqDate) {
+					return nil
+				}
+				if redirectChains != nil {
+					if err := redirectChains.redirected(clientAddress(r), redirectPageKey(originalURL), target.String()); err != nil {
+						errorLog("Giving up on %s: %v", originalURL, err)
+						replaceWithErrorPage(resp, http.StatusLoopDetected, originalURL, err.Error())
+						return nil
+					}
+				}
+				location := redirectLocation(r, target)
+				rl.debug("Crawl-time redirect from %s to %s", waybackURL, location)
+				redirect := fmt.Sprintf(`<html><body>Moved to <a href="%s">%s</a></body></html>`, html.EscapeString(location), html.EscapeString(location))
+				resp.StatusCode = http.StatusFound
+				resp.Status = "302 Found"
+				resp.Header.Set("Location", location)
+				resp.Header.Set("Content-Type", "text/html")
+				resp.Body = io.NopCloser(strings.NewReader(redirect))
+				resp.ContentLength = int64(len(redirect))
+				resp.Header.Set("Content-Length", fmt.Sprintf("%d", len(redirect)))
+				return nil
+			}
+			
+			// Start looking up the page's assets before the browser asks
+			if prefetched != nil && resp.StatusCode == http.StatusOK && strings.HasPrefix(contentType, "text/html") {
+				prefetchPageAssets(string(body), page, reqDate)
+			}
+			
+			// Convert to string and apply the configured modifications
+			modify := rl.startSpan("body.modify", spanKindInternal)
+			modify.setAttr("http.response.content_type", contentType)
+			modify.setAttr("timesurfer.body_bytes", len(body))
+			modified := applyContentActionsSafely(actions, string(body), page, waybackURL)
+			if wantsTransform(contentType) {
+				modified = string(runBodyTransformers(contentType, []byte(modified), waybackURL))
+			}
+			modify.end()
 			
 			// Create a new body with modified content
-			resp.Body = io.NopCloser(strings.NewReader(html))
-			resp.ContentLength = int64(len(html))
-			resp.Header.Set("Content-Length", fmt.Sprintf("%d", len(html)))
+			if !*compressResponses || !compressModifiedBody(resp, modified, r.Header.Get("Accept-Encoding")) {
+				resp.Body = io.NopCloser(strings.NewReader(modified))
+				resp.ContentLength = int64(len(modified))
+				resp.Header.Set("Content-Length", fmt.Sprintf("%d", len(modified)))
+			}
+			// Byte ranges of the modified body would not match the archive's
+			resp.Header.Del("Accept-Ranges")
+		} else if !*trustContentLength {
+			return checkContentLength(resp)
 		}
 		return nil
 	}
 	
+	// Identical concurrent requests share one upstream fetch, whose result is
+	// also reused for -page-cache-ttl, if its size is known to be within the
+	// cache's limit. Conditional requests are not shared, since their 304
+	// answer only suits the client that asked.
+	if pageCache != nil && r.Method == "GET" && r.Header.Get("Range") == "" &&
+		r.Header.Get("If-None-Match") == "" && r.Header.Get("If-Modified-Since") == "" {
+		cacheResult := "hit"
+		response := pageCache.get(pageCacheKey(waybackURL, r), func(streaming func()) *cachedResponse {
+			cacheResult = "miss"
+			pw := newPageCacheWriter(w, streaming)
+			proxyWithRetries(pw, r, proxy, originalURL, staleKey)
+			return pw.result()
+		})
+		trace.setAttr("timesurfer.page_cache", cacheResult)
+		// A response too large for the cache has been streamed already
+		if response != nil {
+			writeCachedResponse(w, response)
+		}
+		return
+	}
+	
+	proxyWithRetries(w, r, proxy, originalURL, staleKey)
+}
+
+// proxyWithRetries fetches an archived page through proxy, retrying
+// connection-related failures, and writes the result to w.
+func proxyWithRetries(w http.ResponseWriter, r *http.Request, proxy http.Handler, originalURL string, staleKey string) {
+	rl := requestLogFrom(r)
+	
 	// Apply retry logic only to the proxy call
 	var lastErr error
 	var recorder *httptest.ResponseRecorder
 	shouldRetry := false
+	attempts := requestMaxRetries(r)
+	fetch := rl.startSpan("upstream.fetch", spanKindClient)
+	defer fetch.end()
+	fetch.setAttr("url.full", originalURL)
 	
-	for attempt := 0; attempt < *maxRetries; attempt++ {
+	delay := *retryDelay
+	for attempt := 0; attempt < attempts; attempt++ {
 		if attempt > 0 {
-			debugLog("Retrying proxy request (attempt %d/%d), waiting %v...", attempt+1, *maxRetries, *retryDelay)
-			time.Sleep(*retryDelay)
-			*retryDelay *= 2 // Exponential backoff
+			rl.debug("Retrying proxy request (attempt %d/%d), waiting %v...", attempt+1, attempts, delay)
+			time.Sleep(delay)
+			delay *= 2 // Exponential backoff
 		}
 		
-		recorder = httptest.NewRecorder()
+		rw := newRetryWriter(w)
+		attemptProxy, bodyErrors := trackBodyErrors(proxy)
 		
 		// Call the proxy with retry logic
+		var panicked bool
 		func() {
 			defer func() {
 				if r := recover(); r != nil {
+					panicked = true
 					lastErr = fmt.Errorf("proxy panic: %v", r)
 				}
 			}()
-			proxy.ServeHTTP(recorder, r)
+			attemptProxy.ServeHTTP(rw, r)
 		}()
+		if !panicked {
+			rw.finish()
+		}
+		
+		// Anything but a 5xx response has been streamed to the client already
+		if rw.committed {
+			if panicked {
+				// Part of the body has been sent, so it is too late to retry.
+				// Abort the connection so the client can tell the body is
+				// incomplete.
+				if bodyErrors != nil && bodyErrors.truncation() != nil {
+					lastErr = bodyErrors.truncation()
+				}
+				errorLog("Proxy response for %s was cut off: %v", originalURL, lastErr)
+				panic(http.ErrAbortHandler)
+			}
+			if rw.status >= 400 {
+				errorLog("Proxy request attempt %d failed with status %d (not retryable)", attempt+1, rw.status)
+			} else if rw.stale != nil {
+				storeStale(staleKey, r, rw.status, rw.header, rw.stale.Bytes())
+			}
+			return
+		}
+		if panicked {
+			// The archive dropped the connection before any of the body
+			// reached the client, so the fetch can simply be redone
+			if bodyErrors != nil && bodyErrors.truncation() != nil {
+				lastErr = fmt.Errorf("archive response was cut off: %v", bodyErrors.truncation())
+				shouldRetry = true
+				warnLog("Proxy request attempt %d failed: %v, will retry", attempt+1, lastErr)
+				continue
+			}
+			errorLog("Proxy request attempt %d failed: %v", attempt+1, lastErr)
+			recorder = nil
+			break
+		}
 		
+		recorder = rw.result()
 		resp := recorder.Result()
 		
 		// HTTP 200-399 are all valid responses
 		if resp.StatusCode >= 200 && resp.StatusCode < 400 {
 			// Success - copy response
-			for k, v := range recorder.Header() {
-				w.Header()[k] = v
-			}
-			w.WriteHeader(recorder.Code)
-			io.Copy(w, recorder.Body)
+			copyResponse(w, recorder)
 			return
 		}
 		
 		lastErr = fmt.Errorf("proxy returned status %d", resp.StatusCode)
 		
-		// Only retry on connection-related errors
-		if resp.StatusCode == 502 || strings.Contains(resp.Status, "connection refused") {
+		// Only retry on connection-related errors; a redirect loop has been
+		// answered with 508 already and would only loop again
+		if cause := bodyErrors.failure(); cause != nil && !errors.Is(cause, ErrRedirectLoop) {
+			lastErr = fmt.Errorf("%s: %v", describeFailure(cause), cause)
 			shouldRetry = true
-			errorLog("Proxy request attempt %d failed with status %d (connection-related), will retry", attempt+1, resp.StatusCode)
+			warnLog("Proxy request attempt %d for %s failed (%v), will retry", attempt+1, originalURL, lastErr)
+			continue
+		}
+		if resp.StatusCode == 502 {
+			shouldRetry = true
+			warnLog("Proxy request attempt %d failed with status %d from the archive, will retry", attempt+1, resp.StatusCode)
 			continue
 		}
 		
@@ -476,47 +1612,406 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 		break
 	}
 	
+	fetch.fail(lastErr)
+	
 	// Handle final result
 	if shouldRetry && lastErr != nil {
-		errorLog("Proxy request failed after %d attempts: %v", *maxRetries, lastErr)
-		http.Error(w, "Failed to connect to archived content after "+strconv.Itoa(*maxRetries)+" attempts", 502)
+		errorLog("Proxy request failed after %d attempts: %v", attempts, lastErr)
+		if serveStale(w, staleKey, lastErr) {
+			return
+		}
+		serveErrorPage(w, 502, originalURL, "Failed to connect to archived content after "+strconv.Itoa(attempts)+" attempts")
 	} else if recorder != nil {
-		// Return last response
-		for k, v := range recorder.Header() {
-			w.Header()[k] = v
+		if recorder.Code >= 500 && serveStale(w, staleKey, lastErr) {
+			return
 		}
-		w.WriteHeader(recorder.Code)
-		io.Copy(w, recorder.Body)
+		// Return last response
+		copyResponse(w, recorder)
 	} else {
-		http.Error(w, "Error proxying request: "+lastErr.Error(), 500)
+		if serveStale(w, staleKey, lastErr) {
+			return
+		}
+		serveErrorPage(w, 502, originalURL, "Error proxying request: "+lastErr.Error())
 	}
 }
 
 func main() {
 	flag.Parse()
+	rand.Seed(time.Now().UnixNano())
+	
+	// Fall back to environment variables for anything not on the command line
+	if err := applyEnvDefaults(); err != nil {
+		log.Fatal(err)
+	}
+	
+	// -debug is kept as a shortcut for -log-level=debug
+	level, err := parseLogLevel(*logLevelName)
+	if err != nil {
+		log.Fatalf("Invalid -log-level: %v", err)
+	}
+	if *debug {
+		level = levelDebug
+	}
+	currentLogLevel = level
+	
+	if *showVersion {
+		fmt.Println(currentVersion())
+		return
+	}
 	
 	if *date == "" {
-		log.Fatal("Date parameter is required")
+		log.Fatal("Date parameter is required (-date or " + envPrefix + "DATE)")
+	}
+	
+	// Validate the date and convert it to the canonical YYYYMMDD form
+	formats, err := parseDateFormats(*acceptDateFormats)
+	if err != nil {
+		log.Fatalf("Invalid -accept-date-formats: %v", err)
+	}
+	// A relative date like -5y counts back from -date-anchor, or today
+	anchor := time.Now()
+	if *dateAnchor != "" {
+		normalized, err := normalizeDate(*dateAnchor, formats)
+		if err != nil {
+			log.Fatalf("Invalid -date-anchor: %v", err)
+		}
+		anchor, _ = time.Parse(canonicalDateLayout, normalized)
+	}
+	if resolved, ok := resolveRelativeDate(*date, anchor); ok {
+		infoLog("Relative date %s resolves to %s", *date, resolved)
+		*date = resolved
+	}
+	*date, err = normalizeDate(*date, formats)
+	if err != nil {
+		log.Fatal(err)
+	}
+	
+	// There are no captures from the future, so every lookup would fail;
+	// a day of tolerance allows for time zones
+	if requested, _ := time.Parse(canonicalDateLayout, *date); !*allowFutureDate && requested.After(time.Now().AddDate(0, 0, 1)) {
+		log.Fatalf("Date %s is in the future, so nothing has been archived for it (use -allow-future-date to start anyway)", *date)
+	}
+	
+	if *maxRetries < 1 {
+		log.Fatal("-max-retries must be at least 1")
+	}
+	
+	// Every fallback could serve something other than a capture of the
+	// URL from the configured day
+	if *strictDate {
+		*tryTrailingSlash = false
+		*dedupeQueryParams = ""
+		*fallbackDateStep = 0
+		*cdxMatchType = cdxMatchExact
+		*useAvailabilityFallback = false
+		*saveOnMiss = false
+	}
+	
+	hostDates, err = parseHostDateMap(*hostDateMap, formats, anchor)
+	if err != nil {
+		log.Fatalf("Invalid -host-date-map: %v", err)
+	}
+	for host, hostDate := range hostDates {
+		if requested, _ := time.Parse(canonicalDateLayout, hostDate); !*allowFutureDate && requested.After(time.Now().AddDate(0, 0, 1)) {
+			log.Fatalf("Invalid -host-date-map: date %s for %s is in the future", hostDate, host)
+		}
+	}
+	
+	if *debugSampleRate < 0 || *debugSampleRate > 1 {
+		log.Fatal("-debug-sample-rate must be between 0 and 1")
+	}
+	
+	if *cdxRetries < 0 {
+		log.Fatal("-cdx-retries must not be negative")
+	}
+	if *cdxRetryDelay < 0 {
+		log.Fatal("-cdx-retry-delay must not be negative")
+	}
+	if *maxUpstreamRedirects < 1 {
+		log.Fatal("-max-upstream-redirects must be at least 1")
+	}
+	if *normalizeWWWRedirects {
+		redirectChains = newRedirectTracker(*maxUpstreamRedirects)
+	}
+	if *redirectInterstitialDays < 0 {
+		log.Fatal("-redirect-interstitial-days must not be negative")
+	}
+	if *postForms != postFormsKeep && *postForms != postFormsGet && *postForms != postFormsDisable {
+		log.Fatalf("Invalid -post-forms %q, must be keep, get or disable", *postForms)
+	}
+	if *cdxBreakerThreshold < 0 {
+		log.Fatal("-cdx-breaker-threshold must not be negative")
+	}
+	if *cdxBreakerCooldown <= 0 {
+		log.Fatal("-cdx-breaker-cooldown must be positive")
+	}
+	cdxBreaker.threshold = *cdxBreakerThreshold
+	cdxBreaker.cooldown = *cdxBreakerCooldown
+	
+	// Load custom error pages so template mistakes are reported at startup
+	if err := loadErrorPage(404, *errorPage404); err != nil {
+		log.Fatalf("Invalid -error-page-404 template: %v", err)
+	}
+	if err := loadErrorPage(502, *errorPage502); err != nil {
+		log.Fatalf("Invalid -error-page-502 template: %v", err)
+	}
+	
+	// Save Page Now only accepts authenticated API requests
+	if *saveOnMiss && (*iaAccessKey == "" || *iaSecretKey == "") {
+		log.Fatal("-save-on-miss requires -ia-access-key and -ia-secret-key")
+	}
+	
+	if *rewriteJSURLs {
+		for _, mediaType := range javaScriptTypes {
+			contentActions[mediaType] = []contentAction{actionRewriteJS}
+		}
+	}
+	policy, err := parseContentPolicy(*contentActionsSpec, contentActions)
+	if err != nil {
+		log.Fatalf("Invalid -content-actions: %v", err)
+	}
+	contentActions = policy
+	
+	for name, timeout := range map[string]time.Duration{
+		"dial-timeout":            *dialTimeout,
+		"tls-handshake-timeout":   *tlsHandshakeTimeout,
+		"response-header-timeout": *responseHeaderTimeout,
+		"idle-conn-timeout":       *idleConnTimeout,
+	} {
+		if timeout < 0 {
+			log.Fatalf("-%s must not be negative", name)
+		}
+	}
+	configureTransportTimeouts(*dialTimeout, *tlsHandshakeTimeout, *responseHeaderTimeout, *idleConnTimeout)
+	if *insecureSkipVerify {
+		skipTLSVerification()
+		warnLog("-insecure-skip-verify is set: TLS certificates of the archive and all other upstream servers are NOT verified, so their connections can be intercepted and altered")
+	}
+	if !*allowPrivateIPs {
+		upstreamDialer.Control = denyPrivateAddresses
+	} else if *fallbackToLive {
+		// Any client could then reach internal hosts by asking for a URL
+		// the archive has never seen
+		log.Fatal("-fallback-to-live can't be used with -allow-private-ips")
 	}
 	
-	// Validate date format
-	if len(*date) != 8 {
-		log.Fatal("Date must be in YYYYMMDD format")
+	if err := configureUpstreamDNS(*dnsServer, *hostOverride); err != nil {
+		log.Fatalf("Invalid DNS settings: %v", err)
 	}
+	// Every connection to these would be refused, however it was set up
+	if private := privateUpstreams(); len(private) > 0 && !*allowPrivateIPs {
+		log.Fatalf("Private upstream addresses are refused without -allow-private-ips: %s", strings.Join(private, ", "))
+	}
+	
+	passthroughDomains = parseDomainList(*passthroughDomainsSpec)
+	liveFallbackDomains = parseDomainList(*fallbackToLiveDomainsSpec)
 	
-	// Parse date to verify it's valid
-	_, err := time.Parse("20060102", *date)
+	setRedactedHeaders(*redactLogHeaders)
+	
+	bandwidth, err := parseBandwidth(*bandwidthSpec)
 	if err != nil {
-		log.Fatalf("Invalid date format: %v", err)
+		log.Fatalf("Invalid -bandwidth: %v", err)
+	}
+	
+	overrides, err := parseContentTypeOverrides(*contentTypeOverrideSpec)
+	if err != nil {
+		log.Fatalf("Invalid -content-type-override: %v", err)
+	}
+	contentTypeOverrides = overrides
+	
+	// The prefix is kept as /name, without a trailing slash
+	if trimmed := strings.Trim(*pathPrefixSpec, "/"); trimmed != "" {
+		pathPrefix = "/" + trimmed
+	}
+	
+	if *externalURL != "" {
+		if u, err := url.Parse(*externalURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("Invalid -external-url %q, must be an absolute http or https URL", *externalURL)
+		}
 	}
 	
-	// Set up the proxy server
-	http.HandleFunc("/", handleRequest)
+	switch *cdxMatchType {
+	case cdxMatchExact, cdxMatchPrefix, cdxMatchHost, cdxMatchDomain:
+	default:
+		log.Fatalf("Invalid -cdx-match-type %q, must be exact, prefix, host or domain", *cdxMatchType)
+	}
+	
+	switch *ftpGopherLinks {
+	case ftpGopherKeep, ftpGopherStrip, ftpGopherAnnotate:
+	default:
+		log.Fatalf("Invalid -ftp-gopher-links %q, must be keep, strip or annotate", *ftpGopherLinks)
+	}
+	
+	if *serveStaleOnError {
+		if *staleCacheSize <= 0 {
+			log.Fatal("-stale-cache-size must be positive")
+		}
+		staleCache = newResponseCache(*staleCacheSize)
+	}
+	
+	if *pageCacheTTL > 0 {
+		if *pageCacheSize <= 0 {
+			log.Fatal("-page-cache-size must be positive")
+		}
+		pageCache = newSharedPageCache(*pageCacheTTL, *pageCacheSize)
+	}
+	
+	if *warcFiles != "" {
+		var paths []string
+		for _, path := range strings.Split(*warcFiles, ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				paths = append(paths, path)
+			}
+		}
+		warcArchive, err = loadWARCIndex(paths)
+		if err != nil {
+			log.Fatalf("Error loading -warc files: %v", err)
+		}
+		infoLog("Indexed %d URLs from %d WARC files", len(warcArchive.records), len(paths))
+	}
+	
+	if *negativeCacheTTL > 0 {
+		negativeCache = newMissCache(*negativeCacheTTL)
+	}
+	if *prefetchAssets {
+		startPrefetching()
+	}
+	
+	if *recordSession != "" && *replaySession != "" {
+		log.Fatal("-record-session and -replay-session can't be used together")
+	}
+	
+	// -resolve-batch looks the URLs up and exits without serving
+	if *resolveBatch != "" {
+		if *replaySession != "" {
+			log.Fatal("-resolve-batch looks URLs up in the archive, which -replay-session rules out")
+		}
+		if err := runResolveBatch(*resolveBatch, *resolveBatchOut, *date); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	
+	// Set up the proxy server, with the proxy's own endpoints alongside it
+	local := http.NewServeMux()
+	local.HandleFunc("/version", handleVersion)
+	// Listing captures queries the archive, which a replay must not reach
+	if *replaySession == "" {
+		local.HandleFunc(captureAroundPath, handleCaptureAround)
+	}
+	if *otelEndpoint != "" {
+		exporter, err := newSpanExporter(*otelEndpoint)
+		if err != nil {
+			log.Fatalf("Invalid -otel-endpoint: %v", err)
+		}
+		tracer = exporter
+		onShutdown(exporter.flush)
+		infoLog("Sending traces to %s", exporter.endpoint)
+	}
+	if *metricsEnabled {
+		prometheus := newPrometheusMetrics()
+		metrics = prometheus
+		local.Handle(metricsPath, prometheus)
+	}
+	if *adminToken != "" {
+		local.HandleFunc(adminConfigPath, handleAdminConfig)
+	}
+	if *faviconSpec != "" {
+		icon, err := loadFavicon(*faviconSpec)
+		if err != nil {
+			log.Fatalf("Error loading -favicon: %v", err)
+		}
+		favicon = icon
+		local.HandleFunc(faviconPath, serveFavicon)
+	}
+	
+	var proxyHandler http.Handler = http.HandlerFunc(handleRequest)
+	if *replaySession != "" {
+		session, err := openSessionStore(*replaySession, false)
+		if err != nil {
+			log.Fatalf("Invalid -replay-session: %v", err)
+		}
+		proxyHandler = http.HandlerFunc(session.replay)
+		infoLog("Replaying the session recorded in %s; nothing will be fetched", *replaySession)
+	} else if *recordSession != "" {
+		session, err := openSessionStore(*recordSession, true)
+		if err != nil {
+			log.Fatalf("Invalid -record-session: %v", err)
+		}
+		proxyHandler = session.record(proxyHandler)
+		infoLog("Recording responses to %s", *recordSession)
+	}
+	if *maxConcurrent < 0 {
+		log.Fatal("-max-concurrent must not be negative")
+	} else if *maxConcurrent > 0 {
+		requestLimiter = newPrioritySemaphore(*maxConcurrent)
+		proxyHandler = limitConcurrency(requestLimiter, proxyHandler)
+	}
+	
+	if bandwidth > 0 {
+		proxyHandler = limitBandwidth(bandwidth, proxyHandler)
+	}
+	
+	var handler http.Handler = localHandler(proxyHandler, local)
+	if pathPrefix != "" {
+		handler = stripPathPrefix(pathPrefix, handler)
+	}
+	if *harFile != "" {
+		har := newHARRecorder(*harFile, *harBodies)
+		handler = har.middleware(handler)
+		onShutdown(func() {
+			if err := har.flush(); err != nil {
+				errorLog("Error writing HAR file %s: %v", *harFile, err)
+			}
+		})
+	}
+	
+	// Even old browsers send a few hundred bytes of headers; a limit far
+	// below this would only reject ordinary requests
+	if *maxHeaderBytes < minMaxHeaderBytes {
+		log.Fatalf("-max-header-bytes must be at least %d", minMaxHeaderBytes)
+	}
+	for name, timeout := range map[string]time.Duration{
+		"read-header-timeout": *readHeaderTimeout,
+		"read-timeout":        *readTimeout,
+		"write-timeout":       *writeTimeout,
+		"idle-timeout":        *idleTimeout,
+	} {
+		if timeout < 0 {
+			log.Fatalf("-%s must not be negative", name)
+		}
+	}
+	writeTimeoutSet := false
+	flag.Visit(func(f *flag.Flag) {
+		writeTimeoutSet = writeTimeoutSet || f.Name == "write-timeout"
+	})
+	*writeTimeout = throttledWriteTimeout(bandwidth, *writeTimeout, writeTimeoutSet)
+	server := &http.Server{
+		Handler:           handler,
+		MaxHeaderBytes:    *maxHeaderBytes,
+		// Stalled clients are dropped once they stop sending, while slow
+		// ones still get the time to download what they asked for
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+	}
 	
-	addr := fmt.Sprintf(":%s", *port)
-	debugLog("Starting proxy server on port %s for date %s", *port, *date)
+	if *pprofAddr != "" {
+		go servePprof(*pprofAddr)
+	}
+	
+	listener, err := listen()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *listenUnix != "" {
+		infoLog("Starting proxy server on %s for date %s", *listenUnix, *date)
+	} else {
+		infoLog("Starting proxy server on port %s for date %s", *port, *date)
+	}
 	
-	if err := http.ListenAndServe(addr, nil); err != nil {
+	if err := serve(server, listener); err != nil {
 		log.Fatal(err)
 	}
 }
\ No newline at end of file
@@ -0,0 +1,739 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// setFlag sets the named flag for the duration of the test.
+func setFlag(t *testing.T, name string, value string) {
+	t.Helper()
+	f := flag.Lookup(name)
+	if f == nil {
+		t.Fatalf("no flag -%s", name)
+	}
+	old := f.Value.String()
+	if err := flag.Set(name, value); err != nil {
+		t.Fatalf("setting -%s: %v", name, err)
+	}
+	t.Cleanup(func() { flag.Set(name, old) })
+}
+
+// testDials routes upstream connections to some addresses to the test
+// servers standing in for them. Tests change it rather than the transport,
+// which connections left over from earlier tests may still be using.
+var testDials = struct {
+	sync.Mutex
+	routes map[string]func(ctx context.Context, network string) (net.Conn, error)
+}{routes: make(map[string]func(ctx context.Context, network string) (net.Conn, error))}
+
+func init() {
+	dial := upstreamTransport.DialContext
+	upstreamTransport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		testDials.Lock()
+		route := testDials.routes[addr]
+		testDials.Unlock()
+		if route != nil {
+			return route(ctx, network)
+		}
+		return dial(ctx, network, addr)
+	}
+	// Test servers stand in for hosts their certificates don't name
+	upstreamTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+}
+
+// routeDial has upstream connections to addr made with dial for the
+// duration of the test.
+func routeDial(t *testing.T, addr string, dial func(ctx context.Context, network string) (net.Conn, error)) {
+	testDials.Lock()
+	testDials.routes[addr] = dial
+	testDials.Unlock()
+	upstreamTransport.CloseIdleConnections()
+	t.Cleanup(func() {
+		testDials.Lock()
+		delete(testDials.routes, addr)
+		testDials.Unlock()
+		upstreamTransport.CloseIdleConnections()
+	})
+}
+
+// routeToServer has upstream connections to addr go to server for the
+// duration of the test.
+func routeToServer(t *testing.T, addr string, server *httptest.Server) {
+	routeDial(t, addr, func(ctx context.Context, network string) (net.Conn, error) {
+		return upstreamDialer.DialContext(ctx, network, server.Listener.Addr().String())
+	})
+}
+
+// newCDXServer starts a TLS server standing in for the archive's APIs, with
+// the CDX API and the availability API pointed at it, for the duration of
+// the test.
+func newCDXServer(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	server := httptest.NewTLSServer(handler)
+	oldCDX, oldAvailability := cdxAPIURL, availabilityAPIURL
+	cdxAPIURL = server.URL + "/cdx/search/cdx"
+	availabilityAPIURL = server.URL + "/wayback/available"
+	t.Cleanup(func() {
+		server.Close()
+		cdxAPIURL, availabilityAPIURL = oldCDX, oldAvailability
+	})
+	return server
+}
+
+// newArchiveServer starts a server standing in for web.archive.org, with
+// upstream connections to it dialed to the server for the duration of the
+// test.
+func newArchiveServer(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	routeToServer(t, "web.archive.org:80", server)
+	return server
+}
+
+// serveArchivedPage sets up the archive with a single capture of
+// originalURL at timestamp, whose Wayback URL is answered by handler.
+func serveArchivedPage(t *testing.T, originalURL string, timestamp string, handler http.HandlerFunc) {
+	t.Helper()
+	setFlag(t, "date", timestamp[:8])
+	newCDXServer(t, archivedCaptures(originalURL, timestamp))
+	newArchiveServer(t, handler)
+}
+
+// cdxRows writes a JSON CDX API response with the proxy's fields and the
+// given timestamp and original URL pairs.
+func cdxRows(w http.ResponseWriter, rows ...[2]string) {
+	var b strings.Builder
+	b.WriteString(`[["timestamp","original","length","statuscode"]`)
+	for _, row := range rows {
+		b.WriteString(`,["` + row[0] + `","` + row[1] + `","5000","200"]`)
+	}
+	b.WriteString("]")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(b.String()))
+}
+
+func TestArchiveAuthorizationOnlyOverHTTPS(t *testing.T) {
+	setFlag(t, "ia-access-key", "access")
+	setFlag(t, "ia-secret-key", "secret")
+
+	for _, tc := range []struct {
+		url  string
+		want string
+	}{
+		{"https://web.archive.org/cdx/search/cdx?url=example.com", "LOW access:secret"},
+		{"http://web.archive.org/cdx/search/cdx?url=example.com", ""},
+	} {
+		req := httptest.NewRequest("GET", tc.url, nil)
+		setArchiveAuthorization(req)
+		if got := req.Header.Get("Authorization"); got != tc.want {
+			t.Errorf("Authorization for %s = %q, want %q", tc.url, got, tc.want)
+		}
+	}
+}
+
+func TestCDXLookupIsAuthenticated(t *testing.T) {
+	setFlag(t, "ia-access-key", "access")
+	setFlag(t, "ia-secret-key", "secret")
+	var authorization string
+	newCDXServer(t, func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		cdxRows(w, [2]string{"20010401000000", "http://example.com/"})
+	})
+
+	waybackURL, err := getWaybackURL(nil, "http://example.com/", "20010401")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://web.archive.org/web/20010401000000/http://example.com/"; waybackURL != want {
+		t.Errorf("getWaybackURL = %q, want %q", waybackURL, want)
+	}
+	if authorization != "LOW access:secret" {
+		t.Errorf("CDX request Authorization = %q", authorization)
+	}
+}
+
+func TestCDXRetries(t *testing.T) {
+	setFlag(t, "cdx-retry-delay", "0")
+	for _, tc := range []struct {
+		name     string
+		retries  string
+		statuses []int
+		requests int
+		ok       bool
+	}{
+		{"recovers", "2", []int{503, 429, 200}, 3, true},
+		{"gives up", "1", []int{503, 503, 503}, 2, false},
+		{"4xx not retried", "2", []int{403, 200}, 1, false},
+	} {
+		setFlag(t, "cdx-retries", tc.retries)
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.statuses[requests])
+			requests++
+		}))
+
+		resp, err := fetchCDXWithRetries(server.Client(), server.URL)
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != tc.ok || requests != tc.requests {
+			t.Errorf("%s: %d requests, err %v; want %d requests, ok %v", tc.name, requests, err, tc.requests, tc.ok)
+		}
+		server.Close()
+	}
+}
+
+// archivedCaptures serves a CDX API holding captures of one URL, at the
+// given timestamps in order, honoring from, to and limit.
+func archivedCaptures(originalURL string, timestamps ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		from, to := query.Get("from"), query.Get("to")
+		var rows [][2]string
+		if !cdxFiltersMatch(r, originalURL) {
+			timestamps = nil
+		}
+		for _, timestamp := range timestamps {
+			if timestamp >= from && (to == "" || timestamp <= to) {
+				rows = append(rows, [2]string{timestamp, originalURL})
+			}
+		}
+		limit, _ := strconv.Atoi(query.Get("limit"))
+		if limit > 0 && len(rows) > limit {
+			rows = rows[:limit]
+		} else if limit < 0 && len(rows) > -limit {
+			rows = rows[len(rows)+limit:]
+		}
+		cdxRows(w, rows...)
+	}
+}
+
+func TestFallbackDateFindsNearestEarlierCapture(t *testing.T) {
+	setFlag(t, "fallback-date-step", "30")
+	setFlag(t, "fallback-date-max", "365")
+	newCDXServer(t, archivedCaptures("http://example.com/", "20000101000000", "20010201000000", "20010301000000"))
+
+	waybackURL, err := lookupWaybackURL(nil, "http://example.com/", "20010401", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://web.archive.org/web/20010301000000/http://example.com/"; waybackURL != want {
+		t.Errorf("lookupWaybackURL = %q, want %q", waybackURL, want)
+	}
+}
+
+func TestRemoveWaybackToolbar(t *testing.T) {
+	for _, tc := range []struct{ name, timestamp, page, want string }{
+		{
+			"markers",
+			"20120615000000",
+			`<html><body><!-- BEGIN WAYBACK TOOLBAR INSERT --><div id="wm-ipp-base"><div>toolbar</div></div><!-- END WAYBACK TOOLBAR INSERT --><p>page</p></body></html>`,
+			`<html><body><p>page</p></body></html>`,
+		},
+		{
+			"unmarked element and styles",
+			"19990101000000",
+			`<html><head><style type="text/css">#wm-ipp { display: none }</style><link rel="stylesheet" href="/_static/css/banner-styles.css"></head><body><div id="wm-ipp"><div>toolbar</div></div><p>page</p></body></html>`,
+			`<html><head></head><body><p>page</p></body></html>`,
+		},
+		{
+			"nested divs",
+			"19980512000000",
+			`<div id="wm-ipp-base" lang="en"><div id="wm-ipp"><div><div>a</div><div>b</div></div></div></div><div>page</div>`,
+			`<div>page</div>`,
+		},
+		{
+			"unterminated element",
+			"19990101000000",
+			`<html><body><div id="wm-ipp"><div>toolbar</div><p>page</p></body></html>`,
+			`<html><body><div id="wm-ipp"><div>toolbar</div><p>page</p></body></html>`,
+		},
+		{
+			"early capture, toolbar markup anywhere",
+			"19971203000000",
+			`<html><body><p>page</p><div id="wm-ipp"><div>toolbar</div></div><style>.wm-ipp { top: 0 }</style></body></html>`,
+			`<html><body><p>page</p></body></html>`,
+		},
+		{
+			"unknown capture time",
+			"",
+			`<html><body><p>page</p><div id="wm-ipp"><div>toolbar</div></div></body></html>`,
+			`<html><body><p>page</p></body></html>`,
+		},
+		{
+			"later capture, inserted toolbar",
+			"20200304000000",
+			`<html><head><link rel="stylesheet" href="/_static/css/iconochive.css?v=qtvMKcIJ"></head><body>
+<div id="wm-ipp-base" lang="en"><div id="wm-ipp"><div>toolbar</div></div></div><p>page</p></body></html>`,
+			`<html><head></head><body>
+<p>page</p></body></html>`,
+		},
+		{
+			"later capture quoting the toolbar",
+			"20030822000000",
+			`<html><head></head><body><h1>Hiding the archive toolbar</h1><style>#wm-ipp { display: none }</style><div id="wm-ipp"><div>toolbar</div></div></body></html>`,
+			`<html><head></head><body><h1>Hiding the archive toolbar</h1><style>#wm-ipp { display: none }</style><div id="wm-ipp"><div>toolbar</div></div></body></html>`,
+		},
+		{
+			"later capture quoting the toolbar under an inserted one",
+			"20080117000000",
+			`<html><body><div id="wm-ipp"><div>toolbar</div></div><pre><div id="wm-ipp"></div></pre></body></html>`,
+			`<html><body><pre><div id="wm-ipp"></div></pre></body></html>`,
+		},
+	} {
+		if got := removeWaybackToolbar(tc.page, tc.timestamp); got != tc.want {
+			t.Errorf("%s (%s):\n got %s\nwant %s", tc.name, tc.timestamp, got, tc.want)
+		}
+	}
+}
+
+func TestArchivedPageToolbarRemoved(t *testing.T) {
+	serveArchivedPage(t, "http://example.com/", "20010401000000", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><head><link rel="stylesheet" type="text/css" href="/_static/css/banner-styles.css?v=1"></head><body><div id="wm-ipp-base"><div id="wm-ipp"><div>toolbar</div></div></div><p>page</p></body></html>`))
+	})
+
+	w := httptest.NewRecorder()
+	handleRequest(w, httptest.NewRequest("GET", "http://example.com/", nil))
+	if want := `<html><head></head><body><p>page</p></body></html>`; w.Body.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", w.Body.String(), want)
+	}
+}
+
+func TestArchivedPageToolbarRemovalUsesCaptureYear(t *testing.T) {
+	page := `<html><body><p>page</p><div id="wm-ipp"><div>quoted toolbar</div></div></body></html>`
+	for _, tc := range []struct{ timestamp, want string }{
+		{"19990101000000", `<html><body><p>page</p></body></html>`},
+		{"20050101000000", page},
+	} {
+		serveArchivedPage(t, "http://example.com/", tc.timestamp, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(page))
+		})
+
+		w := httptest.NewRecorder()
+		handleRequest(w, httptest.NewRequest("GET", "http://example.com/", nil))
+		if w.Body.String() != tc.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tc.timestamp, w.Body.String(), tc.want)
+		}
+	}
+}
+
+func TestDecodeCDXStopsReading(t *testing.T) {
+	var b strings.Builder
+	b.WriteString(`[["timestamp","original","length","statuscode"]`)
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&b, `,["2001%010d","http://example.com/%d","5000","200"]`, i, i)
+	}
+	b.WriteString("]")
+	body := &countingReader{r: bufio.NewReader(strings.NewReader(b.String()))}
+
+	var visited []cdxCapture
+	err := decodeCDX(body, func(capture cdxCapture) bool {
+		visited = append(visited, capture)
+		return len(visited) < 3
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(visited) != 3 || visited[2].Original != "http://example.com/2" {
+		t.Errorf("visited %v", visited)
+	}
+	if body.n > int64(b.Len()/100) {
+		t.Errorf("read %d of %d bytes to decode 3 rows", body.n, b.Len())
+	}
+
+	if err := decodeCDX(strings.NewReader(`{"error":"x"}`), func(cdxCapture) bool { return true }); !errors.Is(err, ErrBadCDXResponse) {
+		t.Errorf("decoding an object: err = %v", err)
+	}
+}
+
+func TestResolveErrorStatus(t *testing.T) {
+	setFlag(t, "cdx-retries", "0")
+	setFlag(t, "date", "20010401")
+	for _, tc := range []struct {
+		name    string
+		handler http.HandlerFunc
+		kind    error
+		status  int
+	}{
+		{"no capture", func(w http.ResponseWriter, r *http.Request) { cdxRows(w) }, ErrNoCapture, http.StatusNotFound},
+		{"API down", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		}, ErrCDXUnavailable, http.StatusServiceUnavailable},
+		{"unreadable response", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`[["original","length"],["http://example.com/","5000"]]`))
+		}, ErrBadCDXResponse, http.StatusBadGateway},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			newCDXServer(t, tc.handler)
+
+			_, err := getWaybackURL(nil, "http://example.com/", "20010401")
+			if !errors.Is(err, tc.kind) {
+				t.Errorf("lookup: err = %v, want %v", err, tc.kind)
+			}
+			if got := statusForResolveError(err); got != tc.status {
+				t.Errorf("statusForResolveError(%v) = %d, want %d", err, got, tc.status)
+			}
+
+			w := httptest.NewRecorder()
+			handleRequest(w, httptest.NewRequest("GET", "http://example.com/", nil))
+			if w.Code != tc.status {
+				t.Errorf("served with status %d, want %d", w.Code, tc.status)
+			}
+		})
+	}
+
+	// The kinds keep their causes
+	cause := &cdxStatusError{status: 503}
+	err := error(&resolveError{kind: ErrCDXUnavailable, err: cause})
+	var statusErr *cdxStatusError
+	if !errors.As(err, &statusErr) || statusErr != cause || errors.Is(err, ErrBadCDXResponse) {
+		t.Errorf("resolveError %v does not match its cause and kind alone", err)
+	}
+	if got := statusForResolveError(errors.New("other")); got != http.StatusInternalServerError {
+		t.Errorf("statusForResolveError of another error = %d", got)
+	}
+}
+
+func TestBroadMatchPicksShortestURL(t *testing.T) {
+	setFlag(t, "cdx-match-type", "prefix")
+	newCDXServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("matchType") == "" {
+			cdxRows(w)
+			return
+		}
+		cdxRows(w,
+			[2]string{"20010401000000", "http://example.com/a/b/c.html"},
+			[2]string{"20010402000000", "http://example.com/a/"},
+			[2]string{"20010401000000", "http://example.com/a/b.html"},
+		)
+	})
+
+	waybackURL, err := getWaybackURL(nil, "http://example.com/a", "20010401")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://web.archive.org/web/20010402000000/http://example.com/a/"; waybackURL != want {
+		t.Errorf("getWaybackURL = %q, want %q", waybackURL, want)
+	}
+}
+
+func TestRelaxCSP(t *testing.T) {
+	serveArchivedPage(t, "http://example.com/", "20010401000000", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", "script-src 'self'")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("Content-Type", "image/gif")
+		w.Write([]byte("GIF89a"))
+	})
+
+	for _, relax := range []bool{false, true} {
+		setFlag(t, "relax-csp", strconv.FormatBool(relax))
+		w := httptest.NewRecorder()
+		handleRequest(w, httptest.NewRequest("GET", "http://example.com/", nil))
+		if w.Code != http.StatusOK || w.Body.String() != "GIF89a" {
+			t.Fatalf("got %d %q, want the capture", w.Code, w.Body.String())
+		}
+		for _, header := range []string{"Content-Security-Policy", "X-Frame-Options"} {
+			if kept := w.Header().Get(header) != ""; kept == relax {
+				t.Errorf("-relax-csp=%v: %s = %q", relax, header, w.Header().Get(header))
+			}
+		}
+	}
+}
+
+func TestMinCaptureBytesSkipsStubs(t *testing.T) {
+	var limit string
+	newCDXServer(t, func(w http.ResponseWriter, r *http.Request) {
+		limit = r.URL.Query().Get("limit")
+		w.Write([]byte(`[["timestamp","original","length","statuscode"],` +
+			`["20010401000000","http://example.com/","300","200"],` +
+			`["20010402000000","http://example.com/","-","200"],` +
+			`["20010403000000","http://example.com/","5000","200"]]`))
+	})
+
+	for _, tc := range []struct{ min, limit, want string }{
+		{"0", "1", "20010401000000"},
+		// The length of the second capture is unknown, so it isn't skipped
+		{"1000", strconv.Itoa(cdxCandidateLimit), "20010402000000"},
+	} {
+		setFlag(t, "min-capture-bytes", tc.min)
+		waybackURL, err := getWaybackURL(nil, "http://example.com/", "20010401")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "http://web.archive.org/web/" + tc.want + "/http://example.com/"; waybackURL != want {
+			t.Errorf("-min-capture-bytes=%s: getWaybackURL = %q, want %q", tc.min, waybackURL, want)
+		}
+		if limit != tc.limit {
+			t.Errorf("-min-capture-bytes=%s: CDX limit = %s, want %s", tc.min, limit, tc.limit)
+		}
+	}
+
+	newCDXServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[["timestamp","original","length","statuscode"],["20010401000000","http://example.com/","300","200"]]`))
+	})
+	if _, err := getWaybackURL(nil, "http://example.com/a", "20010401"); !errors.Is(err, ErrNoCapture) {
+		t.Errorf("only stubs: err = %v, want ErrNoCapture", err)
+	}
+}
+
+func TestExtractRedirectURL(t *testing.T) {
+	for _, tc := range []struct{ url, want string }{
+		{"http://example.com/login?next=http://other.example/a", "http://other.example/a"},
+		{"http://example.com/dir/login?next=/members/?a=1", "http://example.com/members/?a=1"},
+		{"https://example.com:8080/go?url=/b", "https://example.com:8080/b"},
+		// Protocol-relative and plain relative values are not redirects
+		{"http://example.com/go?url=//evil.example/", "http://example.com/go?url=//evil.example/"},
+		{"http://example.com/go?url=b.html", "http://example.com/go?url=b.html"},
+		{"http://example.com/page.html", "http://example.com/page.html"},
+	} {
+		if got := extractRedirectURL(tc.url); got != tc.want {
+			t.Errorf("extractRedirectURL(%s) = %s, want %s", tc.url, got, tc.want)
+		}
+	}
+}
+
+func TestWaybackRedirectResolvedOnArchivedSite(t *testing.T) {
+	var looked []string
+	setFlag(t, "date", "20010401")
+	newCDXServer(t, func(w http.ResponseWriter, r *http.Request) {
+		looked = append(looked, r.URL.Query().Get("url"))
+		cdxRows(w, [2]string{"20010401000000", "http://example.com/members/"})
+	})
+	newArchiveServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/gif")
+		w.Write([]byte("GIF89a"))
+	})
+
+	for _, requested := range []string{
+		"http://web.archive.org/web/20010401000000/http://example.com/login?next=/members/",
+		"http://web.archive.org/web/20010401000000/example.com/login?next=/members/",
+	} {
+		looked = nil
+		w := httptest.NewRecorder()
+		handleRequest(w, httptest.NewRequest("GET", requested, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: got %d", requested, w.Code)
+		}
+		if len(looked) != 1 || !strings.HasPrefix(strings.TrimPrefix(looked[0], "http://"), "example.com/members/") {
+			t.Errorf("%s: looked up %q, want example.com/members/", requested, looked)
+		}
+	}
+}
+
+// cdxFiltersMatch reports whether a capture of originalURL, with status
+// 200 and the MIME type its extension implies, or else text/html, passes
+// the filter parameters of a CDX API request, as the API applies them.
+func cdxFiltersMatch(r *http.Request, originalURL string) bool {
+	fields := map[string]string{"statuscode": "200", "mimetype": "text/html"}
+	if u, err := url.Parse(originalURL); err == nil {
+		if mimeType, _, err := mime.ParseMediaType(mime.TypeByExtension(path.Ext(u.Path))); err == nil {
+			fields["mimetype"] = mimeType
+		}
+	}
+	for _, filter := range r.URL.Query()["filter"] {
+		negate := strings.HasPrefix(filter, "!")
+		parts := strings.SplitN(strings.TrimPrefix(filter, "!"), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if matched, _ := regexp.MatchString("^(?:"+parts[1]+")$", fields[parts[0]]); matched == negate {
+			return false
+		}
+	}
+	return true
+}
+
+// capturesOf serves a CDX API holding a capture of each of urls, looked up
+// by their url parameter.
+func capturesOf(urls ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, u := range urls {
+			if r.URL.Query().Get("url") == normalizeLookupURL(u) && cdxFiltersMatch(r, u) {
+				cdxRows(w, [2]string{"20010401000000", u})
+				return
+			}
+		}
+		cdxRows(w)
+	}
+}
+
+func TestStripQueryParams(t *testing.T) {
+	names := []string{"v", " CB ", "_"}
+	for _, tc := range []struct {
+		url, want string
+		ok        bool
+	}{
+		{"http://example.com/a.js?v=123", "http://example.com/a.js", true},
+		{"http://example.com/a.js?x=1&cb=2&y=%20", "http://example.com/a.js?x=1&y=%20", true},
+		{"http://example.com/a.js?%5F=1&x", "http://example.com/a.js?x", true},
+		{"http://example.com/a.js?x=1", "", false},
+		{"http://example.com/a.js", "", false},
+	} {
+		got, ok := stripQueryParams(tc.url, names)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("stripQueryParams(%s) = %q, %v; want %q, %v", tc.url, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestDedupeQueryParams(t *testing.T) {
+	newCDXServer(t, capturesOf("http://example.com/a.gif", "http://example.com/page.html"))
+
+	if _, err := lookupWaybackURL(nil, "http://example.com/a.gif?v=2", "20010401", false); !errors.Is(err, ErrNoCapture) {
+		t.Errorf("without -dedupe-query-params: err = %v, want ErrNoCapture", err)
+	}
+
+	setFlag(t, "dedupe-query-params", "v,cb")
+	waybackURL, err := lookupWaybackURL(nil, "http://example.com/a.gif?v=2", "20010401", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://web.archive.org/web/20010401000000/http://example.com/a.gif"; waybackURL != want {
+		t.Errorf("lookupWaybackURL = %s, want %s", waybackURL, want)
+	}
+	// Query parameters of pages can select content, so they are kept
+	if _, err := lookupWaybackURL(nil, "http://example.com/page.html?v=2", "20010401", false); !errors.Is(err, ErrNoCapture) {
+		t.Errorf("page: err = %v, want ErrNoCapture", err)
+	}
+}
+
+func TestCDXMatchTypeFallback(t *testing.T) {
+	var matchTypes []string
+	newCDXServer(t, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		matchTypes = append(matchTypes, query.Get("matchType"))
+		switch {
+		case query.Get("url") == "http://example.com/archived.html":
+			cdxRows(w, [2]string{"20010401000000", "http://example.com/archived.html"})
+		case query.Get("matchType") != "":
+			cdxRows(w, [2]string{"20010402000000", "http://example.com/"})
+		default:
+			cdxRows(w)
+		}
+	})
+
+	for _, tc := range []struct {
+		matchType, url string
+		queries        []string
+		found          bool
+	}{
+		{"exact", "http://example.com/missing.html", []string{""}, false},
+		{"host", "http://example.com/missing.html", []string{"", "host"}, true},
+		{"domain", "http://example.com/missing.html", []string{"", "domain"}, true},
+		// A URL with a capture of its own is never broadened
+		{"domain", "http://example.com/archived.html", []string{""}, true},
+	} {
+		setFlag(t, "cdx-match-type", tc.matchType)
+		matchTypes = nil
+		_, err := getWaybackURL(nil, tc.url, "20010401")
+		if (err == nil) != tc.found {
+			t.Errorf("%s match for %s: err = %v", tc.matchType, tc.url, err)
+		}
+		if strings.Join(matchTypes, ",") != strings.Join(tc.queries, ",") {
+			t.Errorf("%s match for %s: queried with matchType %q, want %q", tc.matchType, tc.url, matchTypes, tc.queries)
+		}
+	}
+}
+
+func TestStrictDate(t *testing.T) {
+	setFlag(t, "strict-date", "true")
+	serveArchivedPage(t, "http://example.com/", "20010402000000", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/gif")
+		w.Write([]byte("GIF89a"))
+	})
+	setFlag(t, "date", "20010401")
+
+	// The next day's capture is outside the lookup
+	w := httptest.NewRecorder()
+	handleRequest(w, httptest.NewRequest("GET", "http://example.com/", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("lookup: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	// and isn't served when the archive substitutes it for a Wayback URL
+	w = httptest.NewRecorder()
+	handleRequest(w, httptest.NewRequest("GET", "http://web.archive.org/web/20010402000000/http://example.com/", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Wayback URL: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	setFlag(t, "date", "20010402")
+	w = httptest.NewRecorder()
+	handleRequest(w, httptest.NewRequest("GET", "http://example.com/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("capture from the day: status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestWaybackURLUsesCapturedURL(t *testing.T) {
+	newCDXServer(t, func(w http.ResponseWriter, r *http.Request) {
+		cdxRows(w, [2]string{"20010401000000", "https://www.example.com:443/a/"})
+	})
+
+	waybackURL, err := getWaybackURL(nil, "http://www.example.com/a", "20010401")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://web.archive.org/web/20010401000000/https://www.example.com:443/a/"; waybackURL != want {
+		t.Errorf("getWaybackURL = %s, want %s", waybackURL, want)
+	}
+
+	// Rows without the original URL fall back to the requested one
+	newCDXServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[["timestamp","length","statuscode"],["20010401000000","5000","200"]]`))
+	})
+	waybackURL, err = getWaybackURL(nil, "http://www.example.com/a b", "20010401")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://web.archive.org/web/20010401000000/http://www.example.com/a%20b"; waybackURL != want {
+		t.Errorf("without an original column: getWaybackURL = %s, want %s", waybackURL, want)
+	}
+}
+
+func TestDropCookies(t *testing.T) {
+	var cookie string
+	serveArchivedPage(t, "http://example.com/", "20010401000000", func(w http.ResponseWriter, r *http.Request) {
+		cookie = r.Header.Get("Cookie")
+		w.Header().Set("Set-Cookie", "session=abc")
+		w.Header().Set("Content-Type", "image/gif")
+		w.Write([]byte("GIF89a"))
+	})
+
+	for _, drop := range []bool{false, true} {
+		setFlag(t, "drop-cookies", strconv.FormatBool(drop))
+		setFlag(t, "drop-request-cookies", strconv.FormatBool(drop))
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		r.Header.Set("Cookie", "visitor=1")
+		w := httptest.NewRecorder()
+		handleRequest(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d", w.Code)
+		}
+		if sent := cookie != ""; sent == drop {
+			t.Errorf("-drop-request-cookies=%v: archive got Cookie %q", drop, cookie)
+		}
+		if kept := w.Header().Get("Set-Cookie") != ""; kept == drop {
+			t.Errorf("-drop-cookies=%v: client got Set-Cookie %q", drop, w.Header().Get("Set-Cookie"))
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MetricsSink receives the proxy's instrumentation. Embedders that use statsd,
+// OpenTelemetry or anything else plug in their own by setting metrics;
+// -metrics installs the Prometheus one. Labels may be nil.
+type MetricsSink interface {
+	// IncCounter adds one to the counter name.
+	IncCounter(name string, labels map[string]string)
+	// ObserveHistogram records value, in seconds for durations, in the
+	// histogram name.
+	ObserveHistogram(name string, value float64, labels map[string]string)
+}
+
+// Metrics the proxy records.
+const (
+	metricRequests        = "timesurfer_requests_total"
+	metricRequestDuration = "timesurfer_request_duration_seconds"
+	metricLookups         = "timesurfer_cdx_lookups_total"
+	metricLookupDuration  = "timesurfer_cdx_lookup_duration_seconds"
+
+	metricBreakerTransitions = "timesurfer_circuit_breaker_transitions_total"
+)
+
+var metricHelp = map[string]string{
+	metricRequests:        "Proxied requests, by upstream: archive, direct (the GeoCities mirror), live (-passthrough-domains) or warc.",
+	metricRequestDuration: "Time taken to serve proxied requests.",
+	metricLookups:         "CDX lookups of a URL, by result: found, not_found or error.",
+	metricLookupDuration:  "Time taken by CDX lookups of a URL.",
+
+	metricBreakerTransitions: "Circuit breaker state changes, by breaker and the state entered: open, half_open or closed.",
+}
+
+// metricsPath is where -metrics serves the Prometheus metrics.
+const metricsPath = "/metrics"
+
+// metrics is where instrumentation goes, nowhere unless -metrics is set.
+var metrics MetricsSink = noopMetrics{}
+
+// noopMetrics discards everything.
+type noopMetrics struct{}
+
+func (noopMetrics) IncCounter(string, map[string]string)                {}
+func (noopMetrics) ObserveHistogram(string, float64, map[string]string) {}
+
+// histogramBuckets are the upper bounds, in seconds, of the Prometheus
+// histogram buckets, Prometheus' usual defaults.
+var histogramBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// prometheusMetrics keeps the metrics in memory and serves them in the
+// Prometheus text format.
+type prometheusMetrics struct {
+	mu         sync.Mutex
+	counters   map[string]map[string]float64    // by name, then labels
+	histograms map[string]map[string]*histogram // by name, then labels
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newPrometheusMetrics() *prometheusMetrics {
+	return &prometheusMetrics{
+		counters:   map[string]map[string]float64{},
+		histograms: map[string]map[string]*histogram{},
+	}
+}
+
+func (m *prometheusMetrics) IncCounter(name string, labels map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.counters[name] == nil {
+		m.counters[name] = map[string]float64{}
+	}
+	m.counters[name][formatLabels(labels)]++
+}
+
+func (m *prometheusMetrics) ObserveHistogram(name string, value float64, labels map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.histograms[name] == nil {
+		m.histograms[name] = map[string]*histogram{}
+	}
+	key := formatLabels(labels)
+	h := m.histograms[name][key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(histogramBuckets))}
+		m.histograms[name][key] = h
+	}
+	for i, bound := range histogramBuckets {
+		if value <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// ServeHTTP answers a scrape.
+func (m *prometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.write(w)
+}
+
+func (m *prometheusMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, name := range sortedKeys(m.counters) {
+		writeMetricHeader(w, name, "counter")
+		series := m.counters[name]
+		for _, labels := range sortedKeys(series) {
+			fmt.Fprintf(w, "%s%s %s\n", name, labels, formatMetricValue(series[labels]))
+		}
+	}
+	for _, name := range sortedKeys(m.histograms) {
+		writeMetricHeader(w, name, "histogram")
+		series := m.histograms[name]
+		for _, labels := range sortedKeys(series) {
+			h := series[labels]
+			var cumulative uint64
+			for i, bound := range histogramBuckets {
+				cumulative += h.counts[i]
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(labels, "le", formatMetricValue(bound)), cumulative)
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(labels, "le", "+Inf"), h.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatMetricValue(h.sum))
+			fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+		}
+	}
+}
+
+func writeMetricHeader(w io.Writer, name string, kind string) {
+	if help, ok := metricHelp[name]; ok {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	}
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels renders labels as a Prometheus label set, e.g.
+// {result="found"}, sorted by name, or "" if there are none.
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels))
+	for _, name := range sortedKeys(labels) {
+		pairs = append(pairs, name+`="`+labelValueEscaper.Replace(labels[name])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// withLabel adds a label to a label set from formatLabels.
+func withLabel(labels string, name string, value string) string {
+	pair := name + `="` + value + `"`
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return labels[:len(labels)-1] + "," + pair + "}"
+}
+
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// sortedKeys returns the keys of m, a map with string keys, in order.
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	for _, key := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
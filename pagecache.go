@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// pageCache holds recently fetched archived pages, keyed by the Wayback URL
+// they were fetched from, when -page-cache-ttl is set, and is nil otherwise.
+var pageCache *sharedPageCache
+
+// sharedPageCache reuses archived responses for -page-cache-ttl and makes
+// concurrent requests for the same page wait for a single upstream fetch
+// instead of each fetching it.
+type sharedPageCache struct {
+	ttl     time.Duration
+	entries *responseCache
+
+	mu       sync.Mutex
+	inFlight map[string]*pageFetch
+}
+
+// pageFetch is an upstream fetch other requests for the same page wait on.
+type pageFetch struct {
+	done     chan struct{}
+	response *cachedResponse
+}
+
+func newSharedPageCache(ttl time.Duration, max int) *sharedPageCache {
+	return &sharedPageCache{
+		ttl:      ttl,
+		entries:  newResponseCache(max),
+		inFlight: make(map[string]*pageFetch),
+	}
+}
+
+// pageCacheKey identifies a fetch of waybackURL. The Accept-Encoding header
+// is part of the key so a compressed body is only shared with clients that
+// asked for the same encoding, and so is the base the page's links are
+// rewritten against.
+func pageCacheKey(waybackURL string, r *http.Request) string {
+	return waybackURL + " " + r.Header.Get("Accept-Encoding") + " " + localBaseFor(r)
+}
+
+// get returns the response for key, from the cache if a fresh copy is there
+// and otherwise by calling fetch. Only one fetch per key runs at a time;
+// requests arriving while it runs receive its result. A fetch that streams
+// its response to its own client instead calls streaming as it starts to,
+// and returns nil. That, or a fetch that panics, as proxyWithRetries does to
+// abort a response cut off part way, leaves no result, so the requests
+// waiting for it fetch the page themselves.
+func (c *sharedPageCache) get(key string, fetch func(streaming func()) *cachedResponse) *cachedResponse {
+	if cached, ok := c.entries.get(key); ok && time.Since(cached.storedAt) < c.ttl {
+		debugLog("Page cache hit for %s", key)
+		return cached
+	}
+
+	c.mu.Lock()
+	if pending, ok := c.inFlight[key]; ok {
+		c.mu.Unlock()
+		debugLog("Waiting for in-flight fetch of %s", key)
+		<-pending.done
+		if pending.response == nil {
+			debugLog("In-flight fetch of %s left no shared response, fetching it again", key)
+			return fetch(func() {})
+		}
+		return pending.response
+	}
+	pending := &pageFetch{done: make(chan struct{})}
+	c.inFlight[key] = pending
+	c.mu.Unlock()
+
+	// Waiters are released when the fetch is over, or as soon as it turns
+	// out to be streamed
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			c.mu.Lock()
+			delete(c.inFlight, key)
+			c.mu.Unlock()
+			close(pending.done)
+		})
+	}
+	defer release()
+
+	response := fetch(release)
+	if response == nil {
+		return nil
+	}
+	pending.response = response
+	if cacheablePage(response) {
+		c.entries.put(key, response)
+	}
+	return response
+}
+
+// cacheablePage reports whether response may be reused for later requests.
+// Errors and stale copies served in place of an error are only shared with
+// the requests that were waiting for them.
+func cacheablePage(response *cachedResponse) bool {
+	return response.status >= 200 && response.status < 400 && response.status != http.StatusPartialContent &&
+		response.status != http.StatusNotModified &&
+		response.header.Get("Warning") == "" &&
+		len(response.body) <= staleMaxBodyBytes
+}
+
+// pageCacheWriter is what a fetch through the shared page cache writes to.
+// A response whose Content-Length says it fits in the cache is recorded, to
+// be shared and cached; any other, such as a large download or one of
+// unknown length, is streamed straight to the fetching client instead of
+// being held in memory, and shared with no one.
+type pageCacheWriter struct {
+	w        http.ResponseWriter
+	header   http.Header
+	recorder *httptest.ResponseRecorder
+	// streaming is set once the response is being sent to w
+	streaming bool
+	// onStream is called as streaming starts
+	onStream func()
+}
+
+func newPageCacheWriter(w http.ResponseWriter, onStream func()) *pageCacheWriter {
+	return &pageCacheWriter{w: w, header: make(http.Header), onStream: onStream}
+}
+
+func (pw *pageCacheWriter) Header() http.Header {
+	return pw.header
+}
+
+func (pw *pageCacheWriter) WriteHeader(status int) {
+	if pw.recorder != nil || pw.streaming {
+		return
+	}
+	if length, err := strconv.ParseInt(pw.header.Get("Content-Length"), 10, 64); err == nil && length <= staleMaxBodyBytes {
+		pw.recorder = httptest.NewRecorder()
+		copyHeaders(pw.recorder.Header(), pw.header)
+		pw.recorder.WriteHeader(status)
+		return
+	}
+	pw.streaming = true
+	pw.onStream()
+	copyHeaders(pw.w.Header(), pw.header)
+	pw.w.WriteHeader(status)
+}
+
+func (pw *pageCacheWriter) Write(p []byte) (int, error) {
+	if pw.recorder == nil && !pw.streaming {
+		pw.WriteHeader(http.StatusOK)
+	}
+	if pw.streaming {
+		return pw.w.Write(p)
+	}
+	return pw.recorder.Write(p)
+}
+
+func (pw *pageCacheWriter) Flush() {
+	if !pw.streaming {
+		return
+	}
+	if flusher, ok := pw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// result returns the recorded response, or nil if it was streamed. A fetch
+// that wrote nothing stands for an empty 200 response.
+func (pw *pageCacheWriter) result() *cachedResponse {
+	if pw.streaming {
+		return nil
+	}
+	if pw.recorder == nil {
+		pw.header.Set("Content-Length", "0")
+		pw.WriteHeader(http.StatusOK)
+	}
+	return &cachedResponse{
+		status:   pw.recorder.Code,
+		header:   pw.recorder.Header().Clone(),
+		body:     append([]byte(nil), pw.recorder.Body.Bytes()...),
+		storedAt: time.Now(),
+	}
+}
+
+// writeCachedResponse writes a shared response to w. The header values are
+// copied, so the response can be written to any number of clients.
+func writeCachedResponse(w http.ResponseWriter, response *cachedResponse) {
+	copyHeaders(w.Header(), response.header.Clone())
+	w.WriteHeader(response.status)
+	w.Write(response.body)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSharedPageCacheSharesConcurrentFetches(t *testing.T) {
+	cache := newSharedPageCache(time.Minute, 10)
+	var fetches int32
+	release := make(chan struct{})
+	fetch := func(func()) *cachedResponse {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		return &cachedResponse{status: http.StatusOK, header: http.Header{"Content-Type": {"text/html"}}, body: []byte("page"), storedAt: time.Now()}
+	}
+
+	const clients = 10
+	var wg sync.WaitGroup
+	recorders := make([]*httptest.ResponseRecorder, clients)
+	for i := range recorders {
+		recorders[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(w *httptest.ResponseRecorder) {
+			defer wg.Done()
+			writeCachedResponse(w, cache.get("key", fetch))
+		}(recorders[i])
+	}
+	// Let every client reach the cache before the fetch completes
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("%d upstream fetches, want 1", n)
+	}
+	for i, w := range recorders {
+		if w.Code != http.StatusOK || w.Body.String() != "page" {
+			t.Errorf("client %d got %d %q", i, w.Code, w.Body.String())
+		}
+		// Each writer gets its own copy of the header
+		w.Header().Set("X-Client", "changed")
+	}
+	if cached := cache.get("key", fetch); cached.header.Get("X-Client") != "" {
+		t.Error("a client's header change leaked into the shared response")
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("fresh cached page fetched again")
+	}
+}
+
+func TestSharedPageCacheWaitersRefetchAfterPanic(t *testing.T) {
+	cache := newSharedPageCache(time.Minute, 10)
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	leaderPanicked := make(chan interface{}, 1)
+	go func() {
+		defer func() { leaderPanicked <- recover() }()
+		cache.get("key", func(func()) *cachedResponse {
+			close(started)
+			<-release
+			panic(http.ErrAbortHandler)
+		})
+	}()
+	<-started
+
+	waiter := make(chan *cachedResponse, 1)
+	go func() {
+		waiter <- cache.get("key", func(func()) *cachedResponse {
+			return &cachedResponse{status: http.StatusOK, header: http.Header{}, body: []byte("own fetch"), storedAt: time.Now()}
+		})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if p := <-leaderPanicked; p != http.ErrAbortHandler {
+		t.Errorf("leader recovered %v, want http.ErrAbortHandler", p)
+	}
+	response := <-waiter
+	if response == nil || string(response.body) != "own fetch" {
+		t.Fatalf("waiter got %+v, want its own fetch", response)
+	}
+}
+
+func TestSharedPageCacheStreamedFetchReleasesWaiters(t *testing.T) {
+	cache := newSharedPageCache(time.Minute, 10)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	leaderDone := make(chan *cachedResponse, 1)
+	go func() {
+		leaderDone <- cache.get("key", func(streaming func()) *cachedResponse {
+			streaming()
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+
+	// The waiter needn't wait for the whole download it can't share
+	waiter := cache.get("key", func(func()) *cachedResponse {
+		return &cachedResponse{status: http.StatusOK, header: http.Header{}, body: []byte("own fetch"), storedAt: time.Now()}
+	})
+	if waiter == nil || string(waiter.body) != "own fetch" {
+		t.Errorf("waiter got %+v, want its own fetch", waiter)
+	}
+	close(release)
+	if response := <-leaderDone; response != nil {
+		t.Errorf("streamed fetch returned %+v", response)
+	}
+}
+
+func TestPageCacheWriter(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		contentLength string
+		recorded      bool
+	}{
+		{"known size", "4", true},
+		{"unknown size", "", false},
+		{"too large", strconv.Itoa(staleMaxBodyBytes + 1), false},
+	} {
+		w := httptest.NewRecorder()
+		streamed := false
+		pw := newPageCacheWriter(w, func() { streamed = true })
+		if tc.contentLength != "" {
+			pw.Header().Set("Content-Length", tc.contentLength)
+		}
+		pw.Header().Set("Content-Type", "text/html")
+		pw.Write([]byte("page"))
+
+		response := pw.result()
+		if tc.recorded {
+			if response == nil || string(response.body) != "page" || response.header.Get("Content-Type") != "text/html" || streamed || w.Body.Len() != 0 {
+				t.Errorf("%s: recorded %+v, streamed %v, client got %q", tc.name, response, streamed, w.Body.String())
+			}
+			continue
+		}
+		if response != nil || !streamed || w.Body.String() != "page" || w.Header().Get("Content-Type") != "text/html" {
+			t.Errorf("%s: recorded %+v, streamed %v, client got %q", tc.name, response, streamed, w.Body.String())
+		}
+	}
+}
+
+func TestPageCacheStreamsDownloadsOfUnknownSize(t *testing.T) {
+	old := pageCache
+	pageCache = newSharedPageCache(time.Minute, 10)
+	defer func() { pageCache = old }()
+	var fetches int32
+	serveArchivedPage(t, "http://example.com/intro.swf", "20010401000000", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		if r.URL.Path == "/web/20010401000000/http://example.com/page.html" {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<p>page</p>"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Write([]byte("PK"))
+		// Flushed before the end, so it is sent without a Content-Length
+		w.(http.Flusher).Flush()
+		w.Write([]byte("data"))
+	})
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handleRequest(w, httptest.NewRequest("GET", "http://example.com/intro.swf", nil))
+		if w.Code != http.StatusOK || w.Body.String() != "PKdata" {
+			t.Errorf("request %d: got %d %q", i+1, w.Code, w.Body.String())
+		}
+	}
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Errorf("%d fetches, want each download streamed from the archive", n)
+	}
+
+	// A page of known size is still cached
+	newCDXServer(t, archivedCaptures("http://example.com/page.html", "20010401000000"))
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handleRequest(w, httptest.NewRequest("GET", "http://example.com/page.html", nil))
+		if w.Code != http.StatusOK || w.Body.String() != "<p>page</p>" {
+			t.Errorf("page request %d: got %d %q", i+1, w.Code, w.Body.String())
+		}
+	}
+	if n := atomic.LoadInt32(&fetches); n != 3 {
+		t.Errorf("%d fetches, want the page fetched once", n)
+	}
+}
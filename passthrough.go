@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// passthroughDomains are the domains, from -passthrough-domains, that are
+// fetched live instead of from the archive.
+var passthroughDomains []string
+
+// liveFallbackDomains limits -fallback-to-live to these domains, from
+// -fallback-to-live-domains; empty allows every domain.
+var liveFallbackDomains []string
+
+// parseDomainList parses a comma-separated list of domain names.
+func parseDomainList(spec string) []string {
+	var domains []string
+	for _, domain := range strings.Split(spec, ",") {
+		domain = strings.ToLower(strings.Trim(strings.TrimSpace(domain), "."))
+		if domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// matchesDomain reports whether host is one of domains or a subdomain of
+// one.
+func matchesDomain(host string, domains []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveLive proxies r to target on the live web, unmodified.
+func serveLive(w http.ResponseWriter, r *http.Request, target *url.URL) {
+	debugLog("Fetching %s live", target)
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			// A live site gets the Host the client asked it for
+			req.URL = target
+			req.Host = target.Host
+
+			// Remove headers that might interfere
+			req.Header.Del("Proxy-Connection")
+			req.Header.Del("Proxy-Authorization")
+		},
+		Transport: upstreamTransport,
+		ErrorHandler: func(rw http.ResponseWriter, req *http.Request, err error) {
+			errorLog("Error fetching %s live: %v", target, err)
+			serveErrorPage(rw, http.StatusBadGateway, target.String(), "Error fetching live page: "+err.Error())
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// liveFallbackAllowed reports whether originalURL, which has no capture, may
+// be fetched live instead with -fallback-to-live.
+func liveFallbackAllowed(originalURL string) bool {
+	if !*fallbackToLive {
+		return false
+	}
+	target, err := url.Parse(originalURL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return false
+	}
+	return len(liveFallbackDomains) == 0 || matchesDomain(target.Hostname(), liveFallbackDomains)
+}
+
+// serveLiveFallback fetches originalURL live, for -fallback-to-live, marking
+// the response so the client can tell it isn't from the archive.
+func serveLiveFallback(w http.ResponseWriter, r *http.Request, originalURL string) {
+	target, _ := url.Parse(originalURL)
+	warnLog("No capture of %s, fetching it live (-fallback-to-live)", originalURL)
+	w.Header().Set("X-Time-Surfer-Live", "true")
+	serveLive(w, r, target)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLiveFallbackAllowed(t *testing.T) {
+	setFlag(t, "fallback-to-live", "true")
+	old := liveFallbackDomains
+	defer func() { liveFallbackDomains = old }()
+
+	liveFallbackDomains = nil
+	for url, want := range map[string]bool{
+		"http://fonts.example.com/a.woff": true,
+		"https://cdn.example.net/x.js":    true,
+		"ftp://example.com/file":          false,
+		"/relative":                       false,
+	} {
+		if got := liveFallbackAllowed(url); got != want {
+			t.Errorf("liveFallbackAllowed(%s) = %v, want %v", url, got, want)
+		}
+	}
+
+	liveFallbackDomains = parseDomainList("example.com")
+	if !liveFallbackAllowed("http://fonts.example.com/a.woff") {
+		t.Error("subdomain of an allowed domain refused")
+	}
+	if liveFallbackAllowed("http://cdn.example.net/x.js") {
+		t.Error("domain outside -fallback-to-live-domains allowed")
+	}
+}
+
+// noCapturesFor answers every CDX lookup with no captures.
+func noCapturesFor(t *testing.T) {
+	newCDXServer(t, func(w http.ResponseWriter, r *http.Request) {
+		cdxRows(w)
+	})
+}
+
+func TestFallbackToLive(t *testing.T) {
+	setFlag(t, "date", "20010401")
+	setFlag(t, "fallback-to-live", "true")
+	noCapturesFor(t)
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("live font"))
+	}))
+	defer live.Close()
+
+	w := httptest.NewRecorder()
+	handleRequest(w, httptest.NewRequest("GET", live.URL+"/font.woff", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "live font" {
+		t.Fatalf("got %d %q, want the live response", w.Code, w.Body.String())
+	}
+	if w.Header().Get("X-Time-Surfer-Live") != "true" {
+		t.Error("live fallback response not marked with X-Time-Surfer-Live")
+	}
+}
+
+func TestFallbackToLiveWithoutFlag(t *testing.T) {
+	setFlag(t, "date", "20010401")
+	noCapturesFor(t)
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("live server contacted without -fallback-to-live")
+	}))
+	defer live.Close()
+
+	w := httptest.NewRecorder()
+	handleRequest(w, httptest.NewRequest("GET", live.URL+"/font.woff", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestFallbackToLiveRefusesPrivateTargets(t *testing.T) {
+	setFlag(t, "date", "20010401")
+	setFlag(t, "fallback-to-live", "true")
+	noCapturesFor(t)
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request reached the internal server: %s", r.URL)
+	}))
+	defer internal.Close()
+
+	// The CDX stand-in is on loopback too, so only the live fetch is guarded
+	addr := internal.Listener.Addr().String()
+	routeDial(t, addr, func(ctx context.Context, network string) (net.Conn, error) {
+		return nil, denyPrivateAddresses(network, addr, nil)
+	})
+
+	w := httptest.NewRecorder()
+	handleRequest(w, httptest.NewRequest("GET", internal.URL+"/latest/meta-data/", nil))
+	if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "private address refused") {
+		t.Errorf("got %d %q, want a 502 refusing the private address", w.Code, w.Body.String())
+	}
+}
+
+func TestMatchesDomain(t *testing.T) {
+	domains := parseDomainList(" Example.com., ,maps.example.net")
+	if len(domains) != 2 || domains[0] != "example.com" || domains[1] != "maps.example.net" {
+		t.Fatalf("parseDomainList = %q", domains)
+	}
+	for host, want := range map[string]bool{
+		"example.com":          true,
+		"WWW.EXAMPLE.COM.":     true,
+		"maps.example.net":     true,
+		"example.net":          false,
+		"notexample.com":       false,
+		"example.com.evil.net": false,
+	} {
+		if got := matchesDomain(host, domains); got != want {
+			t.Errorf("matchesDomain(%s) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+func TestPassthroughDomains(t *testing.T) {
+	newCDXServer(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("archive asked about a passthrough domain: %s", r.URL)
+	})
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("live " + r.URL.RequestURI()))
+	}))
+	defer live.Close()
+	old := passthroughDomains
+	passthroughDomains = parseDomainList("127.0.0.1")
+	defer func() { passthroughDomains = old }()
+
+	w := httptest.NewRecorder()
+	handleRequest(w, httptest.NewRequest("GET", live.URL+"/api?q=1", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "live /api?q=1" {
+		t.Errorf("got %d %q, want the live response", w.Code, w.Body.String())
+	}
+}
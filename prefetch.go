@@ -0,0 +1,182 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// prefetchConcurrency bounds the asset lookups -prefetch-assets runs at
+	// once, across all pages.
+	prefetchConcurrency = 4
+	// prefetchMaxAssets bounds the assets looked up for a single page.
+	prefetchMaxAssets = 50
+	// prefetchQueueLimit bounds the assets waiting to be looked up; more
+	// are not prefetched.
+	prefetchQueueLimit = 200
+	// prefetchTTL is how long a prefetched lookup is kept for the browser's
+	// request to arrive.
+	prefetchTTL = 10 * time.Minute
+)
+
+// prefetched holds the Wayback URLs -prefetch-assets resolved ahead of the
+// browser's requests, and is nil unless it is enabled.
+var prefetched *resolvedCache
+
+// prefetchJob is an asset to look up, with the key its lookup is cached
+// under.
+type prefetchJob struct {
+	asset string
+	key   string
+	date  string
+}
+
+// prefetchQueue feeds the prefetchConcurrency workers started by
+// startPrefetching, and is nil unless -prefetch-assets is enabled.
+var prefetchQueue chan prefetchJob
+
+// requestLimiter is the -max-concurrent semaphore, if any. Prefetches take
+// a slot of it at asset priority, so they only run when real requests are
+// not waiting.
+var requestLimiter *prioritySemaphore
+
+// resolvedCache is a concurrency-safe map of lookup results that expire
+// after ttl, bounded like the negative cache.
+type resolvedCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]resolvedEntry
+}
+
+type resolvedEntry struct {
+	waybackURL string
+	expires    time.Time
+}
+
+func newResolvedCache(ttl time.Duration) *resolvedCache {
+	return &resolvedCache{ttl: ttl, entries: make(map[string]resolvedEntry)}
+}
+
+// get returns the Wayback URL recorded for key, if it has not expired.
+func (c *resolvedCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return "", false
+	}
+	return entry.waybackURL, true
+}
+
+func (c *resolvedCache) put(key string, waybackURL string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if len(c.entries) >= negativeCacheMax {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= negativeCacheMax {
+			c.entries = make(map[string]resolvedEntry)
+		}
+	}
+	c.entries[key] = resolvedEntry{waybackURL: waybackURL, expires: now.Add(c.ttl)}
+}
+
+// assetAttrRe matches the attributes pages load their images, scripts,
+// stylesheets and frames with.
+var assetAttrRe = regexp.MustCompile(`(?i)\s(src|background|href)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>"']+))`)
+
+// pageAssetURLs returns the original URLs of the assets an archived page
+// embeds, unwrapping archive prefixes and resolving relative URLs against
+// the page. Links (href) are only included when they name a file with an
+// asset extension, such as a stylesheet.
+func pageAssetURLs(body string, page *pageContext) []string {
+	seen := map[string]bool{}
+	var assets []string
+	for _, m := range assetAttrRe.FindAllStringSubmatch(body, -1) {
+		value := m[2] + m[3] + m[4]
+		target := resolveAgainstPage(html.UnescapeString(value), page)
+		if target == nil {
+			continue
+		}
+		target.Fragment = ""
+		asset := target.String()
+		if seen[asset] || (strings.EqualFold(m[1], "href") && !isAssetURL(asset)) {
+			continue
+		}
+		seen[asset] = true
+		assets = append(assets, asset)
+		if len(assets) == prefetchMaxAssets {
+			break
+		}
+	}
+	return assets
+}
+
+// startPrefetching enables -prefetch-assets, starting the workers that
+// look up the assets prefetchPageAssets queues.
+func startPrefetching() {
+	prefetched = newResolvedCache(prefetchTTL)
+	prefetchQueue = make(chan prefetchJob, prefetchQueueLimit)
+	for i := 0; i < prefetchConcurrency; i++ {
+		go prefetchWorker(prefetchQueue)
+	}
+}
+
+// prefetchWorker looks up the assets from queue until it is closed.
+func prefetchWorker(queue <-chan prefetchJob) {
+	for job := range queue {
+		if requestLimiter != nil {
+			requestLimiter.acquire(priorityAsset, nil)
+		}
+		waybackURL, err := lookupWaybackURL(nil, job.asset, job.date, false)
+		if requestLimiter != nil {
+			requestLimiter.release()
+		}
+		if err != nil {
+			debugLog("Prefetching %s failed: %v", job.asset, err)
+			continue
+		}
+		debugLog("Prefetched %s as %s", job.asset, waybackURL)
+		prefetched.put(job.key, waybackURL)
+	}
+}
+
+// prefetchPageAssets queues the assets of an archived page to be resolved
+// in the background, for -prefetch-assets, so the lookups the browser's
+// requests for them need are already done when those requests arrive.
+// Assets that don't fit in the queue are left for the browser's requests
+// to look up. Prefetches never ask Save Page Now to capture anything.
+func prefetchPageAssets(body string, page *pageContext, date string) {
+	if page == nil {
+		return
+	}
+	dropped := 0
+	for _, asset := range pageAssetURLs(body, page) {
+		key := cacheKey(asset, date)
+		if _, ok := prefetched.get(key); ok {
+			continue
+		}
+		select {
+		case prefetchQueue <- prefetchJob{asset: asset, key: key, date: date}:
+		default:
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		debugLog("Not prefetching %d assets of %s, the queue is full", dropped, page.originalURL)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// usePrefetchQueue sets up -prefetch-assets with queue, and no workers,
+// for the duration of the test.
+func usePrefetchQueue(t *testing.T, queue chan prefetchJob) {
+	oldCache, oldQueue := prefetched, prefetchQueue
+	prefetched, prefetchQueue = newResolvedCache(prefetchTTL), queue
+	t.Cleanup(func() { prefetched, prefetchQueue = oldCache, oldQueue })
+}
+
+func TestPrefetchDropsAssetsWhenQueueFull(t *testing.T) {
+	queue := make(chan prefetchJob, 2)
+	usePrefetchQueue(t, queue)
+	page := newPageContext("http://web.archive.org/web/20010401000000/http://example.com/")
+
+	var body strings.Builder
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(&body, `<img src="/web/20010401000000im_/http://example.com/%d.gif">`, i)
+	}
+	prefetchPageAssets(body.String(), page, "20010401")
+
+	if len(queue) != 2 {
+		t.Fatalf("%d assets queued, want 2", len(queue))
+	}
+	if job := <-queue; job.asset != "http://example.com/0.gif" || job.date != "20010401" {
+		t.Errorf("first job = %+v", job)
+	}
+}
+
+func TestPrefetchWorkerResolvesAssets(t *testing.T) {
+	newCDXServer(t, archivedCaptures("http://example.com/logo.gif", "20010401000000"))
+	queue := make(chan prefetchJob, 1)
+	usePrefetchQueue(t, queue)
+
+	key := cacheKey("http://example.com/logo.gif", "20010401")
+	queue <- prefetchJob{asset: "http://example.com/logo.gif", key: key, date: "20010401"}
+	close(queue)
+	prefetchWorker(queue)
+
+	waybackURL, ok := prefetched.get(key)
+	if want := "http://web.archive.org/web/20010401000000/http://example.com/logo.gif"; !ok || waybackURL != want {
+		t.Errorf("prefetched %q, %v; want %q", waybackURL, ok, want)
+	}
+}
+
+func TestPrefetchWorkerResolvesEveryAssetType(t *testing.T) {
+	// The fake CDX server applies the mimetype filter, so an asset looked
+	// up as though it were a page finds nothing
+	assets := []string{"http://example.com/site.css", "http://example.com/menu.js", "http://example.com/logo.png"}
+	newCDXServer(t, capturesOf(assets...))
+	queue := make(chan prefetchJob, len(assets))
+	usePrefetchQueue(t, queue)
+
+	for _, asset := range assets {
+		queue <- prefetchJob{asset: asset, key: cacheKey(asset, "20010401"), date: "20010401"}
+	}
+	close(queue)
+	prefetchWorker(queue)
+
+	for _, asset := range assets {
+		waybackURL, ok := prefetched.get(cacheKey(asset, "20010401"))
+		if want := "http://web.archive.org/web/20010401000000/" + asset; !ok || waybackURL != want {
+			t.Errorf("%s: prefetched %q, %v; want %q", asset, waybackURL, ok, want)
+		}
+	}
+}
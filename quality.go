@@ -0,0 +1,55 @@
+package main
+
+import "math"
+
+// Status filters for CDX lookups, as regular expressions, the second one
+// escaped for the query string. With -capture-quality-filter, redirect
+// captures are candidates too, ranked below any successful one.
+const (
+	cdxStatusOK         = "200"
+	cdxStatusOKRedirect = "%5B23%5D.." // [23]..
+)
+
+// Penalties of the capture quality score, in days of distance from the
+// date: a stub counts as a capture a year further away, a redirect as one
+// ten years further away.
+const (
+	qualityStubBytes       = 2048
+	qualityStubPenalty     = 365
+	qualityRedirectPenalty = 3650
+)
+
+// captureScore rates a capture for -capture-quality-filter, the higher the
+// better. It starts from the number of days between the capture and date
+// and takes off the penalties for a redirect and for a record under
+// qualityStubBytes, which is usually an error page or a redirect stub the
+// archive recorded with status 200. A capture of unknown length isn't
+// taken for a stub.
+func captureScore(capture cdxCapture, date string) float64 {
+	var score float64
+	if delta, ok := captureDelta(date, capture.Timestamp); ok {
+		score -= math.Abs(delta.Hours()) / 24
+	}
+	if capture.Status != "" && capture.Status != "200" {
+		score -= qualityRedirectPenalty
+	}
+	if capture.Length >= 0 && capture.Length < qualityStubBytes {
+		score -= qualityStubPenalty
+	}
+	return score
+}
+
+// bestCapture returns the candidate with the highest captureScore, the
+// earliest of those tied, or nil if there are none.
+func bestCapture(rl *requestLog, candidates []cdxCapture, date string) *cdxCapture {
+	var best *cdxCapture
+	var bestScore float64
+	for i := range candidates {
+		score := captureScore(candidates[i], date)
+		rl.debug("Capture %s (status %s, %d bytes) scores %.1f", candidates[i].Timestamp, candidates[i].Status, candidates[i].Length, score)
+		if best == nil || score > bestScore {
+			best, bestScore = &candidates[i], score
+		}
+	}
+	return best
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCaptureScore(t *testing.T) {
+	for _, tc := range []struct {
+		capture cdxCapture
+		want    float64
+	}{
+		{cdxCapture{Timestamp: "20010411000000", Status: "200", Length: 5000}, -10},
+		{cdxCapture{Timestamp: "20010401000000", Status: "200", Length: 300}, -qualityStubPenalty},
+		{cdxCapture{Timestamp: "20010401000000", Status: "200", Length: -1}, 0},
+		{cdxCapture{Timestamp: "20010401000000", Status: "302", Length: 300}, -qualityRedirectPenalty - qualityStubPenalty},
+	} {
+		if got := captureScore(tc.capture, "20010401"); got != tc.want {
+			t.Errorf("captureScore(%+v) = %v, want %v", tc.capture, got, tc.want)
+		}
+	}
+}
+
+func TestBestCapture(t *testing.T) {
+	candidates := []cdxCapture{
+		{Timestamp: "20010401000000", Status: "302", Length: 5000},
+		{Timestamp: "20010402000000", Status: "200", Length: 500},
+		{Timestamp: "20010501000000", Status: "200", Length: 5000},
+		{Timestamp: "20010501000000", Status: "200", Length: 6000},
+	}
+	if best := bestCapture(nil, candidates, "20010401"); best != &candidates[2] {
+		t.Errorf("bestCapture = %+v, want the first full capture in May", best)
+	}
+	if best := bestCapture(nil, nil, "20010401"); best != nil {
+		t.Errorf("bestCapture of none = %+v", best)
+	}
+}
+
+func TestCaptureQualityFilter(t *testing.T) {
+	var filter string
+	newCDXServer(t, func(w http.ResponseWriter, r *http.Request) {
+		filter = r.URL.Query()["filter"][0]
+		w.Write([]byte(`[["timestamp","original","length","statuscode"],` +
+			`["20010401000000","http://example.com/","400","200"],` +
+			`["20010402000000","http://example.com/","5000","301"],` +
+			`["20010420000000","http://example.com/","5000","200"]]`))
+	})
+
+	for _, tc := range []struct{ enabled, filter, want string }{
+		{"false", "statuscode:200", "20010401000000"},
+		{"true", "statuscode:[23]..", "20010420000000"},
+	} {
+		setFlag(t, "capture-quality-filter", tc.enabled)
+		waybackURL, err := getWaybackURL(nil, "http://example.com/", "20010401")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "http://web.archive.org/web/" + tc.want + "/http://example.com/"; waybackURL != want {
+			t.Errorf("-capture-quality-filter=%s: getWaybackURL = %q, want %q", tc.enabled, waybackURL, want)
+		}
+		if filter != tc.filter {
+			t.Errorf("-capture-quality-filter=%s: CDX filter %q, want %q", tc.enabled, filter, tc.filter)
+		}
+	}
+}
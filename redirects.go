@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrRedirectLoop is returned when following archive redirects goes round in
+// a circle or takes too many hops.
+var ErrRedirectLoop = errors.New("redirect loop")
+
+// redirectFollower is a transport that follows some of the redirects the
+// archive answers with itself, instead of passing them to the browser, and
+// stops when the chain revisits a page or exceeds maxHops. The number of
+// redirects followed is reported in an X-Time-Surfer-Hops response header.
+type redirectFollower struct {
+	next    http.RoundTripper
+	maxHops int
+	// follow decides whether the redirect from one URL to another is followed
+	follow func(from, to string) bool
+}
+
+func (f *redirectFollower) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := req.URL
+	seen := map[string]bool{redirectPageKey(req.URL.String()): true}
+	for hops := 0; ; hops++ {
+		resp, err := f.next.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		if hops > 0 {
+			resp.Header.Set("X-Time-Surfer-Hops", strconv.Itoa(hops))
+		}
+
+		location, err := resp.Location()
+		if err != nil || resp.StatusCode < 300 || resp.StatusCode >= 400 || !f.follow(req.URL.String(), location.String()) {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		// Moving to another capture of the same page is not a loop, coming
+		// back to a page the chain has already left is
+		from, to := redirectPageKey(req.URL.String()), redirectPageKey(location.String())
+		if to != from && seen[to] || location.String() == req.URL.String() {
+			return nil, fmt.Errorf("%w: %s redirects back to %s", ErrRedirectLoop, req.URL, location)
+		}
+		if hops+1 > f.maxHops {
+			return nil, fmt.Errorf("%w: more than %d redirects from %s", ErrRedirectLoop, f.maxHops, start)
+		}
+		seen[to] = true
+		debugLog("Following archive redirect from %s to %s", req.URL, location)
+
+		req = req.Clone(req.Context())
+		req.URL = location
+		req.Host = location.Host
+	}
+}
+
+// redirectPageKey identifies the page a URL in a redirect chain is for: the
+// original URL of a Wayback URL, whatever the capture, and any other URL as
+// it is.
+func redirectPageKey(rawURL string) string {
+	if page := newPageContext(rawURL); page != nil {
+		return page.originalURL.String()
+	}
+	return rawURL
+}
+
+// isWWWRedirect reports whether an archive redirect from one Wayback URL to
+// another only adds or removes "www." on the same page, e.g. example.com to
+// www.example.com.
+func isWWWRedirect(from, to string) bool {
+	fromPage, toPage := newPageContext(from), newPageContext(to)
+	if fromPage == nil || toPage == nil {
+		return false
+	}
+	fromURL, toURL := *fromPage.originalURL, *toPage.originalURL
+	if strings.TrimPrefix(strings.ToLower(fromURL.Host), "www.") != strings.TrimPrefix(strings.ToLower(toURL.Host), "www.") {
+		return false
+	}
+	fromURL.Host, toURL.Host = "", ""
+	fromURL.Scheme, toURL.Scheme = "", ""
+	return strings.TrimSuffix(fromURL.String(), "/") == strings.TrimSuffix(toURL.String(), "/")
+}
+
+const (
+	// redirectChainWindow is how soon a client has to follow a redirect for
+	// it to count as part of the same chain.
+	redirectChainWindow = 30 * time.Second
+	// redirectChainsMax bounds the clients whose chains are tracked.
+	redirectChainsMax = 1000
+)
+
+// redirectChains tracks the redirects the browser follows itself across
+// requests, with -normalize-www-redirects, and is nil otherwise.
+var redirectChains *redirectTracker
+
+// redirectTracker detects loops in the chains of redirects each client is
+// sent, which redirectFollower can't see: a browser following a redirect
+// makes a new request, and ends up back at a page it has already been
+// redirected away from, for instance when one archive redirect adds "www."
+// and a lookup fallback for the other page takes it off again.
+type redirectTracker struct {
+	maxHops int
+
+	mu     sync.Mutex
+	chains map[string]*redirectChain
+}
+
+// redirectChain is the pages a client has been redirected through, in
+// order, as redirectPageKey identifies them, and the number of redirects,
+// which also counts those between captures of the same page.
+type redirectChain struct {
+	pages   []string
+	hops    int
+	updated time.Time
+}
+
+func newRedirectTracker(maxHops int) *redirectTracker {
+	return &redirectTracker{maxHops: maxHops, chains: make(map[string]*redirectChain)}
+}
+
+// redirected records that client, having asked for page from, is being
+// redirected to page to. A redirect that continues the client's chain from
+// its last page extends it, any other starts a new one. It returns an
+// ErrRedirectLoop if the redirect leads back to a page the chain has already
+// left, or makes it longer than maxHops.
+func (t *redirectTracker) redirected(client string, from string, to string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	chain := t.chains[client]
+	if chain == nil || now.Sub(chain.updated) > redirectChainWindow || chain.pages[len(chain.pages)-1] != from {
+		if len(t.chains) >= redirectChainsMax {
+			for c, old := range t.chains {
+				if now.Sub(old.updated) > redirectChainWindow {
+					delete(t.chains, c)
+				}
+			}
+			if len(t.chains) >= redirectChainsMax {
+				t.chains = make(map[string]*redirectChain)
+			}
+		}
+		chain = &redirectChain{pages: []string{from}}
+		t.chains[client] = chain
+	}
+
+	for _, page := range chain.pages {
+		if page == to && to != from {
+			delete(t.chains, client)
+			return fmt.Errorf("%w: %s redirects back to %s", ErrRedirectLoop, from, to)
+		}
+	}
+	if chain.hops >= t.maxHops {
+		delete(t.chains, client)
+		return fmt.Errorf("%w: more than %d redirects from %s", ErrRedirectLoop, t.maxHops, chain.pages[0])
+	}
+	chain.hops++
+	if to != from {
+		chain.pages = append(chain.pages, to)
+	}
+	chain.updated = now
+	return nil
+}
+
+// clientAddress identifies the client that sent r by its IP address.
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// loopingServer redirects /a to /b and /b back to /a.
+func loopingServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusFound)
+		case "/b":
+			http.Redirect(w, r, "/a", http.StatusFound)
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func followAll(from, to string) bool { return true }
+
+func TestRedirectFollowerDetectsLoops(t *testing.T) {
+	server := loopingServer(t)
+	client := &http.Client{
+		Transport:     &redirectFollower{next: http.DefaultTransport, maxHops: 5, follow: followAll},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	_, err := client.Get(server.URL + "/a")
+	if !errors.Is(err, ErrRedirectLoop) {
+		t.Errorf("following /a: err = %v, want a redirect loop", err)
+	}
+
+	resp, err := client.Get(server.URL + "/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Time-Surfer-Hops") != "" {
+		t.Errorf("following /c: status %d, hops %q", resp.StatusCode, resp.Header.Get("X-Time-Surfer-Hops"))
+	}
+}
+
+func TestIsWWWRedirect(t *testing.T) {
+	for _, tc := range []struct {
+		from, to string
+		want     bool
+	}{
+		{"http://web.archive.org/web/2001/http://example.com/", "http://web.archive.org/web/2001/http://www.example.com/", true},
+		{"http://web.archive.org/web/2001/http://www.example.com/a", "http://web.archive.org/web/2002/https://example.com/a/", true},
+		{"http://web.archive.org/web/2001/http://example.com/", "http://web.archive.org/web/2001/http://www.example.com/other", false},
+		{"http://web.archive.org/web/2001/http://example.com/", "http://web.archive.org/web/2001/http://example.org/", false},
+	} {
+		if got := isWWWRedirect(tc.from, tc.to); got != tc.want {
+			t.Errorf("isWWWRedirect(%s, %s) = %v, want %v", tc.from, tc.to, got, tc.want)
+		}
+	}
+}
+
+func TestRedirectTrackerDetectsLoopsAcrossRequests(t *testing.T) {
+	tracker := newRedirectTracker(5)
+
+	// The browser is sent from example.com to www.example.com and back
+	if err := tracker.redirected("10.0.0.1", "http://example.com/", "http://www.example.com/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.redirected("10.0.0.2", "http://www.example.com/", "http://example.com/"); err != nil {
+		t.Errorf("another client's redirect: %v", err)
+	}
+	if err := tracker.redirected("10.0.0.1", "http://www.example.com/", "http://example.com/"); !errors.Is(err, ErrRedirectLoop) {
+		t.Errorf("redirect back: err = %v, want a redirect loop", err)
+	}
+
+	// A fresh chain, once the loop has been reported
+	if err := tracker.redirected("10.0.0.1", "http://www.example.com/", "http://example.com/"); err != nil {
+		t.Errorf("new chain: %v", err)
+	}
+}
+
+func TestRedirectTrackerLimitsChains(t *testing.T) {
+	tracker := newRedirectTracker(3)
+	pages := []string{"http://example.com/1", "http://example.com/2", "http://example.com/3", "http://example.com/4", "http://example.com/5"}
+	for i := 0; i < 3; i++ {
+		if err := tracker.redirected("10.0.0.1", pages[i], pages[i+1]); err != nil {
+			t.Fatalf("hop %d: %v", i+1, err)
+		}
+	}
+	if err := tracker.redirected("10.0.0.1", pages[3], pages[4]); !errors.Is(err, ErrRedirectLoop) {
+		t.Errorf("hop 4: err = %v, want a redirect loop", err)
+	}
+
+	// Redirects not continuing the chain start another
+	tracker.redirected("10.0.0.1", pages[0], pages[1])
+	if err := tracker.redirected("10.0.0.1", pages[3], pages[4]); err != nil {
+		t.Errorf("unrelated redirect: %v", err)
+	}
+}
+
+// serveCaptureRedirects has the archive answer Wayback URLs with the
+// redirects in redirects, keyed by path, and anything else with a page.
+func serveCaptureRedirects(t *testing.T, redirects map[string]string) {
+	newArchiveServer(t, func(w http.ResponseWriter, r *http.Request) {
+		// Set directly, as http.Redirect would clean the "//" out of the
+		// original URLs
+		if to, ok := redirects[r.URL.Path]; ok {
+			w.Header().Set("Location", to)
+			w.WriteHeader(http.StatusFound)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+}
+
+func TestRedirectFollowerComparesPages(t *testing.T) {
+	serveCaptureRedirects(t, map[string]string{
+		// Another capture of the same page
+		"/web/2001/http://example.com/a": "/web/2002/http://example.com/a",
+		// Back to example.com, with a new timestamp each time
+		"/web/2001/http://example.com/":     "/web/2002/http://www.example.com/",
+		"/web/2002/http://www.example.com/": "/web/2003/http://example.com/",
+		"/web/2003/http://example.com/":     "/web/2004/http://www.example.com/",
+	})
+	client := &http.Client{
+		Transport:     &redirectFollower{next: upstreamTransport, maxHops: 5, follow: followAll},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	resp, err := client.Get("http://web.archive.org/web/2001/http://example.com/a")
+	if err != nil {
+		t.Fatalf("another capture: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Time-Surfer-Hops") != "1" {
+		t.Errorf("another capture: status %d, hops %q", resp.StatusCode, resp.Header.Get("X-Time-Surfer-Hops"))
+	}
+
+	if _, err := client.Get("http://web.archive.org/web/2001/http://example.com/"); !errors.Is(err, ErrRedirectLoop) {
+		t.Errorf("back to example.com: err = %v, want a redirect loop", err)
+	}
+}
+
+func TestRedirectFollowerLimitsHops(t *testing.T) {
+	serveCaptureRedirects(t, map[string]string{
+		"/web/2001/http://example.com/1": "/web/2001/http://example.com/2",
+		"/web/2001/http://example.com/2": "/web/2001/http://example.com/3",
+		"/web/2001/http://example.com/3": "/web/2001/http://example.com/4",
+	})
+	for _, tc := range []struct {
+		maxHops int
+		loop    bool
+	}{
+		{2, true},
+		{3, false},
+	} {
+		client := &http.Client{
+			Transport:     &redirectFollower{next: upstreamTransport, maxHops: tc.maxHops, follow: followAll},
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+		resp, err := client.Get("http://web.archive.org/web/2001/http://example.com/1")
+		if tc.loop {
+			if !errors.Is(err, ErrRedirectLoop) {
+				t.Errorf("%d hops allowed: err = %v, want a redirect loop", tc.maxHops, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d hops allowed: %v", tc.maxHops, err)
+		}
+		resp.Body.Close()
+		if resp.Header.Get("X-Time-Surfer-Hops") != "3" {
+			t.Errorf("%d hops allowed: hops %q, want 3", tc.maxHops, resp.Header.Get("X-Time-Surfer-Hops"))
+		}
+	}
+}
+
+func TestWWWRedirectLoopAnswered508(t *testing.T) {
+	setFlag(t, "normalize-www-redirects", "true")
+	setFlag(t, "max-upstream-redirects", "5")
+	serveArchivedPage(t, "http://example.com/", "20010401000000", func(w http.ResponseWriter, r *http.Request) {
+		// The archive sends example.com to www.example.com and back, naming
+		// a different capture each time
+		if strings.Contains(r.URL.Path, "www.example.com") {
+			http.Redirect(w, r, "http://web.archive.org/web/20020101000000/http://example.com/", http.StatusFound)
+		} else {
+			http.Redirect(w, r, "http://web.archive.org/web/20030101000000/http://www.example.com/", http.StatusFound)
+		}
+	})
+
+	w := httptest.NewRecorder()
+	handleRequest(w, httptest.NewRequest("GET", "http://example.com/", nil))
+	if w.Code != http.StatusLoopDetected {
+		t.Errorf("status %d, want %d", w.Code, http.StatusLoopDetected)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// resolveBatchConcurrency is how many lookups -resolve-batch runs at once.
+const resolveBatchConcurrency = 4
+
+// batchResult is the outcome of resolving one URL from a -resolve-batch
+// file. WaybackURL and Timestamp are empty for a URL with no capture, and
+// Error says why.
+type batchResult struct {
+	URL        string `json:"url"`
+	WaybackURL string `json:"waybackURL,omitempty"`
+	Timestamp  string `json:"timestamp,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// runResolveBatch resolves every URL listed in inputPath, one per line, at
+// date and writes the results to outputPath, or stdout if it is empty. The
+// output is CSV if outputPath ends in .csv and JSON otherwise. A path of -
+// reads the URLs from stdin. Blank lines and lines starting with # are
+// skipped.
+func runResolveBatch(inputPath string, outputPath string, date string) error {
+	urls, err := readURLList(inputPath)
+	if err != nil {
+		return err
+	}
+
+	results := make([]batchResult, len(urls))
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, resolveBatchConcurrency)
+	for i, originalURL := range urls {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, originalURL string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			results[i] = resolveBatchURL(originalURL, date)
+		}(i, originalURL)
+	}
+	wg.Wait()
+
+	out := io.Writer(os.Stdout)
+	if outputPath != "" {
+		f, err := os.Create(outputPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	found := 0
+	for _, result := range results {
+		if result.WaybackURL != "" {
+			found++
+		}
+	}
+	infoLog("Resolved %d of %d URLs for %s", found, len(results), date)
+
+	if strings.HasSuffix(strings.ToLower(outputPath), ".csv") {
+		return writeBatchCSV(out, results)
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(results)
+}
+
+func resolveBatchURL(originalURL string, date string) batchResult {
+	result := batchResult{URL: originalURL}
+	if !strings.HasPrefix(originalURL, "http://") && !strings.HasPrefix(originalURL, "https://") {
+		originalURL = "http://" + originalURL
+	}
+	waybackURL, err := getWaybackURL(nil, originalURL, date)
+	if err != nil {
+		if !errors.Is(err, ErrNoCapture) {
+			warnLog("Error resolving %s: %v", originalURL, err)
+		}
+		result.Error = err.Error()
+		return result
+	}
+	result.WaybackURL = waybackURL
+	if ref, ok := parseWaybackURL(waybackURL); ok {
+		result.Timestamp = ref.Timestamp
+	}
+	return result
+}
+
+func readURLList(path string) ([]string, error) {
+	in := io.Reader(os.Stdin)
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var urls []string
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+	return urls, scanner.Err()
+}
+
+func writeBatchCSV(out io.Writer, results []batchResult) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"url", "wayback_url", "timestamp", "error"})
+	for _, result := range results {
+		w.Write([]string{result.URL, result.WaybackURL, result.Timestamp, result.Error})
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,580 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// pageContext describes the archived page whose body is being modified.
+type pageContext struct {
+	originalURL *url.URL // the page's URL on the original site
+	timestamp   string   // the capture's Wayback timestamp
+	// localBase is put in front of links rewritten to come back through the
+	// proxy; empty for browsers using it as a proxy, see localBaseFor
+	localBase string
+}
+
+// newPageContext describes the page served from waybackURL.
+func newPageContext(waybackURL string) *pageContext {
+	ref, ok := parseWaybackURL(waybackURL)
+	if !ok {
+		return nil
+	}
+	original, err := url.Parse(ref.Original)
+	if err != nil {
+		return nil
+	}
+	// The archive also accepts original URLs without a scheme
+	if original.Host == "" {
+		if original, err = url.Parse("http://" + strings.TrimLeft(ref.Original, "/")); err != nil || original.Host == "" {
+			return nil
+		}
+	}
+	return &pageContext{originalURL: original, timestamp: ref.Timestamp}
+}
+
+// proxyLocalURL returns the URL the browser should use to fetch target
+// through the proxy: the plain http:// URL, the only kind a browser sends
+// through an HTTP proxy, and what goes after the local base for clients
+// addressing it directly.
+func proxyLocalURL(target *url.URL) string {
+	local := *target
+	local.Scheme = "http"
+	return local.String()
+}
+
+// localBaseFor returns what links and redirects sent in answer to r are
+// prefixed with to come back through the proxy. Browsers using the proxy as
+// a proxy simply request the original URLs, so for them it is empty.
+// Clients addressing the proxy directly, for instance through a front end,
+// request the original URL as a path under the proxy's public base URL:
+// -external-url, or else the Host they used followed by -path-prefix.
+func localBaseFor(r *http.Request) string {
+	if r.URL.IsAbs() {
+		return ""
+	}
+	if *externalURL != "" {
+		return strings.TrimSuffix(*externalURL, "/") + "/"
+	}
+	return clientScheme() + "://" + r.Host + pathPrefix + "/"
+}
+
+// base returns the page's localBase; a nil page has none.
+func (page *pageContext) base() string {
+	if page == nil {
+		return ""
+	}
+	return page.localBase
+}
+
+// upgradesInsecureLinks reports whether the plain http:// links the archive
+// left in the page are sent through the proxy, for -block-mixed-content.
+// Only a page served under an https:// local base makes them mixed content;
+// pages browsers fetch through the proxy as a proxy keep their own http://
+// origin.
+func (page *pageContext) upgradesInsecureLinks() bool {
+	return *blockMixedContent && strings.HasPrefix(page.base(), "https://")
+}
+
+// redirectLocation returns the Location of a redirect the proxy itself sends
+// to target in answer to r.
+func redirectLocation(r *http.Request, target *url.URL) string {
+	return localBaseFor(r) + proxyLocalURL(target)
+}
+
+// pathEncodedTarget returns the URL a client addressing the proxy directly
+// asked for as a path, e.g. http://example.com/ for /http://example.com/.
+func pathEncodedTarget(r *http.Request) (string, bool) {
+	if r.URL.IsAbs() {
+		return "", false
+	}
+	target := strings.TrimPrefix(r.RequestURI, "/")
+	if *reverseRewriteEnabled {
+		target = reverseRewrite(r, target)
+	}
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		return target, true
+	}
+	return "", false
+}
+
+// reverseRewrite undoes the ways proxy-local URLs get mangled on their way
+// back from rewritten pages, for -reverse-rewrite. Scripts and forms build
+// request URLs out of links the rewriter produced, so a URL can come back
+// with the local base in front of it a second time, percent-encoded as a
+// single parameter, or with the "//" after its scheme collapsed to "/" by a
+// front end that cleans up paths.
+func reverseRewrite(r *http.Request, target string) string {
+	var bases []string
+	if *externalURL != "" {
+		bases = append(bases, strings.TrimSuffix(*externalURL, "/")+"/")
+	}
+	// An absolute-form request's Host is the site's, not the proxy's
+	if !r.URL.IsAbs() {
+		bases = append(bases, "http://"+r.Host+pathPrefix+"/", "https://"+r.Host+pathPrefix+"/")
+	}
+
+	// Each pass peels off one layer, so nested forms need a few at most
+	for i := 0; i < 4; i++ {
+		unwrapped := target
+		lower := strings.ToLower(unwrapped)
+		if strings.HasPrefix(lower, "http%3a") || strings.HasPrefix(lower, "https%3a") {
+			if decoded, err := url.PathUnescape(unwrapped); err == nil {
+				unwrapped = decoded
+			}
+		}
+		unwrapped = restoreSchemeSlashes(unwrapped)
+		for _, base := range bases {
+			if strings.HasPrefix(unwrapped, base) && encodesURL(unwrapped[len(base):]) {
+				unwrapped = unwrapped[len(base):]
+				break
+			}
+		}
+		if unwrapped == target {
+			break
+		}
+		target = unwrapped
+	}
+	return target
+}
+
+// encodesURL reports whether target is a URL in one of the forms
+// reverseRewrite understands.
+func encodesURL(target string) bool {
+	lower := strings.ToLower(target)
+	for _, prefix := range []string{"http:/", "https:/", "http%3a", "https%3a"} {
+		if strings.HasPrefix(lower, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreSchemeSlashes turns http:/example.com/ back into http://example.com/.
+func restoreSchemeSlashes(target string) string {
+	for _, scheme := range []string{"http:/", "https:/"} {
+		if strings.HasPrefix(target, scheme) && !strings.HasPrefix(target, scheme+"/") {
+			return scheme + "/" + target[len(scheme):]
+		}
+	}
+	return target
+}
+
+// clientScheme is the scheme of the local base clients addressing the proxy
+// directly reach it with: plain http, or https with -block-mixed-content,
+// when they talk to it over HTTPS and http:// subresources would be blocked.
+func clientScheme() string {
+	if *blockMixedContent {
+		return "https"
+	}
+	return "http"
+}
+
+// archiveLinkRe matches the prefix the Wayback Machine puts in front of the
+// links in the pages it serves, whether absolute (http://web.archive.org/web/
+// TIMESTAMP/), protocol-relative (//web.archive.org/web/TIMESTAMP/) or root
+// relative (/web/TIMESTAMP/), together with the scheme of the wrapped URL.
+// The prefix must follow a quote, parenthesis, equals sign or whitespace so
+// that ordinary paths which happen to contain /web/ are left alone.
+var archiveLinkRe = regexp.MustCompile(`(["'(=\s])(?:(?:https?:)?//web\.archive\.org)?/web/\d{1,14}(?:` + waybackModifierPattern + `)?/(?:https?:)?//`)
+
+// archiveOtherSchemeRe matches an archive prefix in front of a link with a
+// scheme other than http(s), such as mailto: or ftp://. The archive does not
+// hold anything at these URLs, so the prefix is dropped to restore the link
+// as the original page had it.
+var archiveOtherSchemeRe = regexp.MustCompile(`(?i)(["'(=\s])(?:(?:https?:)?//web\.archive\.org)?/web/\d{1,14}(?:` + waybackModifierPattern + `)?/((?:mailto|news|ftp|gopher|telnet|wais):)`)
+
+// protocolRelativeAttrRe and protocolRelativeCSSRe match protocol-relative
+// URLs (//host/path) in link attributes and CSS url() values, and
+// insecureAttrRe and insecureCSSRe match plain http:// URLs in the same
+// places.
+var (
+	protocolRelativeAttrRe = regexp.MustCompile(`(?i)(\s(?:href|src|action|background|data|poster|longdesc|codebase|cite)\s*=\s*["']?)//([^/\s"'>])`)
+	protocolRelativeCSSRe  = regexp.MustCompile(`(?i)(url\(\s*["']?)//([^/\s"')])`)
+	insecureAttrRe         = regexp.MustCompile(`(?i)(\s(?:href|src|action|background|data|poster|longdesc|codebase|cite)\s*=\s*["']?)http://`)
+	insecureCSSRe          = regexp.MustCompile(`(?i)(url\(\s*["']?)http://`)
+)
+
+// snapshotParam is the query parameter, holding a Wayback timestamp, that
+// -same-snapshot-assets adds to the asset links of archived pages, so that
+// each asset is fetched from the page's snapshot instead of being looked up.
+const snapshotParam = "__ts"
+
+// archiveAssetLinkRe matches an archive link to an embedded asset, which the
+// archive marks with the im_, js_, cs_ or oe_ modifier, capturing the
+// timestamp and everything after the prefix.
+var archiveAssetLinkRe = regexp.MustCompile(`(["'(=\s](?:(?:https?:)?//web\.archive\.org)?/web/(\d{1,14})(?:im_|js_|cs_|oe_)/)((?:https?:)?//[^"'\s()<>]+)`)
+
+// pinAssetLinks adds a snapshotParam with the link's timestamp, which the
+// archive sets to the page's own, to each asset link in body, ahead of any
+// fragment, e.g. /web/20010401im_/http://example.com/logo.gif becomes
+// /web/20010401im_/http://example.com/logo.gif?__ts=20010401.
+func pinAssetLinks(body string, budget *rewriteBudget) string {
+	return budget.replaceAllStringFunc(archiveAssetLinkRe, body, func(link string) string {
+		m := archiveAssetLinkRe.FindStringSubmatch(link)
+		target, fragment := m[3], ""
+		if i := strings.IndexByte(target, '#'); i >= 0 {
+			target, fragment = target[:i], target[i:]
+		}
+		separator := "?"
+		if strings.Contains(target, "?") {
+			separator = "&"
+		}
+		return m[1] + target + separator + snapshotParam + "=" + m[2] + fragment
+	})
+}
+
+// timestampRe matches a Wayback timestamp.
+var timestampRe = regexp.MustCompile(`^\d{1,14}$`)
+
+// pinnedSnapshotURL reports whether originalURL carries a snapshotParam, and
+// if so returns the Wayback URL of the snapshot it names for the URL without
+// the parameter.
+func pinnedSnapshotURL(originalURL string) (string, bool) {
+	u, err := url.Parse(originalURL)
+	if err != nil || !u.IsAbs() || u.RawQuery == "" {
+		return "", false
+	}
+	var timestamp string
+	var kept []string
+	for _, pair := range strings.Split(u.RawQuery, "&") {
+		if value := strings.TrimPrefix(pair, snapshotParam+"="); value != pair && timestampRe.MatchString(value) {
+			timestamp = value
+			continue
+		}
+		kept = append(kept, pair)
+	}
+	if timestamp == "" {
+		return "", false
+	}
+	u.RawQuery = strings.Join(kept, "&")
+	return formatWaybackURL(timestamp, u.String()), true
+}
+
+// rewriteLinks points the links in an archived page back at the original
+// URLs so the browser requests them through the proxy, which resolves each
+// one against the archive at the configured date. Links are rewritten to
+// plain http:// because that is the only scheme the browser will send
+// through an HTTP proxy, behind the local base if there is one. With
+// -same-snapshot-assets, asset links keep the page's timestamp.
+func rewriteLinks(body string, page *pageContext, budget *rewriteBudget) string {
+	scheme := page.base() + "http"
+	if *sameSnapshotAssets {
+		body = pinAssetLinks(body, budget)
+	}
+	body = budget.replaceAllString(archiveLinkRe, body, "${1}"+scheme+"://")
+	body = budget.replaceAllString(archiveOtherSchemeRe, body, "${1}${2}")
+
+	// Protocol-relative URLs would otherwise take the scheme of the page
+	body = budget.replaceAllString(protocolRelativeAttrRe, body, "${1}"+scheme+"://${2}")
+	body = budget.replaceAllString(protocolRelativeCSSRe, body, "${1}"+scheme+"://${2}")
+
+	// Links the page had as plain http:// would be mixed content
+	if page.upgradesInsecureLinks() {
+		body = budget.replaceAllString(insecureAttrRe, body, "${1}"+page.base()+"http://")
+		body = budget.replaceAllString(insecureCSSRe, body, "${1}"+page.base()+"http://")
+	}
+
+	return body
+}
+
+// rootRelativeArchiveLinkRe matches the root-relative archive links
+// (/web/TIMESTAMP/...) in the pages the archive serves.
+var rootRelativeArchiveLinkRe = regexp.MustCompile(`(["'(=\s])/web/(\d{1,14}(?:` + waybackModifierPattern + `)?/)`)
+
+// absoluteArchiveLinks is what -preserve-wayback-links does instead of
+// rewriteLinks: the archive's links are kept, but made absolute, so that
+// following one leads to the Wayback Machine rather than to /web/ on the
+// archived site's host.
+func absoluteArchiveLinks(body string, budget *rewriteBudget) string {
+	return budget.replaceAllString(rootRelativeArchiveLinkRe, body, "${1}https://web.archive.org/web/${2}")
+}
+
+// Ways of handling ftp:// and gopher:// links, selected with -ftp-gopher-links.
+const (
+	ftpGopherKeep     = "keep"
+	ftpGopherStrip    = "strip"
+	ftpGopherAnnotate = "annotate"
+)
+
+// ftpGopherHrefRe matches an href attribute pointing at an ftp:// or
+// gopher:// URL, quoted or not.
+var ftpGopherHrefRe = regexp.MustCompile(`(?i)\shref\s*=\s*(?:"((?:ftp|gopher)://[^"]*)"|'((?:ftp|gopher)://[^']*)'|((?:ftp|gopher)://[^\s>"']*))`)
+
+// rewriteFTPGopherLinks handles links to ftp:// and gopher:// servers, which
+// have mostly disappeared and are not in the archive. With "strip" the link
+// is removed, leaving its text; with "annotate" it is kept but given a title
+// saying it probably no longer works.
+func rewriteFTPGopherLinks(body string, mode string, budget *rewriteBudget) string {
+	switch mode {
+	case ftpGopherStrip:
+		return budget.replaceAllString(ftpGopherHrefRe, body, "")
+	case ftpGopherAnnotate:
+		return budget.replaceAllStringFunc(ftpGopherHrefRe, body, func(attr string) string {
+			scheme := "ftp"
+			if strings.Contains(strings.ToLower(attr), "gopher://") {
+				scheme = "gopher"
+			}
+			return attr + ` title="This ` + scheme + ` link is not archived and probably no longer works"`
+		})
+	}
+	return body
+}
+
+// rewriteCSS does the same for the url() references in a stylesheet.
+func rewriteCSS(body string, page *pageContext, budget *rewriteBudget) string {
+	scheme := page.base() + "http"
+	body = budget.replaceAllString(archiveLinkRe, body, "${1}"+scheme+"://")
+	body = budget.replaceAllString(protocolRelativeCSSRe, body, "${1}"+scheme+"://${2}")
+	if page.upgradesInsecureLinks() {
+		body = budget.replaceAllString(insecureCSSRe, body, "${1}"+page.base()+"http://")
+	}
+
+	return body
+}
+
+// linkHostPattern matches the host of an absolute URL, which is followed by
+// its port, if any, and then the rest of the URL or the end of the value.
+const linkHostPattern = `([^/?#"'\s:<>()\\]+)(:\d+)?`
+
+// scriptURLRe matches a string literal in a script that starts with an
+// absolute URL, possibly behind an archive prefix, capturing the quote, the
+// host, the port and what follows them.
+var scriptURLRe = regexp.MustCompile(`(?i)(["'])(?:(?:https?:)?//web\.archive\.org)?(?:/web/\d{1,14}(?:` + waybackModifierPattern + `)?/)?(?:https?:)?//` + linkHostPattern + `([/?#"'])`)
+
+// rewriteScriptURLs points string literals in a script that hold absolute URLs
+// on the script's own host, such as "http://oldsite.com/cgi-bin/data", back
+// through the proxy, unwrapping archive prefixes the archive added. URLs on
+// other hosts, and URLs the script builds from pieces, are left alone:
+// rewriting code is guesswork, so this only touches the safest case.
+func rewriteScriptURLs(body string, page *pageContext, budget *rewriteBudget) string {
+	return rewriteSameHost(scriptURLRe, body, page, budget)
+}
+
+// linkAttrPattern matches the start of a link attribute's value, as in
+// protocolRelativeAttrRe, and of a CSS url() value.
+const linkAttrPattern = `(?i)((?:\s(?:href|src|action|background|data|poster|longdesc|codebase|cite)\s*=\s*["']?)|(?:url\(\s*["']?))`
+
+// absoluteLinkRe matches a link attribute or CSS url() value holding an
+// absolute or protocol-relative URL, capturing the start of the value, the
+// host, the port and what follows them.
+var absoluteLinkRe = regexp.MustCompile(linkAttrPattern + `(?:https?:)?//` + linkHostPattern + `([/?#"'\s>)]|$)`)
+
+// rewriteSameHostLinks points plain absolute links to the page's own host,
+// such as http://www.example.com/other on a page of www.example.com, back
+// through the proxy, for -rewrite-absolute-same-host. Links to any other
+// host are left alone.
+func rewriteSameHostLinks(body string, page *pageContext, budget *rewriteBudget) string {
+	return rewriteSameHost(absoluteLinkRe, body, page, budget)
+}
+
+// rewriteSameHost points the URLs re matches in body that are on the page's
+// own host back through the proxy. re captures what comes before the URL,
+// its host, its port and what follows them.
+func rewriteSameHost(re *regexp.Regexp, body string, page *pageContext, budget *rewriteBudget) string {
+	if page == nil || page.originalURL.Hostname() == "" {
+		return body
+	}
+	host := page.originalURL.Hostname()
+	return budget.replaceAllStringFunc(re, body, func(link string) string {
+		m := re.FindStringSubmatch(link)
+		if !strings.EqualFold(m[2], host) {
+			return link
+		}
+		return m[1] + page.base() + "http://" + m[2] + m[3] + m[4]
+	})
+}
+
+// baseHrefRe matches the href attribute of a base element, quoted or not.
+var baseHrefRe = regexp.MustCompile(`(?i)(<base\b[^>]*\shref\s*=\s*)(?:"([^"]*)"|'([^']*)'|([^\s>"']+))`)
+
+// anchorBaseElement points a page's base element at the page itself, for
+// -rewrite-anchor-base, if the base names the directory the page is in, as
+// in <base href="http://example.com/"> on http://example.com/faq.html.
+// Browsers resolve fragment-only links like href="#top" against the base
+// URL, so following one loaded the base URL instead of scrolling. Relative
+// links resolve against the same directory either way, and the links
+// themselves are left alone. A base naming another directory or host is
+// kept, since the page's relative links depend on it.
+func anchorBaseElement(body string, page *pageContext) string {
+	if page == nil {
+		return body
+	}
+	loc := baseHrefRe.FindStringSubmatchIndex(body)
+	if loc == nil {
+		return body
+	}
+	m := baseHrefRe.FindStringSubmatch(body[loc[0]:loc[1]])
+	value := html.UnescapeString(m[2] + m[3] + m[4])
+	if page.base() != "" {
+		value = strings.TrimPrefix(value, page.base())
+	}
+	base := resolveAgainstPage(value, page)
+	document := *page.originalURL
+	document.Fragment = ""
+	if base == nil || !strings.EqualFold(base.Host, document.Host) || base.RawQuery != "" || directoryOf(base.Path) != directoryOf(document.Path) {
+		return body
+	}
+	return body[:loc[0]] + m[1] + `"` + html.EscapeString(page.base()+proxyLocalURL(&document)) + `"` + body[loc[1]:]
+}
+
+// directoryOf returns the directory part of a URL path, up to and including
+// its last slash; an empty path is the root.
+func directoryOf(urlPath string) string {
+	if urlPath == "" {
+		return "/"
+	}
+	return urlPath[:strings.LastIndex(urlPath, "/")+1]
+}
+
+var (
+	formTagRe    = regexp.MustCompile(`(?i)<form\b[^>]*>`)
+	formActionRe = regexp.MustCompile(`(?i)(\saction\s*=\s*)(?:"([^"]*)"|'([^']*)'|([^\s>"']+))`)
+)
+
+var (
+	// resourceTagRe matches the tags Subresource Integrity applies to.
+	resourceTagRe = regexp.MustCompile(`(?i)<(?:script|link)\b[^>]*>`)
+	// integrityAttrRe matches an integrity or crossorigin attribute, with or
+	// without a value.
+	integrityAttrRe = regexp.MustCompile(`(?i)\s(?:integrity|crossorigin)(?:\s*=\s*(?:"[^"]*"|'[^']*'|[^\s>"']+))?`)
+)
+
+// stripIntegrityAttrs removes integrity and crossorigin attributes from the
+// script and link tags in body. Assets served through the proxy come from a
+// capture and are often rewritten themselves, so they rarely match the hash
+// the page was published with, and browsers refuse to load them when they
+// don't. crossorigin goes too, since the proxy sends no CORS headers.
+func stripIntegrityAttrs(body string, budget *rewriteBudget) string {
+	return budget.replaceAllStringFunc(resourceTagRe, body, func(tag string) string {
+		return integrityAttrRe.ReplaceAllString(tag, "")
+	})
+}
+
+// -post-forms modes.
+const (
+	postFormsKeep    = "keep"
+	postFormsGet     = "get"
+	postFormsDisable = "disable"
+)
+
+var (
+	formElementRe    = regexp.MustCompile(`(?is)(<form\b[^>]*>)(.*?)(?:</form\s*>|$)`)
+	formMethodRe     = regexp.MustCompile(`(?i)\smethod\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>"']+))`)
+	formEnctypeRe    = regexp.MustCompile(`(?i)\senctype\s*=\s*(?:"[^"]*"|'[^']*'|[^\s>"']+)`)
+	unsafeGetFieldRe = regexp.MustCompile(`(?i)<input\b[^>]*\stype\s*=\s*["']?(?:password|file)\b`)
+)
+
+// disabledFormTitle is the tooltip of a form -post-forms has disabled.
+const disabledFormTitle = "This form sent its data with POST, which the Wayback Machine did not archive, so it cannot be submitted"
+
+// rewritePostForms handles the POST forms in body for -post-forms. The
+// archive only holds what was fetched with GET, so a POST submission can
+// only ever fail. With get, a form is turned into a GET form, whose query
+// URL can then be looked up like any other; forms with password or file
+// fields are disabled instead, since their contents would end up in the
+// URL, or could not be sent in one at all. With disable, every POST form
+// is disabled: submitting it does nothing, and hovering over it says why.
+func rewritePostForms(body string, mode string, budget *rewriteBudget) string {
+	return budget.replaceAllStringFunc(formElementRe, body, func(element string) string {
+		m := formElementRe.FindStringSubmatchIndex(element)
+		tag := element[m[2]:m[3]]
+		method := formMethodRe.FindStringSubmatch(tag)
+		if method == nil || !strings.EqualFold(strings.TrimSpace(method[1]+method[2]+method[3]), "post") {
+			return element
+		}
+
+		if mode == postFormsGet && !unsafeGetFieldRe.MatchString(element[m[3]:]) {
+			tag = formMethodRe.ReplaceAllString(tag, ` method="get"`)
+			tag = formEnctypeRe.ReplaceAllString(tag, "")
+		} else {
+			// Ahead of the form's own attributes, as the first of a repeated
+			// attribute is the one that counts
+			tag = tag[:len("<form")] + ` onsubmit="return false" title="` + html.EscapeString(disabledFormTitle) + `"` + tag[len("<form"):]
+		}
+		return tag + element[m[3]:]
+	})
+}
+
+// rewriteFormActions points form actions back through the proxy, resolving
+// relative and archive-prefixed actions against the page's original URL, so
+// that submitting an archived search form is resolved at the configured date.
+func rewriteFormActions(body string, page *pageContext, budget *rewriteBudget) string {
+	if page == nil {
+		return body
+	}
+	if *postForms != postFormsKeep {
+		body = rewritePostForms(body, *postForms, budget)
+	}
+
+	return budget.replaceAllStringFunc(formTagRe, body, func(tag string) string {
+		m := formActionRe.FindStringSubmatchIndex(tag)
+		if m == nil {
+			return tag
+		}
+
+		var value string
+		for group := 2; group <= 4; group++ {
+			if m[2*group] != -1 {
+				value = tag[m[2*group]:m[2*group+1]]
+				break
+			}
+		}
+
+		action := resolveAgainstPage(html.UnescapeString(value), page)
+		if action == nil {
+			return tag
+		}
+		return tag[:m[3]] + `"` + html.EscapeString(page.base()+proxyLocalURL(action)) + `"` + tag[m[1]:]
+	})
+}
+
+// resolveAgainstPage resolves a URL found in a page to an absolute URL on the
+// original site, unwrapping archive prefixes. It returns nil for anything
+// that is not an http(s) URL.
+func resolveAgainstPage(value string, page *pageContext) *url.URL {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+
+	if inner := newPageContext(value); inner != nil {
+		return inner.originalURL
+	}
+
+	ref, err := url.Parse(value)
+	if err != nil {
+		return nil
+	}
+	resolved := page.originalURL.ResolveReference(ref)
+	if resolved.Scheme != "http" && resolved.Scheme != "https" {
+		return nil
+	}
+	return resolved
+}
+
+var (
+	// crawlRedirectRe identifies the page the archive shows in place of a
+	// capture that was a redirect at crawl time.
+	crawlRedirectRe = regexp.MustCompile(`Got an HTTP 30\d response at crawl time`)
+	// crawlRedirectLinkRe finds that page's "Impatient?" link to the capture
+	// of the redirect target.
+	crawlRedirectLinkRe = regexp.MustCompile(`(?is)class=["']impatient["'][^>]*>\s*<a\b[^>]*\bhref=["']([^"']+)["']`)
+)
+
+// crawlRedirectTarget returns the original URL a crawl-time redirect page
+// points to, if body is such a page.
+func crawlRedirectTarget(body string, page *pageContext) (*url.URL, bool) {
+	if page == nil || !crawlRedirectRe.MatchString(body) {
+		return nil, false
+	}
+	m := crawlRedirectLinkRe.FindStringSubmatch(body)
+	if m == nil {
+		return nil, false
+	}
+	target := resolveAgainstPage(html.UnescapeString(m[1]), page)
+	return target, target != nil
+}
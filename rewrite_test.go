@@ -0,0 +1,474 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const mixedContentPage = `<img src="/web/20010401000000im_/http://example.com/a.gif"><img src="http://other.example/b.gif"><a href="//example.com/c.html">c</a>`
+
+func TestBlockMixedContent(t *testing.T) {
+	setFlag(t, "block-mixed-content", "true")
+	page := newPageContext("http://web.archive.org/web/20010401000000/http://example.com/")
+
+	// Browsers using the proxy as a proxy can't reach https:// URLs through it
+	want := `<img src="http://example.com/a.gif"><img src="http://other.example/b.gif"><a href="http://example.com/c.html">c</a>`
+	if got := rewriteLinks(mixedContentPage, page, nil); got != want {
+		t.Errorf("as a proxy:\n got %s\nwant %s", got, want)
+	}
+
+	page.localBase = "https://proxy.example/"
+	want = `<img src="https://proxy.example/http://example.com/a.gif"><img src="https://proxy.example/http://other.example/b.gif"><a href="https://proxy.example/http://example.com/c.html">c</a>`
+	if got := rewriteLinks(mixedContentPage, page, nil); got != want {
+		t.Errorf("behind an https:// base:\n got %s\nwant %s", got, want)
+	}
+
+	css := `a { background: url(http://other.example/bg.gif) }`
+	if got, want := rewriteCSS(css, page, nil), `a { background: url(https://proxy.example/http://other.example/bg.gif) }`; got != want {
+		t.Errorf("rewriteCSS = %s, want %s", got, want)
+	}
+}
+
+func TestRedirectLocation(t *testing.T) {
+	setFlag(t, "block-mixed-content", "true")
+	target, _ := url.Parse("https://example.com/next")
+
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	if got, want := redirectLocation(r, target), "http://example.com/next"; got != want {
+		t.Errorf("redirect as a proxy = %s, want %s", got, want)
+	}
+
+	r = httptest.NewRequest("GET", "/http://example.com/", nil)
+	r.Host = "proxy.example"
+	if got, want := redirectLocation(r, target), "https://proxy.example/http://example.com/next"; got != want {
+		t.Errorf("redirect addressed directly = %s, want %s", got, want)
+	}
+}
+
+func TestRewriteScriptURLs(t *testing.T) {
+	page := newPageContext("http://web.archive.org/web/20010401000000js_/http://Example.com/app.js")
+	script := `var a = "http://example.com/cgi-bin/data", b = '//web.archive.org/web/20010401000000/http://example.com:8080/x', c = "http://other.example/y", d = "http://example.com.evil.example/";`
+	want := `var a = "http://example.com/cgi-bin/data", b = 'http://example.com:8080/x', c = "http://other.example/y", d = "http://example.com.evil.example/";`
+	if got := rewriteScriptURLs(script, page, nil); got != want {
+		t.Errorf("as a proxy:\n got %s\nwant %s", got, want)
+	}
+
+	page.localBase = "http://proxy.example/"
+	want = `var a = "http://proxy.example/http://example.com/cgi-bin/data", b = 'http://proxy.example/http://example.com:8080/x', c = "http://other.example/y", d = "http://example.com.evil.example/";`
+	if got := rewriteScriptURLs(script, page, nil); got != want {
+		t.Errorf("behind a base:\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestRewriteSameHostLinks(t *testing.T) {
+	page := newPageContext("http://web.archive.org/web/20010401000000/http://www.example.com/")
+	page.localBase = "http://proxy.example/"
+	body := `<a href="http://www.example.com/other">x</a><a href=https://WWW.EXAMPLE.COM>y</a><img src="//www.example.com:81/i.gif"><a href="http://example.com/">z</a><div style="background: url(http://www.example.com/bg.gif)">`
+	want := `<a href="http://proxy.example/http://www.example.com/other">x</a><a href=http://proxy.example/http://WWW.EXAMPLE.COM>y</a><img src="http://proxy.example/http://www.example.com:81/i.gif"><a href="http://example.com/">z</a><div style="background: url(http://proxy.example/http://www.example.com/bg.gif)">`
+	if got := rewriteSameHostLinks(body, page, nil); got != want {
+		t.Errorf("rewriteSameHostLinks:\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestRewriteLinks(t *testing.T) {
+	page := newPageContext("http://web.archive.org/web/20010401000000/http://example.com/")
+	for _, tc := range []struct{ body, want string }{
+		{`<a href="http://web.archive.org/web/20010401000000/http://example.com/a.html">`, `<a href="http://example.com/a.html">`},
+		{`<img src="//web.archive.org/web/20010401000000im_/https://example.com/a.gif">`, `<img src="http://example.com/a.gif">`},
+		{`<a href='/web/2001/http://other.example/'>`, `<a href='http://other.example/'>`},
+		{`<script src=/web/20010401000000js_///cdn.example/x.js>`, `<script src=http://cdn.example/x.js>`},
+		{`<div style="background: url(/web/20010401000000im_/http://example.com/bg.gif)">`, `<div style="background: url(http://example.com/bg.gif)">`},
+		{`<img src="//cdn.example/a.gif"><a HREF='//example.com/'>`, `<img src="http://cdn.example/a.gif"><a HREF='http://example.com/'>`},
+		{`<style>a { background: url( "//cdn.example/bg.gif") }</style>`, `<style>a { background: url( "http://cdn.example/bg.gif") }</style>`},
+		// Paths that merely contain /web/ are not archive links
+		{`<a href="http://example.com/web/20010401000000/http://other.example/">`, `<a href="http://example.com/web/20010401000000/http://other.example/">`},
+		{`<a href="http://example.com/a.html">`, `<a href="http://example.com/a.html">`},
+	} {
+		if got := rewriteLinks(tc.body, page, nil); got != tc.want {
+			t.Errorf("rewriteLinks(%s):\n got %s\nwant %s", tc.body, got, tc.want)
+		}
+	}
+}
+
+func TestArchivedPageLinksRewritten(t *testing.T) {
+	serveArchivedPage(t, "http://example.com/", "20010401000000", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><body><a href="/web/20010401000000/http://example.com/a.html">a</a><img src="//web.archive.org/web/20010401000000im_/http://example.com/b.gif"></body></html>`))
+	})
+
+	w := httptest.NewRecorder()
+	handleRequest(w, httptest.NewRequest("GET", "http://example.com/", nil))
+	want := `<html><body><a href="http://example.com/a.html">a</a><img src="http://example.com/b.gif"></body></html>`
+	if w.Code != http.StatusOK || w.Body.String() != want {
+		t.Errorf("got %d:\n%s\nwant 200:\n%s", w.Code, w.Body.String(), want)
+	}
+}
+
+func TestPinAssetLinks(t *testing.T) {
+	for _, tc := range []struct{ body, want string }{
+		{`<img src="/web/20010401123456im_/http://example.com/logo.gif">`, `<img src="/web/20010401123456im_/http://example.com/logo.gif?__ts=20010401123456">`},
+		{`<script src='//web.archive.org/web/2001js_/http://example.com/a.js?v=2#x'>`, `<script src='//web.archive.org/web/2001js_/http://example.com/a.js?v=2&__ts=2001#x'>`},
+		{`background: url(/web/2001cs_/http://example.com/bg.png)`, `background: url(/web/2001cs_/http://example.com/bg.png?__ts=2001)`},
+		// Links to pages are left to be resolved at the date
+		{`<a href="/web/2001/http://example.com/page.html">`, `<a href="/web/2001/http://example.com/page.html">`},
+	} {
+		if got := pinAssetLinks(tc.body, nil); got != tc.want {
+			t.Errorf("pinAssetLinks(%s):\n got %s\nwant %s", tc.body, got, tc.want)
+		}
+	}
+}
+
+func TestPinnedSnapshotURL(t *testing.T) {
+	for _, tc := range []struct {
+		url, want string
+		ok        bool
+	}{
+		{"http://example.com/logo.gif?__ts=20010401123456", "http://web.archive.org/web/20010401123456/http://example.com/logo.gif", true},
+		{"http://example.com/a.js?v=2&__ts=2001", "http://web.archive.org/web/2001/http://example.com/a.js?v=2", true},
+		{"http://example.com/a.js?__ts=yesterday", "", false},
+		{"http://example.com/a.js?v=2", "", false},
+		{"/a.js?__ts=2001", "", false},
+	} {
+		got, ok := pinnedSnapshotURL(tc.url)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("pinnedSnapshotURL(%s) = %q, %v, want %q, %v", tc.url, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestSameSnapshotAssets(t *testing.T) {
+	setFlag(t, "same-snapshot-assets", "true")
+	setFlag(t, "date", "20010401")
+	lookups := 0
+	newCDXServer(t, func(w http.ResponseWriter, r *http.Request) {
+		lookups++
+		archivedCaptures("http://example.com/", "20010401000000")(w, r)
+	})
+	var fetched []string
+	newArchiveServer(t, func(w http.ResponseWriter, r *http.Request) {
+		fetched = append(fetched, r.URL.Path+"?"+r.URL.RawQuery)
+		if strings.HasSuffix(r.URL.Path, ".gif") {
+			w.Header().Set("Content-Type", "image/gif")
+			w.Write([]byte("GIF89a"))
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><body><img src="/web/20010401000000im_/http://example.com/b.gif"><a href="/web/20010401000000/http://example.com/c.html">c</a></body></html>`))
+	})
+
+	w := httptest.NewRecorder()
+	handleRequest(w, httptest.NewRequest("GET", "http://example.com/", nil))
+	want := `<html><body><img src="http://example.com/b.gif?__ts=20010401000000"><a href="http://example.com/c.html">c</a></body></html>`
+	if w.Body.String() != want {
+		t.Errorf("page:\n got %s\nwant %s", w.Body.String(), want)
+	}
+
+	// The asset is fetched from the snapshot without another lookup
+	w = httptest.NewRecorder()
+	handleRequest(w, httptest.NewRequest("GET", "http://example.com/b.gif?__ts=20010401000000", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "GIF89a" {
+		t.Errorf("asset: got %d %q", w.Code, w.Body.String())
+	}
+	if lookups != 1 {
+		t.Errorf("%d CDX lookups, want 1 for the page", lookups)
+	}
+	if len(fetched) != 2 || !strings.HasPrefix(fetched[1], "/web/20010401000000") || !strings.HasSuffix(fetched[1], "/http://example.com/b.gif?") {
+		t.Errorf("fetched %q from the archive", fetched)
+	}
+}
+
+func TestRewriteFormActions(t *testing.T) {
+	page := newPageContext("http://web.archive.org/web/20010401000000/http://example.com/dir/page.html")
+	for _, tc := range []struct{ body, want string }{
+		{`<form action="search.cgi">`, `<form action="http://example.com/dir/search.cgi">`},
+		{`<FORM method=get ACTION=/cgi-bin/find>`, `<FORM method=get ACTION="http://example.com/cgi-bin/find">`},
+		{`<form action='/web/20010401000000/https://other.example/q?a=1&amp;b=2'>`, `<form action="http://other.example/q?a=1&amp;b=2">`},
+		{`<form action="javascript:void(0)">`, `<form action="javascript:void(0)">`},
+		{`<form method="get">`, `<form method="get">`},
+	} {
+		if got := rewriteFormActions(tc.body, page, nil); got != tc.want {
+			t.Errorf("rewriteFormActions(%s):\n got %s\nwant %s", tc.body, got, tc.want)
+		}
+	}
+
+	page.localBase = "http://proxy.example/"
+	if got, want := rewriteFormActions(`<form action="search.cgi">`, page, nil), `<form action="http://proxy.example/http://example.com/dir/search.cgi">`; got != want {
+		t.Errorf("behind a base:\n got %s\nwant %s", got, want)
+	}
+	if got := rewriteFormActions(`<form action="search.cgi">`, nil, nil); got != `<form action="search.cgi">` {
+		t.Errorf("unknown page: got %s", got)
+	}
+}
+
+func TestRewritePostForms(t *testing.T) {
+	attrs := ` onsubmit="return false" title="` + html.EscapeString(disabledFormTitle) + `"`
+	disabled := `<form` + attrs
+	for _, tc := range []struct{ mode, body, want string }{
+		{postFormsGet, `<form method="post" action="/search" enctype="multipart/form-data"><input name=q></form>`, `<form method="get" action="/search"><input name=q></form>`},
+		{postFormsGet, `<FORM METHOD=Post action=/login><input type=password name=pw></FORM>`, `<FORM` + attrs + ` METHOD=Post action=/login><input type=password name=pw></FORM>`},
+		{postFormsGet, `<form method='post'><input type="file" name=f></form>`, disabled + ` method='post'><input type="file" name=f></form>`},
+		{postFormsGet, `<form method="get" action="/search"></form>`, `<form method="get" action="/search"></form>`},
+		{postFormsDisable, `<form method="post" action="/search"><input name=q></form>`, disabled + ` method="post" action="/search"><input name=q></form>`},
+		{postFormsDisable, `<form action="/search"></form>`, `<form action="/search"></form>`},
+		// Only the form a password field is in is disabled
+		{postFormsGet, `<form method=post><input name=q></form><form method=post><input type=password></form>`, `<form method="get"><input name=q></form>` + disabled + ` method=post><input type=password></form>`},
+	} {
+		if got := rewritePostForms(tc.body, tc.mode, nil); got != tc.want {
+			t.Errorf("rewritePostForms(%s, %s):\n got %s\nwant %s", tc.body, tc.mode, got, tc.want)
+		}
+	}
+}
+
+func TestArchivedPostFormResubmittedAsGet(t *testing.T) {
+	setFlag(t, "rewrite-forms", "true")
+	setFlag(t, "post-forms", postFormsGet)
+	serveArchivedPage(t, "http://example.com/", "20010401000000", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><body><form method="post" action="/web/20010401000000/http://example.com/search"><input name=q></form></body></html>`))
+	})
+
+	w := httptest.NewRecorder()
+	handleRequest(w, httptest.NewRequest("GET", "http://example.com/", nil))
+	want := `<html><body><form method="get" action="http://example.com/search"><input name=q></form></body></html>`
+	if w.Body.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", w.Body.String(), want)
+	}
+}
+
+func TestAnchorBaseElement(t *testing.T) {
+	page := newPageContext("http://web.archive.org/web/20010401000000/http://example.com/docs/faq.html?a=1&b=2")
+	links := `<a href="#top">top</a><a href=#q1>q1</a><a href="other.html#x">x</a>`
+	for _, tc := range []struct{ localBase, body, want string }{
+		{
+			"",
+			`<base href="http://example.com/docs/">` + links,
+			`<base href="http://example.com/docs/faq.html?a=1&amp;b=2">` + links,
+		},
+		{
+			"",
+			`<BASE TARGET=_top HREF='http://EXAMPLE.com/docs/index.html'>` + links,
+			`<BASE TARGET=_top HREF="http://example.com/docs/faq.html?a=1&amp;b=2">` + links,
+		},
+		{
+			"",
+			`<base href=/docs/>` + links,
+			`<base href="http://example.com/docs/faq.html?a=1&amp;b=2">` + links,
+		},
+		{
+			"http://proxy.example:8080/",
+			`<base href="http://proxy.example:8080/http://example.com/docs/">` + links,
+			`<base href="http://proxy.example:8080/http://example.com/docs/faq.html?a=1&amp;b=2">` + links,
+		},
+		// Relative links depend on a base elsewhere
+		{"", `<base href="http://example.com/">` + links, `<base href="http://example.com/">` + links},
+		{"", `<base href="http://www.example.com/docs/">` + links, `<base href="http://www.example.com/docs/">` + links},
+		{"", `<base href="http://example.com/docs/?lang=en">` + links, `<base href="http://example.com/docs/?lang=en">` + links},
+		// Without a base element fragments already stay on the page
+		{"", links, links},
+	} {
+		page.localBase = tc.localBase
+		if got := anchorBaseElement(tc.body, page); got != tc.want {
+			t.Errorf("anchorBaseElement(%s):\n got %s\nwant %s", tc.body, got, tc.want)
+		}
+	}
+}
+
+func TestArchivedPageBaseAnchored(t *testing.T) {
+	setFlag(t, "rewrite-anchor-base", "true")
+	serveArchivedPage(t, "http://example.com/faq.html", "20010401000000", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><head><base href="/web/20010401000000/http://example.com/"></head><body><a href="#top">top</a><a href="news.html">news</a></body></html>`))
+	})
+
+	w := httptest.NewRecorder()
+	handleRequest(w, httptest.NewRequest("GET", "http://example.com/faq.html", nil))
+	want := `<html><head><base href="http://example.com/faq.html"></head><body><a href="#top">top</a><a href="news.html">news</a></body></html>`
+	if w.Body.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", w.Body.String(), want)
+	}
+}
+
+// crawlRedirectPage is the page the archive serves for a capture that was a
+// redirect to target at crawl time.
+func crawlRedirectPage(target string) string {
+	return `<html><body><div id="positionHome"><section><div class="layout-slim"><h2 class="blue">Got an HTTP 302 response at crawl time</h2><p class="code">Redirecting to...</p><p class="code shift target">` + target + `</p><p class="impatient"><a href="` + target + `">Impatient?</a></p></div></section></div></body></html>`
+}
+
+func TestCrawlRedirectTarget(t *testing.T) {
+	page := newPageContext("http://web.archive.org/web/20010401000000/http://example.com/old/")
+	for _, tc := range []struct{ body, want string }{
+		{crawlRedirectPage("https://web.archive.org/web/20010401000001/http://www.example.com/new.html"), "http://www.example.com/new.html"},
+		{crawlRedirectPage("new.html?a=1&amp;b=2"), "http://example.com/old/new.html?a=1&b=2"},
+		{crawlRedirectPage("mailto:someone@example.com"), ""},
+		{`<p class="impatient"><a href="http://example.com/">Impatient?</a></p>`, ""},
+	} {
+		got := ""
+		if target, ok := crawlRedirectTarget(tc.body, page); ok {
+			got = target.String()
+		}
+		if got != tc.want {
+			t.Errorf("crawlRedirectTarget = %q, want %q", got, tc.want)
+		}
+	}
+}
+
+func TestCrawlRedirectServedAsRedirect(t *testing.T) {
+	serveArchivedPage(t, "http://example.com/old/", "20010401000000", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(crawlRedirectPage("/web/20010401000001/http://example.com/new.html")))
+	})
+
+	w := httptest.NewRecorder()
+	handleRequest(w, httptest.NewRequest("GET", "http://example.com/old/", nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "http://example.com/new.html" {
+		t.Errorf("got %d to %q, want a redirect to http://example.com/new.html", w.Code, w.Header().Get("Location"))
+	}
+
+	r := httptest.NewRequest("GET", "/http://example.com/old/", nil)
+	r.Host = "proxy.example"
+	w = httptest.NewRecorder()
+	handleRequest(w, r)
+	if got, want := w.Header().Get("Location"), "http://proxy.example/http://example.com/new.html"; w.Code != http.StatusFound || got != want {
+		t.Errorf("addressed directly: got %d to %q, want a redirect to %s", w.Code, got, want)
+	}
+}
+
+func TestOtherSchemeLinksLeftIntact(t *testing.T) {
+	page := newPageContext("http://web.archive.org/web/20010401000000/http://example.com/")
+	body := `<a href="/web/20010401000000/mailto:someone@example.com">m</a><a href="//web.archive.org/web/20010401000000/ftp://ftp.example.com/pub/">f</a><a href="gopher://gopher.example.com/">g</a>`
+	want := `<a href="mailto:someone@example.com">m</a><a href="ftp://ftp.example.com/pub/">f</a><a href="gopher://gopher.example.com/">g</a>`
+	if got := rewriteLinks(body, page, nil); got != want {
+		t.Errorf("rewriteLinks:\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestRewriteFTPGopherLinks(t *testing.T) {
+	body := `<a href="ftp://ftp.example.com/pub/">f</a><A HREF=gopher://gopher.example.com/>g</A><a href='http://example.com/'>h</a>`
+	for _, tc := range []struct{ mode, want string }{
+		{ftpGopherKeep, body},
+		{ftpGopherStrip, `<a>f</a><A>g</A><a href='http://example.com/'>h</a>`},
+		{ftpGopherAnnotate, `<a href="ftp://ftp.example.com/pub/" title="This ftp link is not archived and probably no longer works">f</a>` +
+			`<A HREF=gopher://gopher.example.com/ title="This gopher link is not archived and probably no longer works">g</A><a href='http://example.com/'>h</a>`},
+	} {
+		if got := rewriteFTPGopherLinks(body, tc.mode, nil); got != tc.want {
+			t.Errorf("%s:\n got %s\nwant %s", tc.mode, got, tc.want)
+		}
+	}
+}
+
+func TestPathEncodedTarget(t *testing.T) {
+	for _, tc := range []struct {
+		uri, want string
+		ok        bool
+	}{
+		{"/http://example.com/a?b=c", "http://example.com/a?b=c", true},
+		{"/https://example.com/", "https://example.com/", true},
+		{"/index.html", "", false},
+		{"http://example.com/", "", false},
+	} {
+		got, ok := pathEncodedTarget(httptest.NewRequest("GET", tc.uri, nil))
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("pathEncodedTarget(%s) = %q, %v; want %q, %v", tc.uri, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestExternalURLInRedirects(t *testing.T) {
+	target, _ := url.Parse("http://example.com/next")
+	r := httptest.NewRequest("GET", "/http://example.com/", nil)
+	r.Host = "10.0.0.5:8080"
+	if got, want := redirectLocation(r, target), "http://10.0.0.5:8080/http://example.com/next"; got != want {
+		t.Errorf("without -external-url: %s, want %s", got, want)
+	}
+
+	setFlag(t, "external-url", "https://surf.example.com/")
+	if got, want := redirectLocation(r, target), "https://surf.example.com/http://example.com/next"; got != want {
+		t.Errorf("with -external-url: %s, want %s", got, want)
+	}
+	// Browsers using the proxy as a proxy still get the original URL
+	if got, want := redirectLocation(httptest.NewRequest("GET", "http://example.com/", nil), target), "http://example.com/next"; got != want {
+		t.Errorf("as a proxy: %s, want %s", got, want)
+	}
+}
+
+func TestRewriteAbsoluteSameHostFlag(t *testing.T) {
+	serveArchivedPage(t, "http://www.example.com/", "20010401000000", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<a href="http://www.example.com/a.html">a</a><a href="http://other.example/">b</a>`))
+	})
+
+	for _, tc := range []struct{ flag, want string }{
+		{"false", `<a href="http://www.example.com/a.html">a</a><a href="http://other.example/">b</a>`},
+		{"true", `<a href="http://proxy.example/http://www.example.com/a.html">a</a><a href="http://other.example/">b</a>`},
+	} {
+		setFlag(t, "rewrite-absolute-same-host", tc.flag)
+		r := httptest.NewRequest("GET", "/http://www.example.com/", nil)
+		r.Host = "proxy.example"
+		w := httptest.NewRecorder()
+		handleRequest(w, r)
+		if w.Body.String() != tc.want {
+			t.Errorf("-rewrite-absolute-same-host=%s:\n got %s\nwant %s", tc.flag, w.Body.String(), tc.want)
+		}
+	}
+}
+
+func TestReverseRewrite(t *testing.T) {
+	setFlag(t, "reverse-rewrite", "true")
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Host = "proxy.example"
+	for target, want := range map[string]string{
+		"http://example.com/a":                                          "http://example.com/a",
+		"http:/example.com/a":                                           "http://example.com/a",
+		"http://proxy.example/http://example.com/a?b=c":                 "http://example.com/a?b=c",
+		"https://proxy.example/http:/example.com/a":                     "http://example.com/a",
+		"http%3A%2F%2Fexample.com%2Fa%3Fb%3Dc":                          "http://example.com/a?b=c",
+		"http%3A%2F%2Fproxy.example%2Fhttp%3A%2F%2Fexample.com%2F":      "http://example.com/",
+		"http://proxy.example/http://proxy.example/http://example.com/": "http://example.com/",
+		// The local base in front of something that isn't a URL is kept
+		"http://proxy.example/index.html": "http://proxy.example/index.html",
+	} {
+		if got := reverseRewrite(r, target); got != want {
+			t.Errorf("reverseRewrite(%s) = %s, want %s", target, got, want)
+		}
+	}
+
+	// A browser using the proxy as a proxy sends the site's own Host
+	r = httptest.NewRequest("GET", "http://example.com/http://example.com/a", nil)
+	if got, want := reverseRewrite(r, "http://example.com/http://other.example/"), "http://example.com/http://other.example/"; got != want {
+		t.Errorf("absolute-form request: %s, want %s", got, want)
+	}
+}
+
+func TestReverseRewrittenRequestServed(t *testing.T) {
+	setFlag(t, "reverse-rewrite", "true")
+	serveArchivedPage(t, "http://example.com/a", "20010401000000", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/gif")
+		w.Write([]byte(r.URL.Path))
+	})
+
+	r := httptest.NewRequest("GET", "/http%3A%2F%2Fproxy.example%2Fhttp:/example.com/a", nil)
+	r.Host = "proxy.example"
+	w := httptest.NewRecorder()
+	handleRequest(w, r)
+	if want := "/web/20010401000000/http://example.com/a"; w.Code != http.StatusOK || w.Body.String() != want {
+		t.Errorf("got %d fetching %q, want %s", w.Code, w.Body.String(), want)
+	}
+}
+
+func TestStripIntegrityAttrs(t *testing.T) {
+	for _, tc := range []struct{ body, want string }{
+		{`<script src="a.js" integrity="sha384-abc" crossorigin="anonymous"></script>`, `<script src="a.js"></script>`},
+		{`<LINK rel=stylesheet INTEGRITY='sha256-x' crossorigin href=b.css>`, `<LINK rel=stylesheet href=b.css>`},
+		{`<link rel="stylesheet" href="c.css" integrity=sha256-y>`, `<link rel="stylesheet" href="c.css">`},
+		// Only script and link tags are touched
+		{`<img src="d.gif" crossorigin="anonymous"><p>integrity="kept"</p>`, `<img src="d.gif" crossorigin="anonymous"><p>integrity="kept"</p>`},
+	} {
+		if got := stripIntegrityAttrs(tc.body, nil); got != tc.want {
+			t.Errorf("stripIntegrityAttrs(%s):\n got %s\nwant %s", tc.body, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout is how long in-flight requests get to finish on shutdown.
+const shutdownTimeout = 10 * time.Second
+
+// minMaxHeaderBytes is the smallest -max-header-bytes accepted.
+const minMaxHeaderBytes = 4096
+
+// shutdownHooks run, in order, once the server has shut down gracefully.
+var shutdownHooks []func()
+
+// onShutdown registers fn to run on graceful shutdown.
+func onShutdown(fn func()) {
+	shutdownHooks = append(shutdownHooks, fn)
+}
+
+// localHandler routes requests addressed to the proxy itself to the proxy's
+// own endpoints in local, and everything else to proxy. Requests in absolute
+// form (GET http://host/path), which is how browsers talk to an HTTP proxy,
+// always go to proxy, so the local endpoints never shadow an archived page
+// with the same path.
+func localHandler(proxy http.Handler, local *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !r.URL.IsAbs() {
+			if handler, pattern := local.Handler(r); pattern != "" {
+				handler.ServeHTTP(w, r)
+				return
+			}
+		}
+		proxy.ServeHTTP(w, r)
+	})
+}
+
+// pathPrefix is the sub-path, e.g. /time-surfer, the proxy is mounted under
+// by a front end, from -path-prefix. It is empty when mounted at the root.
+var pathPrefix string
+
+// stripPathPrefix removes prefix from the path of requests addressed to the
+// proxy directly, leaving absolute-form proxy requests alone.
+func stripPathPrefix(prefix string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.IsAbs() || (r.URL.Path != prefix && !strings.HasPrefix(r.URL.Path, prefix+"/")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		stripped := r.Clone(r.Context())
+		stripped.URL.Path = strings.TrimPrefix(r.URL.Path, prefix)
+		stripped.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, prefix)
+		stripped.RequestURI = strings.TrimPrefix(r.RequestURI, prefix)
+		if stripped.URL.Path == "" {
+			stripped.URL.Path = "/"
+			stripped.RequestURI = "/" + stripped.RequestURI
+		}
+		next.ServeHTTP(w, stripped)
+	})
+}
+
+// listen opens the listener the proxy serves on: the -listen-unix socket if
+// one is configured, otherwise TCP on -port.
+func listen() (net.Listener, error) {
+	if *listenUnix == "" {
+		return net.Listen("tcp", fmt.Sprintf(":%s", *port))
+	}
+
+	mode, err := strconv.ParseUint(*listenUnixMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -listen-unix-mode %q: %v", *listenUnixMode, err)
+	}
+
+	// Remove a socket left behind by a previous run, but never a regular file
+	if info, err := os.Lstat(*listenUnix); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", *listenUnix)
+		}
+		if err := os.Remove(*listenUnix); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", *listenUnix)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(*listenUnix, os.FileMode(mode)); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// serve runs server on listener until it receives SIGINT or SIGTERM, then
+// shuts it down gracefully. Closing the listener also removes a Unix socket
+// file.
+func serve(server *http.Server, listener net.Listener) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		sig := <-stop
+		infoLog("Received %v, shutting down", sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			errorLog("Error during shutdown: %v", err)
+		}
+		for _, hook := range shutdownHooks {
+			hook()
+		}
+	}()
+
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
+	<-done
+	return nil
+}
+
+// servePprof serves the net/http/pprof profiling endpoints under
+// /debug/pprof/ on addr, separately from the proxy so they can't be reached
+// through it. addr should normally be a loopback address.
+func servePprof(addr string) {
+	infoLog("Serving pprof endpoints on %s", addr)
+	if err := http.ListenAndServe(addr, pprofHandler()); err != nil {
+		errorLog("pprof server on %s failed: %v", addr, err)
+	}
+}
+
+// pprofHandler serves the profiling endpoints, apart from
+// /debug/pprof/cmdline: the command line holds the archive keys and any
+// other secrets given as flags.
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPprofHandlerHidesCommandLine(t *testing.T) {
+	handler := pprofHandler()
+	for path, want := range map[string]int{
+		"/debug/pprof/":              http.StatusOK,
+		"/debug/pprof/goroutine":     http.StatusOK,
+		"/debug/pprof/cmdline":       http.StatusNotFound,
+		"/debug/pprof/symbol":        http.StatusOK,
+		"/debug/pprof/not-a-profile": http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != want {
+			t.Errorf("GET %s: status %d, want %d", path, w.Code, want)
+		}
+	}
+}
+
+func TestStripPathPrefix(t *testing.T) {
+	var path, requestURI string
+	handler := stripPathPrefix("/ts", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, requestURI = r.URL.Path, r.RequestURI
+	}))
+	for _, tc := range []struct{ uri, path, requestURI string }{
+		{"/ts/http://example.com/a?b=c", "/http://example.com/a", "/http://example.com/a?b=c"},
+		{"/ts", "/", "/"},
+		{"/ts?x=1", "/", "/?x=1"},
+		{"/tsx/a", "/tsx/a", "/tsx/a"},
+		{"http://example.com/ts/a", "/ts/a", "http://example.com/ts/a"},
+	} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", tc.uri, nil))
+		if path != tc.path || requestURI != tc.requestURI {
+			t.Errorf("%s: passed on %s as %s, want %s as %s", tc.uri, path, requestURI, tc.path, tc.requestURI)
+		}
+	}
+}
+
+func TestPathPrefixInLinks(t *testing.T) {
+	old := pathPrefix
+	pathPrefix = "/ts"
+	defer func() { pathPrefix = old }()
+	serveArchivedPage(t, "http://example.com/", "20010401000000", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<a href="/web/20010401000000/http://example.com/a.html">a</a>`))
+	})
+
+	r := httptest.NewRequest("GET", "/ts/http://example.com/", nil)
+	r.Host = "proxy.example"
+	w := httptest.NewRecorder()
+	stripPathPrefix(pathPrefix, http.HandlerFunc(handleRequest)).ServeHTTP(w, r)
+	if want := `<a href="http://proxy.example/ts/http://example.com/a.html">a</a>`; w.Code != http.StatusOK || w.Body.String() != want {
+		t.Errorf("got %d %s, want %s", w.Code, w.Body.String(), want)
+	}
+}
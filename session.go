@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// sessionEntry is one response saved by -record-session, stored as JSON in
+// a file of its own named after its sessionKey.
+type sessionEntry struct {
+	Date       string      `json:"date"`
+	URL        string      `json:"url"`
+	Status     int         `json:"status"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"` // base64 in the file
+	RecordedAt time.Time   `json:"recordedAt"`
+}
+
+// sessionStore is a directory of responses recorded with -record-session
+// and served again with -replay-session.
+type sessionStore struct {
+	dir string
+}
+
+// openSessionStore uses dir for recording, creating it if create is set, or
+// for replay, when it must already exist.
+func openSessionStore(dir string, create bool) (*sessionStore, error) {
+	if create {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &sessionStore{dir: dir}, nil
+}
+
+// sessionTarget is the URL a proxied request asks for: the original URL for
+// browsers using the proxy as a proxy, or the request URI, such as
+// /http://example.com/, for clients addressing it directly. It leaves out
+// the proxy's host, so a session can be replayed on another host name.
+func sessionTarget(r *http.Request) string {
+	if r.URL.IsAbs() {
+		return r.URL.String()
+	}
+	return r.RequestURI
+}
+
+// path returns the file the response to a request for target at date is
+// kept in.
+func (s *sessionStore) path(date string, target string) string {
+	sum := sha256.Sum256([]byte(date + " " + target))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// save writes entry to its file, replacing any earlier recording. The file
+// is written under a temporary name first, so that a replay never reads a
+// partly written entry.
+func (s *sessionStore) save(entry *sessionEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(s.dir, ".recording-*")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), s.path(entry.Date, entry.URL))
+}
+
+// load returns the recording for target at date. It reports false if there
+// is none.
+func (s *sessionStore) load(date string, target string) (*sessionEntry, bool, error) {
+	data, err := os.ReadFile(s.path(date, target))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	var entry sessionEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, false, err
+	}
+	return &entry, true, nil
+}
+
+// sessionMaxBodyBytes bounds the bodies -record-session keeps, each of which
+// is held in memory while it is served.
+const sessionMaxBodyBytes = 64 << 20
+
+// recordable reports whether a response with status and header is kept by
+// -record-session. Server errors are usually passing upstream failures, and
+// partial and stale responses don't stand for the whole resource; replay
+// answers those requests as not recorded instead.
+func recordable(status int, header http.Header) bool {
+	return status < 500 && status != http.StatusPartialContent && status != http.StatusNotModified &&
+		header.Get("Warning") == "" && header.Get("Content-Encoding") == ""
+}
+
+// record saves every response next serves to a GET request, for
+// -record-session. Clients' Accept-Encoding is dropped so that responses are
+// recorded uncompressed, and can be replayed to any client.
+func (s *sessionStore) record(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r = r.Clone(r.Context())
+		r.Header.Del("Accept-Encoding")
+
+		rw := &harResponseWriter{ResponseWriter: w, body: &bytes.Buffer{}, bodyLimit: sessionMaxBodyBytes}
+		next.ServeHTTP(rw, r)
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+			rw.header = w.Header().Clone()
+		}
+		if !recordable(rw.status, rw.header) {
+			debugLog("Not recording %d response for %s", rw.status, sessionTarget(r))
+			return
+		}
+		if rw.bodyOmitted {
+			warnLog("Not recording %s, its body is over %d bytes", sessionTarget(r), sessionMaxBodyBytes)
+			return
+		}
+
+		// A correlation ID belongs to the request that was recorded
+		if *requestIDHeader != "" {
+			rw.header.Del(*requestIDHeader)
+		}
+		entry := &sessionEntry{
+			Date:       requestDate(r),
+			URL:        sessionTarget(r),
+			Status:     rw.status,
+			Header:     rw.header,
+			Body:       rw.body.Bytes(),
+			RecordedAt: time.Now().UTC(),
+		}
+		if err := s.save(entry); err != nil {
+			errorLog("Error recording %s to session %s: %v", entry.URL, s.dir, err)
+		}
+	})
+}
+
+// replay answers proxied requests from the recording alone, for
+// -replay-session. Nothing is fetched: a request that wasn't recorded gets
+// a 404 error page saying so.
+func (s *sessionStore) replay(w http.ResponseWriter, r *http.Request) {
+	reqDate := requestDate(r)
+	target := sessionTarget(r)
+	if r.Method != "GET" && r.Method != "HEAD" {
+		serveErrorPage(w, http.StatusMethodNotAllowed, target, "Only GET and HEAD requests can be replayed from a recorded session")
+		return
+	}
+
+	entry, ok, err := s.load(reqDate, target)
+	if err != nil {
+		errorLog("Error reading the recording of %s from session %s: %v", target, s.dir, err)
+		serveErrorPage(w, http.StatusInternalServerError, target, "The recording of this page could not be read")
+		return
+	}
+	if !ok {
+		infoLog("Not in the replayed session: %s for %s", target, reqDate)
+		serveErrorPage(w, http.StatusNotFound, target, "This page was not recorded in the session being replayed")
+		return
+	}
+
+	debugLog("Replaying %s for %s, recorded %s", target, reqDate, entry.RecordedAt.Format(time.RFC3339))
+	for name, values := range entry.Header {
+		w.Header()[name] = append([]string(nil), values...)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(entry.Body)))
+	w.WriteHeader(entry.Status)
+	if r.Method != "HEAD" {
+		w.Write(entry.Body)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecordable(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		header http.Header
+		want   bool
+	}{
+		{http.StatusOK, http.Header{}, true},
+		{http.StatusNotFound, http.Header{}, true},
+		{http.StatusFound, http.Header{"Location": {"http://example.com/"}}, true},
+		{http.StatusBadGateway, http.Header{}, false},
+		{http.StatusPartialContent, http.Header{}, false},
+		{http.StatusNotModified, http.Header{}, false},
+		{http.StatusOK, http.Header{"Warning": {`110 - "Response is Stale"`}}, false},
+		{http.StatusOK, http.Header{"Content-Encoding": {"gzip"}}, false},
+	} {
+		if got := recordable(tc.status, tc.header); got != tc.want {
+			t.Errorf("recordable(%d, %v) = %v, want %v", tc.status, tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestRecordAndReplaySession(t *testing.T) {
+	setFlag(t, "request-id-header", "X-Request-ID")
+	fetches := 0
+	serveArchivedPage(t, "http://example.com/", "20010401000000", func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><body>page</body></html>"))
+	})
+	dir := t.TempDir()
+
+	recording, err := openSessionStore(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	recording.record(http.HandlerFunc(handleRequest)).ServeHTTP(w, r)
+	if w.Code != http.StatusOK || fetches != 1 {
+		t.Fatalf("recording: status %d after %d fetches", w.Code, fetches)
+	}
+
+	replaying, err := openSessionStore(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	replaying.replay(w, httptest.NewRequest("GET", "http://example.com/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "<html><body>page</body></html>" || w.Header().Get("Content-Type") != "text/html" {
+		t.Errorf("replay: got %d %v\n%s", w.Code, w.Header(), w.Body.String())
+	}
+	if w.Header().Get("X-Request-ID") != "" {
+		t.Errorf("replay: recorded request ID %q served again", w.Header().Get("X-Request-ID"))
+	}
+	if fetches != 1 {
+		t.Errorf("replay fetched from the archive")
+	}
+
+	w = httptest.NewRecorder()
+	replaying.replay(w, httptest.NewRequest("HEAD", "http://example.com/", nil))
+	if w.Code != http.StatusOK || w.Body.Len() != 0 || w.Header().Get("Content-Length") != "30" {
+		t.Errorf("HEAD replay: got %d, Content-Length %q, %d bytes", w.Code, w.Header().Get("Content-Length"), w.Body.Len())
+	}
+
+	for _, tc := range []struct {
+		method, url string
+		status      int
+	}{
+		{"GET", "http://example.com/other", http.StatusNotFound},
+		{"POST", "http://example.com/", http.StatusMethodNotAllowed},
+	} {
+		w = httptest.NewRecorder()
+		replaying.replay(w, httptest.NewRequest(tc.method, tc.url, nil))
+		if w.Code != tc.status {
+			t.Errorf("%s %s: status %d, want %d", tc.method, tc.url, w.Code, tc.status)
+		}
+	}
+
+	// Replay is of the date recorded
+	setFlag(t, "date", "20050101")
+	w = httptest.NewRecorder()
+	replaying.replay(w, httptest.NewRequest("GET", "http://example.com/", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("replay at another date: status %d", w.Code)
+	}
+}
+
+func TestReplaySessionMustExist(t *testing.T) {
+	if _, err := openSessionStore(t.TempDir()+"/missing", false); err == nil {
+		t.Error("opened a missing session for replay")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spnSaveURL      = "https://web.archive.org/save"
+	spnStatusURL    = "https://web.archive.org/save/status/"
+	spnPollInterval = 5 * time.Second
+)
+
+// spnLimiter enforces the minimum interval between Save Page Now jobs. SPN
+// only allows a handful of captures per minute per account, so requests that
+// arrive inside the interval are not queued; they simply skip the save.
+var spnLimiter struct {
+	sync.Mutex
+	nextAllowed time.Time
+}
+
+type spnJob struct {
+	URL       string `json:"url"`
+	JobID     string `json:"job_id"`
+	Status    string `json:"status"`
+	StatusExt string `json:"status_ext"`
+	Message   string `json:"message"`
+	Timestamp string `json:"timestamp"`
+	Original  string `json:"original_url"`
+}
+
+// reserveSPNSlot reports whether a new Save Page Now job may be started now,
+// and if so reserves the slot until the configured interval has passed.
+func reserveSPNSlot() bool {
+	spnLimiter.Lock()
+	defer spnLimiter.Unlock()
+
+	now := time.Now()
+	if now.Before(spnLimiter.nextAllowed) {
+		return false
+	}
+	spnLimiter.nextAllowed = now.Add(*spnMinInterval)
+	return true
+}
+
+func newSPNRequest(method, target string, body string) (*http.Request, error) {
+	req, err := http.NewRequest(method, target, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	setArchiveAuthorization(req)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return req, nil
+}
+
+func doSPNRequest(client *http.Client, req *http.Request) (*spnJob, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Save Page Now returned status %d", resp.StatusCode)
+	}
+
+	var job spnJob
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// savePageNow asks archive.org to capture originalURL and waits for the job
+// to finish, returning the Wayback URL of the new capture.
+func savePageNow(originalURL string) (string, error) {
+	if !reserveSPNSlot() {
+		return "", fmt.Errorf("Save Page Now rate limit reached, try again later")
+	}
+
+	client := &http.Client{Timeout: 60 * time.Second, Transport: upstreamTransport}
+
+	req, err := newSPNRequest("POST", spnSaveURL, url.Values{"url": {originalURL}}.Encode())
+	if err != nil {
+		return "", err
+	}
+	job, err := doSPNRequest(client, req)
+	if err != nil {
+		return "", err
+	}
+	if job.JobID == "" {
+		return "", fmt.Errorf("Save Page Now rejected %s: %s %s", originalURL, job.StatusExt, job.Message)
+	}
+
+	debugLog("Save Page Now job %s started for %s", job.JobID, originalURL)
+
+	deadline := time.Now().Add(*spnTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(spnPollInterval)
+
+		req, err := newSPNRequest("GET", spnStatusURL+url.PathEscape(job.JobID), "")
+		if err != nil {
+			return "", err
+		}
+		status, err := doSPNRequest(client, req)
+		if err != nil {
+			errorLog("Error polling Save Page Now job %s: %v", job.JobID, err)
+			continue
+		}
+
+		debugLog("Save Page Now job %s status: %s", job.JobID, status.Status)
+
+		switch status.Status {
+		case "success":
+			original := status.Original
+			if original == "" {
+				original = originalURL
+			}
+			waybackURL := formatWaybackURL(status.Timestamp, original)
+			debugLog("Save Page Now job %s captured %s", job.JobID, waybackURL)
+			return waybackURL, nil
+		case "error":
+			return "", fmt.Errorf("Save Page Now job %s failed: %s %s", job.JobID, status.StatusExt, status.Message)
+		}
+	}
+
+	return "", fmt.Errorf("Save Page Now job %s did not finish within %v", job.JobID, *spnTimeout)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// retryWriter streams a proxied response straight to the client as it is
+// written, so that large downloads are not held in memory and Range
+// responses reach the client unchanged. Responses with a 5xx status are
+// buffered instead, because they may still be retried or replaced by a stale
+// copy. Other responses are only sent once the first byte of their body is,
+// so a fetch that fails before that can still be retried.
+type retryWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+	status int
+
+	// buffer holds a 5xx response, which has not been sent to w
+	buffer *httptest.ResponseRecorder
+	// committed is set once the response has been sent to w
+	committed bool
+	// stale collects a committed body for -serve-stale; nil if it is not
+	// being kept or turned out to be too large
+	stale *bytes.Buffer
+}
+
+func newRetryWriter(w http.ResponseWriter) *retryWriter {
+	return &retryWriter{w: w, header: make(http.Header)}
+}
+
+func (rw *retryWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *retryWriter) WriteHeader(status int) {
+	if rw.status != 0 {
+		return
+	}
+	rw.status = status
+
+	if status >= 500 {
+		rw.buffer = httptest.NewRecorder()
+		copyHeaders(rw.buffer.Header(), rw.header)
+		rw.buffer.WriteHeader(status)
+		return
+	}
+
+	if staleCache != nil && status != http.StatusPartialContent {
+		rw.stale = &bytes.Buffer{}
+	}
+}
+
+// commit sends the header of a response that is not buffered to w.
+func (rw *retryWriter) commit() {
+	copyHeaders(rw.w.Header(), rw.header)
+	rw.w.WriteHeader(rw.status)
+	rw.committed = true
+}
+
+// finish sends the header of a response that ended without a body.
+func (rw *retryWriter) finish() {
+	if rw.status != 0 && rw.buffer == nil && !rw.committed {
+		rw.commit()
+	}
+}
+
+func (rw *retryWriter) Write(p []byte) (int, error) {
+	if rw.status == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.buffer != nil {
+		return rw.buffer.Write(p)
+	}
+	if !rw.committed {
+		rw.commit()
+	}
+
+	if rw.stale != nil {
+		if rw.stale.Len()+len(p) > staleMaxBodyBytes {
+			rw.stale = nil
+		} else {
+			rw.stale.Write(p)
+		}
+	}
+	return rw.w.Write(p)
+}
+
+func (rw *retryWriter) Flush() {
+	if !rw.committed {
+		return
+	}
+	if flusher, ok := rw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// result returns the buffered response, or, if nothing was written, an empty
+// 200 response as the proxy would have sent.
+func (rw *retryWriter) result() *httptest.ResponseRecorder {
+	if rw.buffer == nil {
+		rw.buffer = httptest.NewRecorder()
+		copyHeaders(rw.buffer.Header(), rw.header)
+	}
+	return rw.buffer
+}
+
+// bodyErrorTransport remembers whether reading a response body it returned
+// failed because the archive cut the connection short, and the error of a
+// request that failed outright. httputil's ReverseProxy only reports the
+// former by aborting the handler, and turns the latter into a bare 502.
+type bodyErrorTransport struct {
+	next http.RoundTripper
+
+	mu         sync.Mutex
+	err        error
+	requestErr error
+}
+
+func (t *bodyErrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		t.mu.Lock()
+		t.requestErr = err
+		t.mu.Unlock()
+		return nil, err
+	}
+	resp.Body = &errorRecordingBody{ReadCloser: resp.Body, transport: t}
+	return resp, nil
+}
+
+// truncation returns the error a body was cut off with, if any.
+func (t *bodyErrorTransport) truncation() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// failure returns the error the last request failed with, if any. It is
+// nil-safe, as trackBodyErrors returns no transport for other handlers.
+func (t *bodyErrorTransport) failure() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.requestErr
+}
+
+// describeFailure names the kind of connection problem err is, for the
+// retry log: a timeout, a failed DNS lookup, a refused or reset connection.
+func describeFailure(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		return "DNS lookup failed"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connection reset"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "connection closed"
+	default:
+		return "connection error"
+	}
+}
+
+type errorRecordingBody struct {
+	io.ReadCloser
+	transport *bodyErrorTransport
+}
+
+// Read records a body that ended early. A plain io.EOF ends every body, but
+// a connection dropped part way through a body of known length, or inside a
+// chunked or compressed one, shows up as io.ErrUnexpectedEOF.
+func (b *errorRecordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		b.transport.mu.Lock()
+		if b.transport.err == nil {
+			b.transport.err = err
+		}
+		b.transport.mu.Unlock()
+	}
+	return n, err
+}
+
+// trackBodyErrors returns a copy of proxy whose transport records body
+// truncation, for deciding whether an aborted fetch may be retried. Other
+// handlers are returned as they are, with nil.
+func trackBodyErrors(proxy http.Handler) (http.Handler, *bodyErrorTransport) {
+	reverseProxy, ok := proxy.(*httputil.ReverseProxy)
+	if !ok {
+		return proxy, nil
+	}
+	tracked := *reverseProxy
+	next := tracked.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	transport := &bodyErrorTransport{next: next}
+	tracked.Transport = transport
+	return &tracked, transport
+}
+
+// maxRetriesHeader overrides -max-retries for one request, when
+// -allow-retries-header is set.
+const maxRetriesHeader = "X-Time-Surfer-Max-Retries"
+
+// maxRetriesHeaderLimit is the most attempts maxRetriesHeader can ask for.
+const maxRetriesHeaderLimit = 10
+
+// requestMaxRetries returns how many attempts r's upstream fetch gets:
+// -max-retries, or with -allow-retries-header the number r asks for in
+// maxRetriesHeader, clamped to between 1 and maxRetriesHeaderLimit.
+func requestMaxRetries(r *http.Request) int {
+	value := r.Header.Get(maxRetriesHeader)
+	if !*allowRetriesHeader || value == "" {
+		return *maxRetries
+	}
+	attempts, err := strconv.Atoi(value)
+	if err != nil {
+		requestLogFrom(r).debug("Ignoring invalid %s: %q", maxRetriesHeader, value)
+		return *maxRetries
+	}
+	if attempts < 1 {
+		attempts = 1
+	} else if attempts > maxRetriesHeaderLimit {
+		attempts = maxRetriesHeaderLimit
+	}
+	requestLogFrom(r).debug("%s: %d attempts", maxRetriesHeader, attempts)
+	return attempts
+}
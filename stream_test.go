@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// binaryServer serves a large binary file with Range support, as the
+// archive does for downloads.
+func binaryServer(t *testing.T, content []byte) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/zip")
+		http.ServeContent(w, r, "file.zip", time.Unix(0, 0), bytes.NewReader(content))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestProxyPassesRangeRequestsThrough(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 100000)
+	server := binaryServer(t, content)
+	target, _ := url.Parse(server.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+
+	r := httptest.NewRequest("GET", "http://example.com/file.zip", nil)
+	r.Header.Set("Range", "bytes=500000-500009")
+	w := httptest.NewRecorder()
+	proxyWithRetries(w, r, proxy, "http://example.com/file.zip", "")
+
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusPartialContent)
+	}
+	if got := w.Header().Get("Content-Range"); got != "bytes 500000-500009/1000000" {
+		t.Errorf("Content-Range = %q", got)
+	}
+	if got := w.Header().Get("Accept-Ranges"); got != "bytes" {
+		t.Errorf("Accept-Ranges = %q", got)
+	}
+	if !bytes.Equal(w.Body.Bytes(), content[500000:500010]) {
+		t.Errorf("body = %q, want %q", w.Body.Bytes(), content[500000:500010])
+	}
+}
+
+// flushRecorder notes whether the body reached the client before the
+// proxied response was complete.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (w *flushRecorder) Write(p []byte) (int, error) {
+	w.writes++
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestProxyStreamsLargeDownloads(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 1<<20)
+	server := binaryServer(t, content)
+	target, _ := url.Parse(server.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+
+	w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	proxyWithRetries(w, httptest.NewRequest("GET", "http://example.com/file.zip", nil), proxy, "http://example.com/file.zip", "")
+	if w.Code != http.StatusOK || w.Body.Len() != len(content) {
+		t.Fatalf("got %d with %d bytes, want 200 with %d", w.Code, w.Body.Len(), len(content))
+	}
+	// A buffered response would be copied to the client in one write
+	if w.writes < 2 {
+		t.Errorf("body written in %d writes, want it streamed", w.writes)
+	}
+}
+
+func TestRequestMaxRetries(t *testing.T) {
+	setFlag(t, "max-retries", "3")
+	for _, tc := range []struct {
+		allow  string
+		header string
+		want   int
+	}{
+		{"false", "7", 3},
+		{"true", "", 3},
+		{"true", "7", 7},
+		{"true", "0", 1},
+		{"true", "100", maxRetriesHeaderLimit},
+		{"true", "many", 3},
+	} {
+		setFlag(t, "allow-retries-header", tc.allow)
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		if tc.header != "" {
+			r.Header.Set(maxRetriesHeader, tc.header)
+		}
+		if got := requestMaxRetries(r); got != tc.want {
+			t.Errorf("allow=%s header=%q: %d attempts, want %d", tc.allow, tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestRetryDelayIsPerRequest(t *testing.T) {
+	setFlag(t, "retry-delay", "1ms")
+	setFlag(t, "max-retries", "3")
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	t.Cleanup(server.Close)
+	target, _ := url.Parse(server.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		proxyWithRetries(httptest.NewRecorder(), r, proxy, "http://example.com/", "")
+	}
+	if requests != 9 {
+		t.Errorf("%d archive requests, want 3 attempts for each of 3", requests)
+	}
+	if *retryDelay != time.Millisecond {
+		t.Errorf("-retry-delay is %v after retrying, want it left at 1ms", *retryDelay)
+	}
+}
+
+func TestProxyPanicAnsweredWith502(t *testing.T) {
+	setFlag(t, "max-retries", "3")
+	calls := 0
+	proxy := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "text/html")
+		panic("modifier bug")
+	})
+
+	w := httptest.NewRecorder()
+	proxyWithRetries(w, httptest.NewRequest("GET", "http://example.com/", nil), proxy, "http://example.com/", "")
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadGateway)
+	}
+	if calls != 1 {
+		t.Errorf("%d attempts, want a panic not to be retried", calls)
+	}
+}
+
+func TestProxyPanicServesStaleCopy(t *testing.T) {
+	useStaleCache(t)
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	storeStale("key", r, http.StatusOK, http.Header{"Content-Type": {"text/plain"}}, []byte("stored"))
+	proxy := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("modifier bug")
+	})
+
+	w := httptest.NewRecorder()
+	proxyWithRetries(w, r, proxy, "http://example.com/", "key")
+	if w.Code != http.StatusOK || w.Body.String() != "stored" {
+		t.Errorf("got %d %q, want the stored copy", w.Code, w.Body.String())
+	}
+}
+
+// cutOffResponse answers with a 100 byte body of which only the given
+// bytes arrive before the connection drops.
+func cutOffResponse(t *testing.T, w http.ResponseWriter, sent string) {
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf.WriteString("HTTP/1.1 200 OK\r\nContent-Type: image/gif\r\nContent-Length: 100\r\n\r\n" + sent)
+	buf.Flush()
+}
+
+// servedRequest is a request as the server hands it to the handler.
+// ReverseProxy only aborts a request it can't finish when it comes from a
+// server.
+func servedRequest(method string, target string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	return r.WithContext(context.WithValue(r.Context(), http.ServerContextKey, &http.Server{}))
+}
+
+func TestCutOffFetchRetried(t *testing.T) {
+	setFlag(t, "max-retries", "3")
+	setFlag(t, "retry-delay", "0")
+	requests := 0
+	serveArchivedPage(t, "http://example.com/a.gif", "20010401000000", func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			cutOffResponse(t, w, "")
+			return
+		}
+		w.Header().Set("Content-Type", "image/gif")
+		w.Write([]byte("GIF89a"))
+	})
+
+	w := httptest.NewRecorder()
+	handleRequest(w, servedRequest("GET", "http://example.com/a.gif"))
+	if w.Code != http.StatusOK || w.Body.String() != "GIF89a" || requests != 2 {
+		t.Errorf("got %d %q after %d requests, want the second, complete fetch", w.Code, w.Body.String(), requests)
+	}
+}
+
+func TestCutOffBodyAbortsClientConnection(t *testing.T) {
+	setFlag(t, "max-retries", "3")
+	requests := 0
+	serveArchivedPage(t, "http://example.com/a.gif", "20010401000000", func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		cutOffResponse(t, w, "GIF89a")
+	})
+
+	w := httptest.NewRecorder()
+	defer func() {
+		// Part of the body was sent, so the client must see the connection
+		// drop rather than a complete response, and nothing can be retried
+		if r := recover(); r != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler", r)
+		}
+		if requests != 1 || w.Body.String() != "GIF89a" {
+			t.Errorf("%d requests, sent %q", requests, w.Body.String())
+		}
+	}()
+	handleRequest(w, servedRequest("GET", "http://example.com/a.gif"))
+}
+
+func TestDescribeFailure(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{&net.DNSError{Err: "no such host", Name: "example.invalid"}, "DNS lookup failed"},
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, "connection refused"},
+		{fmt.Errorf("read: %w", syscall.ECONNRESET), "connection reset"},
+		{io.ErrUnexpectedEOF, "connection closed"},
+		{context.DeadlineExceeded, "timeout"},
+		{errors.New("tls: bad certificate"), "connection error"},
+	} {
+		if got := describeFailure(tc.err); got != tc.want {
+			t.Errorf("describeFailure(%v) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestRetryLogNamesTransportError(t *testing.T) {
+	setFlag(t, "max-retries", "2")
+	setFlag(t, "retry-delay", "0")
+	server := httptest.NewServer(http.NotFoundHandler())
+	target, _ := url.Parse(server.URL)
+	server.Close()
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.ErrorLog = log.New(io.Discard, "", 0)
+	buf := captureLog(t)
+
+	w := httptest.NewRecorder()
+	proxyWithRetries(w, httptest.NewRequest("GET", "http://example.com/", nil), proxy, "http://example.com/", "")
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadGateway)
+	}
+	if got := strings.Count(buf.String(), "failed (connection refused: "); got != 2 {
+		t.Errorf("%d attempts logged as refused:\n%s", got, buf.String())
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// throttleInterval is how much transfer time each write of a throttled
+// response covers; smaller writes make the rate smoother.
+const throttleInterval = 100 * time.Millisecond
+
+// parseBandwidth parses a -bandwidth value in bits per second, with an
+// optional k, M or G suffix, e.g. 56k or 1.5M, into bytes per second. An
+// empty value or 0 means unlimited.
+func parseBandwidth(spec string) (int64, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return 0, nil
+	}
+
+	number, multiplier := spec, 1.0
+	switch spec[len(spec)-1] {
+	case 'k', 'K':
+		multiplier = 1e3
+	case 'm', 'M':
+		multiplier = 1e6
+	case 'g', 'G':
+		multiplier = 1e9
+	}
+	if multiplier != 1 {
+		number = spec[:len(spec)-1]
+	}
+	bits, err := strconv.ParseFloat(number, 64)
+	if err != nil || bits < 0 {
+		return 0, fmt.Errorf("invalid bandwidth %q, expected bits per second such as 56k or 1.5M", spec)
+	}
+	bytesPerSecond := int64(bits * multiplier / 8)
+	if bits > 0 && bytesPerSecond == 0 {
+		bytesPerSecond = 1
+	}
+	return bytesPerSecond, nil
+}
+
+// throttledWriter sends a response body no faster than rate bytes per
+// second, counted from the first write.
+type throttledWriter struct {
+	http.ResponseWriter
+	rate    int64
+	ctx     context.Context
+	start   time.Time
+	written int64
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	if t.start.IsZero() {
+		t.start = time.Now()
+	}
+	chunkSize := int(t.rate * int64(throttleInterval) / int64(time.Second))
+	if chunkSize < 1 {
+		chunkSize = 1
+	}
+
+	n := 0
+	for len(p) > 0 {
+		due := t.start.Add(time.Duration(t.written * int64(time.Second) / t.rate))
+		if wait := time.Until(due); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-t.ctx.Done():
+				// The client went away, there is no one left to send to
+				timer.Stop()
+				return n, t.ctx.Err()
+			}
+		}
+
+		chunk := p
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		written, err := t.ResponseWriter.Write(chunk)
+		n += written
+		t.written += int64(written)
+		if err != nil {
+			return n, err
+		}
+		p = p[written:]
+		t.Flush()
+	}
+	return n, nil
+}
+
+// Flush sends what has been written so far, so the client sees the body
+// arrive at the throttled rate rather than all at once.
+func (t *throttledWriter) Flush() {
+	if flusher, ok := t.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// limitBandwidth throttles the responses of next to bytesPerSecond per
+// connection, for -bandwidth.
+func limitBandwidth(bytesPerSecond int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&throttledWriter{ResponseWriter: w, rate: bytesPerSecond, ctx: r.Context()}, r)
+	})
+}
+
+// throttledWriteTimeout is the server's WriteTimeout under a -bandwidth of
+// bytesPerSecond. The default -write-timeout only lets a 56k modem receive
+// about 6MB, cutting larger downloads off part way, so under a bandwidth
+// limit there is no write timeout unless one was given explicitly, and then
+// the largest response it lets through is logged.
+func throttledWriteTimeout(bytesPerSecond int64, timeout time.Duration, explicit bool) time.Duration {
+	if bytesPerSecond <= 0 || timeout == 0 {
+		return timeout
+	}
+	if !explicit {
+		infoLog("Not limiting how long responses take to send, as -bandwidth is set (see -write-timeout)")
+		return 0
+	}
+	warnLog("With -bandwidth and -write-timeout %v, responses over %d bytes will be cut off", timeout, bytesPerSecond*int64(timeout/time.Second))
+	return timeout
+}
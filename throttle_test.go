@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseBandwidth(t *testing.T) {
+	for spec, want := range map[string]int64{
+		"":     0,
+		"0":    0,
+		"56k":  7000,
+		"1.5M": 187500,
+		"1G":   125000000,
+		"1":    1,
+	} {
+		got, err := parseBandwidth(spec)
+		if err != nil || got != want {
+			t.Errorf("parseBandwidth(%q) = %d, %v; want %d", spec, got, err, want)
+		}
+	}
+	for _, spec := range []string{"fast", "-56k", "k"} {
+		if _, err := parseBandwidth(spec); err == nil {
+			t.Errorf("parseBandwidth(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestThrottledWriteTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		bandwidth int64
+		timeout   time.Duration
+		explicit  bool
+		want      time.Duration
+	}{
+		{0, 15 * time.Minute, false, 15 * time.Minute},
+		{7000, 15 * time.Minute, false, 0},
+		{7000, time.Hour, true, time.Hour},
+		{7000, 0, true, 0},
+	} {
+		if got := throttledWriteTimeout(tc.bandwidth, tc.timeout, tc.explicit); got != tc.want {
+			t.Errorf("throttledWriteTimeout(%d, %v, %v) = %v, want %v", tc.bandwidth, tc.timeout, tc.explicit, got, tc.want)
+		}
+	}
+}
+
+func TestLimitBandwidth(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 6000)
+	handler := limitBandwidth(20000, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/", nil))
+	// 2000 byte chunks, the last due 200ms after the first
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond {
+		t.Errorf("6000 bytes at 20000 bytes/s sent in %v", elapsed)
+	}
+	if !bytes.Equal(w.Body.Bytes(), body) || !w.Flushed {
+		t.Errorf("got %d bytes, flushed %v", w.Body.Len(), w.Flushed)
+	}
+}
+
+func TestThrottledWriterStopsWhenClientLeaves(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &throttledWriter{ResponseWriter: httptest.NewRecorder(), rate: 10, ctx: ctx}
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	n, err := w.Write(bytes.Repeat([]byte("x"), 100))
+	if err != context.Canceled || n != 1 {
+		t.Errorf("Write = %d, %v; want 1 byte and context.Canceled", n, err)
+	}
+}
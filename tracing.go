@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Span kinds, as OTLP numbers them.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// span is one timed phase of a request, traced for -otel-endpoint. A nil
+// *span, which is all there is while tracing is off, does nothing, so phases
+// are traced without checking whether tracing is on.
+type span struct {
+	rl       *requestLog
+	parent   *span
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte // zero for a root span without a remote parent
+	name     string
+	kind     int
+	start    time.Time
+	attrs    []otlpAttribute
+	err      error
+}
+
+// tracer sends finished spans to -otel-endpoint, nil when it is not set.
+var tracer *spanExporter
+
+// traceparentRe matches a W3C traceparent header: version, trace ID,
+// parent span ID and flags.
+var traceparentRe = regexp.MustCompile(`^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// startRequestSpan starts the root span of r's trace and makes it rl's
+// current span. A client that sends a traceparent header has the request
+// traced as part of its own trace.
+func startRequestSpan(rl *requestLog, r *http.Request) *span {
+	if tracer == nil || rl == nil {
+		return nil
+	}
+	s := &span{rl: rl, name: r.Method, kind: spanKindServer, start: time.Now()}
+	if m := traceparentRe.FindStringSubmatch(r.Header.Get("traceparent")); m != nil && m[1] != "ff" {
+		hex.Decode(s.traceID[:], []byte(m[2]))
+		hex.Decode(s.parentID[:], []byte(m[3]))
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	s.setAttr("http.request.method", r.Method)
+	rl.span = s
+	return s
+}
+
+// startSpan starts a phase of the request as a child of rl's current span,
+// and makes it the current one until it ends.
+func (rl *requestLog) startSpan(name string, kind int) *span {
+	if rl == nil || rl.span == nil {
+		return nil
+	}
+	parent := rl.span
+	s := &span{rl: rl, parent: parent, traceID: parent.traceID, parentID: parent.spanID, name: name, kind: kind, start: time.Now()}
+	rand.Read(s.spanID[:])
+	rl.span = s
+	return s
+}
+
+// setAttr records an attribute of the span; value is a string, an int or a
+// bool.
+func (s *span) setAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	attr := otlpAttribute{Key: key}
+	switch value := value.(type) {
+	case string:
+		attr.Value.StringValue = &value
+	case int:
+		text := strconv.Itoa(value)
+		attr.Value.IntValue = &text
+	case bool:
+		attr.Value.BoolValue = &value
+	default:
+		text := fmt.Sprint(value)
+		attr.Value.StringValue = &text
+	}
+	s.attrs = append(s.attrs, attr)
+}
+
+// fail marks the span as failed with err, if it isn't nil.
+func (s *span) fail(err error) {
+	if s != nil && err != nil {
+		s.err = err
+	}
+}
+
+// end finishes the span, hands it to the exporter and makes its parent the
+// current span again.
+func (s *span) end() {
+	if s == nil {
+		return
+	}
+	if s.rl.span == s {
+		s.rl.span = s.parent
+	}
+	exported := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes:        s.attrs,
+	}
+	if s.parentID != [8]byte{} {
+		exported.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.err != nil {
+		exported.Status = otlpStatus{Code: 2, Message: redactLogMessage(s.err.Error())}
+	}
+	tracer.add(exported)
+}
+
+// traceparent returns the W3C traceparent header naming the span as the
+// parent of an outgoing request.
+func (s *span) traceparent() string {
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-01"
+}
+
+// OTLP/HTTP JSON structures, see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding. Only the
+// fields the proxy fills in are included.
+type otlpExport struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"` // 2 is an error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// otlpValue holds one of its fields; 64-bit integers are strings in OTLP
+// JSON.
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+const (
+	traceBatchSize     = 256             // spans sent at once
+	traceBatchInterval = 5 * time.Second // longest a span waits to be sent
+	traceQueueLimit    = 4096            // spans kept while the collector is unreachable
+)
+
+// spanExporter sends finished spans in batches to an OTLP/HTTP collector.
+type spanExporter struct {
+	endpoint string
+	client   *http.Client
+
+	mu      sync.Mutex
+	pending []otlpSpan
+	dropped int
+	full    chan struct{}
+}
+
+// newSpanExporter returns an exporter for the collector at endpoint, e.g.
+// http://localhost:4318, sending to its /v1/traces unless endpoint names
+// another path, and starts sending every traceBatchInterval.
+func newSpanExporter(endpoint string) (*spanExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%q is not an http or https URL", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	e := &spanExporter{
+		endpoint: u.String(),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		full:     make(chan struct{}, 1),
+	}
+	go func() {
+		ticker := time.NewTicker(traceBatchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-e.full:
+			}
+			e.flush()
+		}
+	}()
+	return e, nil
+}
+
+func (e *spanExporter) add(s otlpSpan) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.pending) >= traceQueueLimit {
+		e.dropped++
+		return
+	}
+	e.pending = append(e.pending, s)
+	if len(e.pending) >= traceBatchSize {
+		select {
+		case e.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// flush sends the pending spans. Spans the collector doesn't accept are
+// dropped, so a collector that is down doesn't make them pile up.
+func (e *spanExporter) flush() {
+	e.mu.Lock()
+	spans, dropped := e.pending, e.dropped
+	e.pending, e.dropped = nil, 0
+	e.mu.Unlock()
+	if dropped > 0 {
+		warnLog("Dropped %d trace spans, the queue for %s was full", dropped, e.endpoint)
+	}
+	for len(spans) > 0 {
+		batch := spans
+		if len(batch) > traceBatchSize {
+			batch = batch[:traceBatchSize]
+		}
+		spans = spans[len(batch):]
+		if err := e.send(batch); err != nil {
+			warnLog("Error sending %d trace spans to %s: %v", len(batch)+len(spans), e.endpoint, err)
+			return
+		}
+	}
+}
+
+func (e *spanExporter) send(spans []otlpSpan) error {
+	service := "timesurfer"
+	body, err := json.Marshal(otlpExport{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttribute{{Key: "service.name", Value: otlpValue{StringValue: &service}}}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "timesurfer", Version: version}, Spans: spans}},
+	}}})
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// useSpanExporter collects the spans of the test's requests in the
+// returned exporter, which never sends them.
+func useSpanExporter(t *testing.T) *spanExporter {
+	old := tracer
+	tracer = &spanExporter{full: make(chan struct{}, 1)}
+	t.Cleanup(func() { tracer = old })
+	return tracer
+}
+
+func TestSuccessfulFetchSpanExported(t *testing.T) {
+	exporter := useSpanExporter(t)
+	serveArchivedPage(t, "http://example.com/", "20010401000000", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><body>page</body></html>"))
+	})
+
+	w := httptest.NewRecorder()
+	handleRequest(w, httptest.NewRequest("GET", "http://example.com/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+
+	spans := map[string]otlpSpan{}
+	for _, s := range exporter.pending {
+		spans[s.Name] = s
+	}
+	fetch, ok := spans["upstream.fetch"]
+	if !ok {
+		t.Fatalf("no upstream.fetch span among %d exported", len(exporter.pending))
+	}
+	if fetch.Status.Code != 0 {
+		t.Errorf("upstream.fetch status %+v, want unset", fetch.Status)
+	}
+	if root := spans["GET"]; fetch.ParentSpanID != root.SpanID {
+		t.Errorf("upstream.fetch parent %s, want the request span %s", fetch.ParentSpanID, root.SpanID)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"mime"
+)
+
+// BodyTransformer is a site-specific fix for archived bodies, run after the
+// built-in content actions. Transformers are added by dropping a file into
+// this package that registers them from an init function:
+//
+//	func init() {
+//		RegisterBodyTransformer(myFix{})
+//	}
+//
+// Transform receives the response's Content-Type and its body as modified so
+// far, and returns the new body. If it returns an error the error is logged
+// and the body is passed on unchanged, as if the transformer had not run.
+type BodyTransformer interface {
+	Transform(contentType string, body []byte) ([]byte, error)
+}
+
+// bodyTransformers run in the order they were registered. Init functions
+// run in file name order, so that decides the order across files.
+var bodyTransformers []BodyTransformer
+
+// RegisterBodyTransformer adds t to the transformers run over HTML, CSS and
+// JavaScript bodies. It must be called before the proxy starts, typically
+// from init.
+func RegisterBodyTransformer(t BodyTransformer) {
+	bodyTransformers = append(bodyTransformers, t)
+}
+
+// transformableTypes are the media types bodies are read for when
+// transformers are registered, even without content actions.
+var transformableTypes = map[string]bool{
+	"text/html":                true,
+	"text/css":                 true,
+	"application/javascript":   true,
+	"application/x-javascript": true,
+	"text/javascript":          true,
+}
+
+// wantsTransform reports whether registered transformers apply to bodies of
+// contentType.
+func wantsTransform(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && len(bodyTransformers) > 0 && transformableTypes[mediaType]
+}
+
+// runBodyTransformers applies every registered transformer to body, which
+// was fetched from source.
+func runBodyTransformers(contentType string, body []byte, source string) []byte {
+	for i, t := range bodyTransformers {
+		transformed, err := t.Transform(contentType, body)
+		if err != nil {
+			warnLog("Body transformer %d (%T) failed for %s, skipping it: %v", i+1, t, source, err)
+			continue
+		}
+		body = transformed
+	}
+	return body
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// upstreamDialer makes every connection to the archive and other upstream
+// servers. -dns-server replaces its resolver.
+var upstreamDialer = &net.Dialer{
+	Timeout:   30 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
+// hostOverrides pins host names to IP addresses, from -host-override.
+var hostOverrides = map[string]string{}
+
+// upstreamTransport is the transport proxied requests are sent with. It is
+// http.DefaultTransport's configuration, dialing through dialUpstream.
+var upstreamTransport = &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	DialContext:           dialUpstream,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
+// configureTransportTimeouts applies -dial-timeout, -tls-handshake-timeout,
+// -response-header-timeout and -idle-conn-timeout to upstream connections.
+// Zero means no limit.
+func configureTransportTimeouts(dial, tlsHandshake, responseHeader, idleConn time.Duration) {
+	upstreamDialer.Timeout = dial
+	upstreamTransport.TLSHandshakeTimeout = tlsHandshake
+	upstreamTransport.ResponseHeaderTimeout = responseHeader
+	upstreamTransport.IdleConnTimeout = idleConn
+}
+
+// skipTLSVerification turns off certificate verification for every
+// upstream connection, for -insecure-skip-verify. Anyone able to intercept
+// the traffic can then impersonate the archive, see what is browsed and
+// change the pages served.
+func skipTLSVerification() {
+	upstreamTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+}
+
+// dialUpstream dials addr with upstreamDialer, replacing the host with its
+// -host-override address if it has one.
+func dialUpstream(ctx context.Context, network, addr string) (net.Conn, error) {
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		if ip, ok := hostOverrides[strings.ToLower(host)]; ok {
+			addr = net.JoinHostPort(ip, port)
+		}
+	}
+	return upstreamDialer.DialContext(ctx, network, addr)
+}
+
+// configureUpstreamDNS applies -dns-server, a host:port that all upstream
+// host names are resolved with, and -host-override, a comma-separated list
+// of host=ip entries.
+func configureUpstreamDNS(dnsServer string, overrides string) error {
+	if dnsServer != "" {
+		if _, _, err := net.SplitHostPort(dnsServer); err != nil {
+			dnsServer = net.JoinHostPort(dnsServer, "53")
+		}
+		dnsDialer := &net.Dialer{Timeout: 5 * time.Second}
+		upstreamDialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dnsDialer.DialContext(ctx, network, dnsServer)
+			},
+		}
+	}
+
+	for _, entry := range strings.Split(overrides, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		eq := strings.Index(entry, "=")
+		if eq <= 0 || net.ParseIP(strings.TrimSpace(entry[eq+1:])) == nil {
+			return fmt.Errorf("invalid entry %q, expected host=ip", entry)
+		}
+		hostOverrides[strings.ToLower(strings.TrimSpace(entry[:eq]))] = strings.TrimSpace(entry[eq+1:])
+	}
+	return nil
+}
+
+// errPrivateAddress is the error connections to private addresses fail with
+// unless -allow-private-ips is set.
+var errPrivateAddress = errors.New("private address refused (see -allow-private-ips)")
+
+// privateNetworks are the address ranges upstream connections are refused
+// to unless -allow-private-ips is set: loopback, private, shared (carrier-grade NAT), link-local,
+// which includes cloud metadata services at 169.254.169.254, and
+// unspecified addresses, in IPv4 and IPv6.
+var privateNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.168.0.0/16",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10",
+	} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// isPrivateAddress reports whether ip is in one of the privateNetworks.
+func isPrivateAddress(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// denyPrivateAddresses is upstreamDialer's Control function unless
+// -allow-private-ips is set. It sees the address each connection is actually made
+// to, after the host name has been resolved, so neither a name pointing at
+// an internal host nor one that changes its answer between lookups gets
+// through.
+func denyPrivateAddresses(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || isPrivateAddress(ip) {
+		return errPrivateAddress
+	}
+	return nil
+}
+
+// privateUpstreams describes the -host-override addresses and the outbound
+// proxy from HTTP_PROXY or HTTPS_PROXY that are private, which
+// denyPrivateAddresses refuses every connection to. Proxies named by host
+// name are only caught if the name is localhost.
+func privateUpstreams() []string {
+	var private []string
+	for host, ip := range hostOverrides {
+		if isPrivateAddress(net.ParseIP(ip)) {
+			private = append(private, fmt.Sprintf("-host-override %s=%s", host, ip))
+		}
+	}
+	sort.Strings(private)
+
+	proxies := map[string]bool{}
+	for _, target := range []string{archiveBaseURL + "/", cdxAPIURL, availabilityAPIURL} {
+		req, err := http.NewRequest("GET", target, nil)
+		if err != nil {
+			continue
+		}
+		proxyURL, err := upstreamTransport.Proxy(req)
+		if err != nil || proxyURL == nil || proxies[proxyURL.Host] {
+			continue
+		}
+		proxies[proxyURL.Host] = true
+		host := proxyURL.Hostname()
+		if ip := net.ParseIP(host); (ip != nil && isPrivateAddress(ip)) || strings.EqualFold(host, "localhost") {
+			private = append(private, "outbound proxy "+proxyURL.Host+" from the environment")
+		}
+	}
+	return private
+}
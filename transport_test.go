@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// denyPrivateUpstreams installs the private address guard, as main does
+// without -allow-private-ips, for the duration of the test.
+func denyPrivateUpstreams(t *testing.T) {
+	old := upstreamDialer.Control
+	upstreamDialer.Control = denyPrivateAddresses
+	upstreamTransport.CloseIdleConnections()
+	t.Cleanup(func() {
+		upstreamDialer.Control = old
+		upstreamTransport.CloseIdleConnections()
+	})
+}
+
+func TestIsPrivateAddress(t *testing.T) {
+	for _, tc := range []struct {
+		ip      string
+		private bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"172.31.255.255", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"0.0.0.0", true},
+		{"::1", true},
+		{"::", true},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:169.254.169.254", true},
+		{"8.8.8.8", false},
+		{"172.32.0.1", false},
+		{"207.241.224.2", false},
+		{"2606:4700::1111", false},
+	} {
+		if got := isPrivateAddress(net.ParseIP(tc.ip)); got != tc.private {
+			t.Errorf("isPrivateAddress(%s) = %v, want %v", tc.ip, got, tc.private)
+		}
+	}
+}
+
+func TestDenyPrivateAddresses(t *testing.T) {
+	for _, address := range []string{"127.0.0.1:80", "169.254.169.254:80", "[::1]:443", "10.0.0.1:8080"} {
+		if err := denyPrivateAddresses("tcp", address, nil); !errors.Is(err, errPrivateAddress) {
+			t.Errorf("denyPrivateAddresses(%s) = %v, want errPrivateAddress", address, err)
+		}
+	}
+	if err := denyPrivateAddresses("tcp", "93.184.216.34:80", nil); err != nil {
+		t.Errorf("denyPrivateAddresses(public) = %v", err)
+	}
+}
+
+func TestUpstreamTransportRefusesPrivateTargets(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request reached the private server: %s", r.URL)
+	}))
+	defer server.Close()
+	denyPrivateUpstreams(t)
+
+	// localhost resolves to loopback, so a name is refused like an address
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	for _, target := range []string{server.URL, "http://localhost:" + port + "/"} {
+		req, _ := http.NewRequest("GET", target, nil)
+		resp, err := upstreamTransport.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+			t.Errorf("fetching %s succeeded", target)
+		} else if !errors.Is(err, errPrivateAddress) {
+			t.Errorf("fetching %s failed with %v, want errPrivateAddress", target, err)
+		}
+	}
+}
+
+func TestPassthroughRefusesPrivateTargets(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request reached the private server: %s", r.URL)
+	}))
+	defer server.Close()
+	denyPrivateUpstreams(t)
+
+	target, _ := url.Parse(server.URL + "/latest/meta-data/")
+	w := httptest.NewRecorder()
+	serveLive(w, httptest.NewRequest("GET", target.String(), nil), target)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadGateway)
+	}
+}
+
+func TestAllowPrivateIPs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("internal"))
+	}))
+	defer server.Close()
+
+	// Without the guard, as with -allow-private-ips, the server is reached
+	target, _ := url.Parse(server.URL + "/")
+	w := httptest.NewRecorder()
+	serveLive(w, httptest.NewRequest("GET", target.String(), nil), target)
+	if w.Code != http.StatusOK || w.Body.String() != "internal" {
+		t.Errorf("got %d %q, want 200 \"internal\"", w.Code, w.Body.String())
+	}
+}
+
+func TestPrivateUpstreams(t *testing.T) {
+	oldOverrides, oldProxy := hostOverrides, upstreamTransport.Proxy
+	t.Cleanup(func() { hostOverrides, upstreamTransport.Proxy = oldOverrides, oldProxy })
+
+	hostOverrides = map[string]string{"web.archive.org": "207.241.224.2", "www.mirror.example": "192.168.1.10"}
+	upstreamTransport.Proxy = func(*http.Request) (*url.URL, error) { return nil, nil }
+	if got, want := privateUpstreams(), []string{"-host-override www.mirror.example=192.168.1.10"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("privateUpstreams = %q, want %q", got, want)
+	}
+
+	hostOverrides = map[string]string{}
+	for proxy, private := range map[string]bool{
+		"http://10.0.0.1:3128":      true,
+		"http://localhost:3128":     true,
+		"http://203.0.113.5:3128":   false,
+		"http://proxy.example:3128": false,
+	} {
+		proxyURL, _ := url.Parse(proxy)
+		upstreamTransport.Proxy = http.ProxyURL(proxyURL)
+		got := privateUpstreams()
+		if want := []string{"outbound proxy " + proxyURL.Host + " from the environment"}; private && !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: privateUpstreams = %q, want %q", proxy, got, want)
+		} else if !private && len(got) != 0 {
+			t.Errorf("%s: privateUpstreams = %q, want none", proxy, got)
+		}
+	}
+}
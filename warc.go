@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// warcArchive is the index of the -warc files, and nil when there are none.
+// When it is set pages are served from the files and archive.org is never
+// contacted.
+var warcArchive *warcIndex
+
+// warcIndex maps normalized URLs to the response records captured for them,
+// oldest first.
+type warcIndex struct {
+	records map[string][]warcRecordRef
+}
+
+// warcRecordRef locates a response record in a WARC file.
+type warcRecordRef struct {
+	path       string
+	offset     int64 // start of the record, or of its gzip member
+	compressed bool
+	timestamp  string // the capture's WARC-Date as YYYYMMDDhhmmss
+}
+
+// countingReader counts the bytes read through it. It implements
+// io.ByteReader, so gzip reads from it without buffering ahead, and the
+// count is an exact offset into the file.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+func (c *countingReader) ReadString(delim byte) (string, error) {
+	line, err := c.r.ReadString(delim)
+	c.n += int64(len(line))
+	return line, err
+}
+
+// warcReader is what records are read from: a counted file, or the
+// decompressed contents of a gzip member.
+type warcReader interface {
+	io.Reader
+	ReadString(delim byte) (string, error)
+}
+
+// loadWARCIndex indexes the response records of the given WARC files, which
+// may be plain or compressed record by record (.warc.gz).
+func loadWARCIndex(paths []string) (*warcIndex, error) {
+	index := &warcIndex{records: make(map[string][]warcRecordRef)}
+	for _, path := range paths {
+		if err := index.addFile(path); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	for key := range index.records {
+		records := index.records[key]
+		sort.Slice(records, func(i, j int) bool { return records[i].timestamp < records[j].timestamp })
+	}
+	return index, nil
+}
+
+func (index *warcIndex) addFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	compressed := strings.HasSuffix(path, ".gz")
+	in := &countingReader{r: bufio.NewReader(f)}
+	if !compressed {
+		for {
+			offset := in.n
+			if err := index.addRecord(in, path, offset, false); err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+		}
+	}
+
+	// Each gzip member holds one record
+	var zr *gzip.Reader
+	for {
+		offset := in.n
+		if zr == nil {
+			zr, err = gzip.NewReader(in)
+		} else {
+			err = zr.Reset(in)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		zr.Multistream(false)
+		if err := index.addRecord(bufio.NewReader(zr), path, offset, true); err != nil && err != io.EOF {
+			return err
+		}
+		io.Copy(io.Discard, zr)
+	}
+}
+
+// addRecord reads the record at the start of r, indexing it if it is a
+// response.
+func (index *warcIndex) addRecord(r warcReader, path string, offset int64, compressed bool) error {
+	header, err := readWARCHeader(r)
+	if err != nil {
+		return err
+	}
+	length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("record at offset %d has an invalid Content-Length", offset)
+	}
+	if _, err := io.CopyN(io.Discard, r, length); err != nil {
+		return err
+	}
+	if header.Get("WARC-Type") == "response" {
+		index.add(header, warcRecordRef{path: path, offset: offset, compressed: compressed})
+	}
+	return nil
+}
+
+// readWARCHeader reads a record's version line and named fields. Blank
+// lines before the version line, such as the two CRLFs that end the
+// previous record, are skipped.
+func readWARCHeader(r warcReader) (textproto.MIMEHeader, error) {
+	version, err := r.ReadString('\n')
+	for err == nil && strings.TrimSpace(version) == "" {
+		version, err = r.ReadString('\n')
+	}
+	if err == io.EOF && strings.TrimSpace(version) == "" {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(version, "WARC/") {
+		return nil, fmt.Errorf("not a WARC record: %q", strings.TrimSpace(version))
+	}
+
+	header := make(textproto.MIMEHeader)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if i := strings.Index(line, ":"); i > 0 {
+			header.Add(strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]))
+		}
+	}
+	return header, nil
+}
+
+func (index *warcIndex) add(header textproto.MIMEHeader, ref warcRecordRef) {
+	target := strings.Trim(header.Get("WARC-Target-URI"), "<>")
+	key, ok := warcKey(target)
+	if !ok {
+		return
+	}
+	captured, err := time.Parse(time.RFC3339, header.Get("WARC-Date"))
+	if err != nil {
+		return
+	}
+	ref.timestamp = captured.UTC().Format("20060102150405")
+	index.records[key] = append(index.records[key], ref)
+}
+
+// warcKey normalizes rawURL for lookups: the scheme, default port and
+// fragment are ignored and the host is lower-cased.
+func warcKey(rawURL string) (string, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return "", false
+	}
+	host := strings.ToLower(u.Host)
+	host = strings.TrimSuffix(strings.TrimSuffix(host, ":80"), ":443")
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	return host + path, true
+}
+
+// lookup returns the capture of originalURL closest to date.
+func (index *warcIndex) lookup(originalURL string, date string) (warcRecordRef, bool) {
+	key, ok := warcKey(originalURL)
+	if !ok {
+		return warcRecordRef{}, false
+	}
+	records := index.records[key]
+	if len(records) == 0 {
+		return warcRecordRef{}, false
+	}
+
+	want, err := time.Parse(canonicalDateLayout, date)
+	if err != nil {
+		return records[0], true
+	}
+	best, bestDistance := records[0], time.Duration(-1)
+	for _, record := range records {
+		captured, err := time.Parse("20060102150405", record.timestamp)
+		if err != nil {
+			continue
+		}
+		distance := captured.Sub(want)
+		if distance < 0 {
+			distance = -distance
+		}
+		if bestDistance < 0 || distance < bestDistance {
+			best, bestDistance = record, distance
+		}
+	}
+	if *strictDate && !strings.HasPrefix(best.timestamp, date) {
+		return warcRecordRef{}, false
+	}
+	return best, true
+}
+
+// openWARCRecord reads the HTTP response stored in ref. Closing its body
+// closes the WARC file.
+func openWARCRecord(ref warcRecordRef) (*http.Response, error) {
+	f, err := os.Open(ref.path)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := readWARCResponse(f, ref)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{resp.Body, f}
+	return resp, nil
+}
+
+func readWARCResponse(f *os.File, ref warcRecordRef) (*http.Response, error) {
+	if _, err := f.Seek(ref.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var in io.Reader = f
+	if ref.compressed {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		zr.Multistream(false)
+		in = zr
+	}
+	records := bufio.NewReader(in)
+	header, err := readWARCHeader(records)
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid record Content-Length")
+	}
+	return http.ReadResponse(bufio.NewReader(io.LimitReader(records, length)), nil)
+}
+
+// serveFromWARC answers a request for originalURL with its capture in the
+// -warc files closest to date.
+func serveFromWARC(w http.ResponseWriter, originalURL string, date string) {
+	ref, ok := warcArchive.lookup(originalURL, date)
+	if !ok {
+		debugLog("No WARC record for %s", originalURL)
+		serveErrorPage(w, http.StatusNotFound, originalURL, fmt.Sprintf("%v for %s in the WARC files", ErrNoCapture, originalURL))
+		return
+	}
+
+	resp, err := openWARCRecord(ref)
+	if err != nil {
+		errorLog("Error reading WARC record for %s from %s: %v", originalURL, ref.path, err)
+		serveErrorPage(w, http.StatusInternalServerError, originalURL, "Error reading archived version: "+err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	debugLog("Serving %s from %s, captured %s", originalURL, ref.path, ref.timestamp)
+
+	// The stored body may have been chunked; it is sent as it is read
+	resp.Header.Del("Transfer-Encoding")
+	resp.Header.Del("Content-Length")
+	copyHeaders(w.Header(), resp.Header)
+	w.Header().Set("X-Time-Surfer-Timestamp", ref.timestamp)
+	if *originalURLHeader {
+		w.Header().Set("X-Original-URL", originalURL)
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}